@@ -0,0 +1,154 @@
+package collector
+
+import (
+	"strings"
+
+	"mongoshake/dbpool"
+	"mongoshake/executor"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+// AutoHasher distributes the oplogs of the namespaces having unique indexes
+// by namespace, and the others by _id. The namespaces are listed from source
+// at first and refreshed by the index commands in oplogs
+type AutoHasher struct {
+	oplog.Hasher
+
+	src string
+	// namespaces having unique indexes
+	unique map[string]bool
+
+	table      oplog.TableHasher
+	primaryKey oplog.PrimaryKeyHasher
+}
+
+func NewAutoHasher(src string) (*AutoHasher, error) {
+	conn, err := dbpool.NewMongoConn(src, false)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	unique, err := conn.UniqueIndexNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	LOG.Info("Auto hasher distributes namespaces %v by namespace", unique)
+	return &AutoHasher{src: src, unique: unique}, nil
+}
+
+func (hasher *AutoHasher) DistributeOplogByMod(log *oplog.PartialLog, mod int) uint32 {
+	if hasher.unique[log.Namespace] {
+		return hasher.table.DistributeOplogByMod(log, mod)
+	}
+	return hasher.primaryKey.DistributeOplogByMod(log, mod)
+}
+
+// Observe refreshes the namespaces by the index commands. it returns true if
+// the namespace is distributed in another way from now on. the oplog should
+// be observed before distributed
+func (hasher *AutoHasher) Observe(log *oplog.PartialLog) bool {
+	return hasher.observe(log.Operation, log.Namespace, log.Object)
+}
+
+func (hasher *AutoHasher) observe(operation, namespace string, object bson.M) bool {
+	switch operation {
+	case "i":
+		// index built by inserting into system.indexes in old versions
+		if strings.HasSuffix(namespace, ".system.indexes") {
+			if ns, ok := object["ns"].(string); ok && object["unique"] == true {
+				return hasher.set(ns, true)
+			}
+		}
+	case "c":
+		name, ok := executor.IndexCommandName(object)
+		if !ok {
+			return false
+		}
+		database := namespace
+		if index := strings.Index(database, "."); index != -1 {
+			database = database[:index]
+		}
+
+		switch name {
+		case "createIndexes":
+			if collection, ok := object[name].(string); ok && object["unique"] == true {
+				return hasher.set(database+"."+collection, true)
+			}
+		case "commitIndexBuild":
+			// 4.4 builds the indexes in two phases and they are effective
+			// on commit
+			collection, ok := object[name].(string)
+			if !ok {
+				break
+			}
+			indexes, _ := object["indexes"].([]interface{})
+			for _, index := range indexes {
+				if index, ok := index.(bson.M); ok && index["unique"] == true {
+					return hasher.set(database+"."+collection, true)
+				}
+			}
+		case "dropIndex", "dropIndexes", "deleteIndex", "deleteIndexes":
+			// the other unique indexes may be left. it's distributed by
+			// namespace until source has none of them
+			if collection, ok := object[name].(string); ok && hasher.unique[database+"."+collection] {
+				return hasher.refresh(dbpool.NS{Database: database, Collection: collection})
+			}
+		case "renameCollection":
+			// the indexes are moved along
+			from, _ := object[name].(string)
+			to, _ := object["to"].(string)
+			if hasher.unique[from] && to != "" {
+				return hasher.set(to, true)
+			}
+		case "applyOps":
+			// the commands may be wrapped in applyOps
+			changed := false
+			ops, _ := object[name].([]interface{})
+			for _, op := range ops {
+				if op, ok := op.(bson.M); ok {
+					operation, _ := op["op"].(string)
+					ns, _ := op["ns"].(string)
+					o, _ := op["o"].(bson.M)
+					changed = hasher.observe(operation, ns, o) || changed
+				}
+			}
+			return changed
+		}
+	}
+	return false
+}
+
+// refresh lists the indexes of namespace from source
+func (hasher *AutoHasher) refresh(ns dbpool.NS) bool {
+	conn, err := dbpool.NewMongoConn(hasher.src, false)
+	if err != nil {
+		LOG.Critical("Auto hasher refresh indexes of %s failed, keep it by namespace. %v", ns.Str(), err)
+		return false
+	}
+	defer conn.Close()
+
+	unique, err := conn.HasUniqueIndex(ns)
+	if err != nil {
+		LOG.Critical("Auto hasher refresh indexes of %s failed, keep it by namespace. %v", ns.Str(), err)
+		return false
+	}
+	return hasher.set(ns.Str(), unique)
+}
+
+func (hasher *AutoHasher) set(namespace string, unique bool) bool {
+	if hasher.unique[namespace] == unique {
+		return false
+	}
+	if unique {
+		hasher.unique[namespace] = true
+		LOG.Info("Auto hasher distributes %s by namespace from now on", namespace)
+	} else {
+		delete(hasher.unique, namespace)
+		LOG.Info("Auto hasher distributes %s by _id from now on", namespace)
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package collector
+
+import (
+	"testing"
+
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func TestAutoHasherObserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		unique  []string
+		log     *oplog.PartialLog
+		changed bool
+		// namespace distributed by namespace after observed
+		expect string
+	}{
+		{
+			name: "system.indexes",
+			log: &oplog.PartialLog{Operation: "i", Namespace: "db.system.indexes",
+				Object: bson.M{"ns": "db.c", "key": bson.M{"a": 1}, "unique": true}},
+			changed: true,
+			expect:  "db.c",
+		},
+		{
+			name: "createIndexes",
+			log: &oplog.PartialLog{Operation: "c", Namespace: "db.$cmd",
+				Object: bson.M{"createIndexes": "c", "key": bson.M{"a": 1}, "name": "a_1", "unique": true}},
+			changed: true,
+			expect:  "db.c",
+		},
+		{
+			name: "createIndexes not unique",
+			log: &oplog.PartialLog{Operation: "c", Namespace: "db.$cmd",
+				Object: bson.M{"createIndexes": "c", "key": bson.M{"a": 1}, "name": "a_1"}},
+		},
+		{
+			name:   "createIndexes known",
+			unique: []string{"db.c"},
+			log: &oplog.PartialLog{Operation: "c", Namespace: "db.$cmd",
+				Object: bson.M{"createIndexes": "c", "key": bson.M{"a": 1}, "name": "a_1", "unique": true}},
+			expect: "db.c",
+		},
+		{
+			name: "commitIndexBuild",
+			log: &oplog.PartialLog{Operation: "c", Namespace: "db.$cmd",
+				Object: bson.M{"commitIndexBuild": "c", "indexes": []interface{}{
+					bson.M{"key": bson.M{"a": 1}, "name": "a_1"},
+					bson.M{"key": bson.M{"b": 1}, "name": "b_1", "unique": true},
+				}}},
+			changed: true,
+			expect:  "db.c",
+		},
+		{
+			name: "commitIndexBuild not unique",
+			log: &oplog.PartialLog{Operation: "c", Namespace: "db.$cmd",
+				Object: bson.M{"commitIndexBuild": "c", "indexes": []interface{}{
+					bson.M{"key": bson.M{"a": 1}, "name": "a_1"},
+				}}},
+		},
+		{
+			name: "startIndexBuild",
+			log: &oplog.PartialLog{Operation: "c", Namespace: "db.$cmd",
+				Object: bson.M{"startIndexBuild": "c", "indexes": []interface{}{
+					bson.M{"key": bson.M{"a": 1}, "name": "a_1", "unique": true},
+				}}},
+		},
+		{
+			name:   "renameCollection",
+			unique: []string{"db.c"},
+			log: &oplog.PartialLog{Operation: "c", Namespace: "admin.$cmd",
+				Object: bson.M{"renameCollection": "db.c", "to": "db.d"}},
+			changed: true,
+			expect:  "db.d",
+		},
+		{
+			name: "applyOps",
+			log: &oplog.PartialLog{Operation: "c", Namespace: "admin.$cmd",
+				Object: bson.M{"applyOps": []interface{}{
+					bson.M{"op": "i", "ns": "db.c", "o": bson.M{"_id": 1}},
+					bson.M{"op": "c", "ns": "db.$cmd", "o": bson.M{"createIndexes": "c",
+						"key": bson.M{"a": 1}, "name": "a_1", "unique": true}},
+				}}},
+			changed: true,
+			expect:  "db.c",
+		},
+		{
+			name: "applyOps commitIndexBuild",
+			log: &oplog.PartialLog{Operation: "c", Namespace: "admin.$cmd",
+				Object: bson.M{"applyOps": []interface{}{
+					bson.M{"op": "c", "ns": "db.$cmd", "o": bson.M{"commitIndexBuild": "c",
+						"indexes": []interface{}{bson.M{"key": bson.M{"a": 1}, "name": "a_1", "unique": true}}}},
+				}}},
+			changed: true,
+			expect:  "db.c",
+		},
+		{
+			name: "insert",
+			log: &oplog.PartialLog{Operation: "i", Namespace: "db.c",
+				Object: bson.M{"_id": 1, "unique": true}},
+		},
+	}
+	for _, test := range tests {
+		hasher := &AutoHasher{unique: make(map[string]bool)}
+		for _, ns := range test.unique {
+			hasher.unique[ns] = true
+		}
+		if changed := hasher.Observe(test.log); changed != test.changed {
+			t.Errorf("%s: changed is %v, should be %v", test.name, changed, test.changed)
+		}
+		if test.expect != "" && !hasher.unique[test.expect] {
+			t.Errorf("%s: %s should be distributed by namespace", test.name, test.expect)
+		}
+		if test.expect == "" && len(hasher.unique) != 0 {
+			t.Errorf("%s: %v shouldn't be distributed by namespace", test.name, hasher.unique)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"mongoshake/collector/ckpt"
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+	"mongoshake/dbpool"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// getMore waits at most this long for new events
+	changeStreamAwaitTime = 1000 * time.Millisecond
+	changeStreamBatchSize = 8192
+
+	// startAfter is supported since 4.2. resumeAfter can't resume from an
+	// invalidate event
+	changeStreamStartAfterVersion = "4.2.0"
+)
+
+const (
+	ChangeStreamHistoryLost     = 286
+	ChangeStreamFatalError      = 280
+	ChangeStreamHistoryLostText = "resume point may no longer be in the oplog"
+)
+
+var ChangeStreamInvalidatedError = errors.New("change stream invalidated")
+
+// changeEvent is the event document returned by $changeStream
+type changeEvent struct {
+	Id                bson.Raw            `bson:"_id"`
+	OperationType     string              `bson:"operationType"`
+	ClusterTime       bson.MongoTimestamp `bson:"clusterTime"`
+	Ns                changeNamespace     `bson:"ns"`
+	To                changeNamespace     `bson:"to"`
+	DocumentKey       bson.D              `bson:"documentKey"`
+	FullDocument      bson.Raw            `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.D   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+type changeNamespace struct {
+	Db   string `bson:"db"`
+	Coll string `bson:"coll"`
+}
+
+// resumePoint records the token of the last event before timestamp ts.
+// resume after the token gets all the events since ts. empty token means
+// that resume with ts directly
+type resumePoint struct {
+	ts    bson.MongoTimestamp
+	token []byte
+}
+
+// ChangeStreamReader consumes $changeStream of the whole cluster or one
+// database and converts events into oplogs. It doesn't require any privilege
+// on local database. The stream is resumed by tokens which are recorded in
+// checkpoint along with the timestamp.
+type ChangeStreamReader struct {
+	// source mongo address url
+	src string
+	// watched database. the whole cluster if empty
+	database string
+	conn     *dbpool.MongoConn
+
+	// current cursor. batch is the events fetched and not consumed
+	cursorId int64
+	cursorNs string
+	batch    []bson.Raw
+
+	// start position from checkpoint
+	startTs  bson.MongoTimestamp
+	startSet bool
+	// regenerated checkpoint. start from now if history of startTs is lost
+	startFresh bool
+
+	// token of the last event read. the stream is rebuilt from here
+	lastToken  []byte
+	lastTs     bson.MongoTimestamp
+	startAfter bool
+
+	// resume points of events not checkpointed yet in ascend order
+	resumePoints []*resumePoint
+	resumeLock   sync.Mutex
+
+	// oplog channel
+	oplogChan    chan *retOplog
+	fetcherExist bool
+	fetcherLock  sync.Mutex
+	// fetcher waits on it after the errors need recovery
+	rewind chan struct{}
+}
+
+// NewChangeStreamReader creates reader with mongodb url. database is
+// the watched one and empty means the whole cluster
+func NewChangeStreamReader(src string, database string) *ChangeStreamReader {
+	return &ChangeStreamReader{
+		src:       src,
+		database:  database,
+		oplogChan: make(chan *retOplog, oplogChanSize),
+		rewind:    make(chan struct{}),
+	}
+}
+
+func (reader *ChangeStreamReader) SetStartPositionOnEmpty(checkpoint *ckpt.CheckpointContext) {
+	if reader.startSet {
+		return
+	}
+	reader.startSet = true
+	reader.startTs = checkpoint.Timestamp
+	reader.startFresh = !checkpoint.Exist
+	reader.lastToken = checkpoint.ResumeToken
+}
+
+// UpdateQueryTimestamp is useless. the stream is always rebuilt from
+// the last token read
+func (reader *ChangeStreamReader) UpdateQueryTimestamp(ts bson.MongoTimestamp) {
+}
+
+// ResumeToken returns the token resumes from the biggest recorded timestamp
+// that not bigger than ts. the points before it won't be used any more
+func (reader *ChangeStreamReader) ResumeToken(ts bson.MongoTimestamp) []byte {
+	reader.resumeLock.Lock()
+	defer reader.resumeLock.Unlock()
+
+	found := -1
+	for i, point := range reader.resumePoints {
+		if point.ts > ts {
+			break
+		}
+		found = i
+	}
+	if found == -1 {
+		return nil
+	}
+	token := reader.resumePoints[found].token
+	reader.resumePoints = reader.resumePoints[found:]
+	return token
+}
+
+// Rewind reopens the stream at ts after recovery. hash and term are useless
+func (reader *ChangeStreamReader) Rewind(ts bson.MongoTimestamp, hash, term int64) {
+	reader.resumeLock.Lock()
+	reader.resumePoints = nil
+	reader.resumeLock.Unlock()
+	// fetcher is waiting. it's safe to reset the position
+	reader.releaseCursor()
+	reader.startTs = ts
+	reader.lastToken = nil
+	reader.lastTs = 0
+	reader.rewind <- struct{}{}
+}
+
+func (reader *ChangeStreamReader) addResumePoint(ts bson.MongoTimestamp, token []byte) {
+	reader.resumeLock.Lock()
+	reader.resumePoints = append(reader.resumePoints, &resumePoint{ts: ts, token: token})
+	reader.resumeLock.Unlock()
+}
+
+// Next returns an oplog by raw bytes which is []byte
+func (reader *ChangeStreamReader) Next() (*bson.Raw, error) {
+	select {
+	case ret := <-reader.oplogChan:
+		return ret.log, ret.err
+	case <-time.After(time.Second * time.Duration(conf.Options.SyncerReaderBufferTime)):
+		return nil, TimeoutError
+	}
+}
+
+// start fetcher if not exist
+func (reader *ChangeStreamReader) StartFetcher() {
+	if reader.fetcherExist == true {
+		return
+	}
+
+	reader.fetcherLock.Lock()
+	if reader.fetcherExist == false { // double check
+		reader.fetcherExist = true
+		go reader.fetcher()
+	}
+	reader.fetcherLock.Unlock()
+}
+
+// fetch events, convert into oplogs and put into channel
+func (reader *ChangeStreamReader) fetcher() {
+	for {
+		if err := reader.ensureNetwork(); err != nil {
+			reader.oplogChan <- &retOplog{nil, err}
+			if waitRewind(err) {
+				<-reader.rewind
+			}
+			continue
+		}
+
+		if len(reader.batch) == 0 {
+			if err := reader.getMore(); err != nil {
+				reader.releaseCursor()
+				reader.oplogChan <- &retOplog{nil, err}
+				if waitRewind(err) {
+					<-reader.rewind
+				}
+				continue
+			}
+			if len(reader.batch) == 0 {
+				// await timeout
+				reader.oplogChan <- &retOplog{nil, TimeoutError}
+				continue
+			}
+		}
+
+		event := new(changeEvent)
+		raw := reader.batch[0]
+		reader.batch = reader.batch[1:]
+		if err := raw.Unmarshal(event); err != nil {
+			reader.oplogChan <- &retOplog{nil, fmt.Errorf("decode change event failed. %v", err)}
+			continue
+		}
+
+		log, err := reader.convert(event)
+		if err == ChangeStreamInvalidatedError {
+			// the watched database is dropped. rebuild the stream after the
+			// invalidate event
+			LOG.Warn("Change stream on database[%s] invalidated, rebuild it", reader.database)
+			reader.releaseCursor()
+			reader.lastToken = append([]byte(nil), event.Id.Data...)
+			reader.startAfter = true
+			continue
+		}
+		if err != nil {
+			reader.oplogChan <- &retOplog{nil, err}
+			continue
+		}
+
+		// the first event of every timestamp is resumed after the previous one
+		if event.ClusterTime != reader.lastTs {
+			reader.addResumePoint(event.ClusterTime, reader.lastToken)
+			reader.lastTs = event.ClusterTime
+		}
+		// copy it. otherwise the whole batch is referenced
+		reader.lastToken = append([]byte(nil), event.Id.Data...)
+		if log != nil {
+			reader.oplogChan <- &retOplog{log, nil}
+		}
+	}
+}
+
+// ensureNetwork establish the mongodb connection and open the change
+// stream if current cursor is not ready
+func (reader *ChangeStreamReader) ensureNetwork() (err error) {
+	if reader.cursorId != 0 || len(reader.batch) != 0 {
+		return nil
+	}
+	if reader.conn == nil || (reader.conn != nil && !reader.conn.IsGood()) {
+		if reader.conn != nil {
+			reader.conn.Close()
+		}
+		// reconnect
+		if reader.conn, err = dbpool.NewMongoConn(reader.src, false); reader.conn == nil || err != nil {
+			err = fmt.Errorf("reconnect mongo instance [%s] error. %v", reader.src, err)
+			return err
+		}
+		// getMore should be sent to the server that cursor opened on
+		reader.conn.Session.SetMode(mgo.Monotonic, true)
+	}
+
+	if err = reader.open(reader.changeStreamStage()); err != nil && reader.isHistoryLost(err) &&
+		reader.startFresh && len(reader.lastToken) == 0 {
+		// start position isn't from an existing checkpoint
+		LOG.Warn("Change stream start position[%d] is out of oplog window, start from now",
+			utils.ExtractMongoTimestamp(reader.startTs))
+		err = reader.open(bson.D{})
+	}
+	if err != nil {
+		if reader.isHistoryLost(err) {
+			LOG.Error("change stream resume point is lost: %v", err)
+			return CollectionCappedError
+		}
+		return fmt.Errorf("open change stream failed. %v", err)
+	}
+	reader.startFresh = false
+	return nil
+}
+
+// changeStreamStage returns options of $changeStream located by last
+// token or start timestamp
+func (reader *ChangeStreamReader) changeStreamStage() bson.D {
+	switch {
+	case len(reader.lastToken) != 0:
+		resume := "resumeAfter"
+		if reader.startAfter || utils.GetAndCompareVersion(reader.conn.Session, changeStreamStartAfterVersion) {
+			resume = "startAfter"
+		}
+		return bson.D{{resume, bson.Raw{Kind: 0x03, Data: reader.lastToken}}}
+	case reader.startTs != 0:
+		return bson.D{{"startAtOperationTime", reader.startTs}}
+	default:
+		return bson.D{}
+	}
+}
+
+func (reader *ChangeStreamReader) open(stage bson.D) error {
+	database := reader.database
+	if database == "" {
+		database = "admin"
+		stage = append(stage, bson.DocElem{Name: "allChangesForCluster", Value: true})
+	}
+
+	var result struct {
+		Cursor commandCursorResult `bson:"cursor"`
+	}
+	if err := reader.conn.Session.DB(database).Run(bson.D{
+		{"aggregate", 1},
+		{"pipeline", []bson.M{{"$changeStream": stage}}},
+		{"cursor", bson.M{"batchSize": changeStreamBatchSize}}}, &result); err != nil {
+		return err
+	}
+
+	LOG.Info("Change stream opened on [%s] with %v. cursor[%d]", database, stage, result.Cursor.Id)
+	reader.cursorId = result.Cursor.Id
+	reader.cursorNs = result.Cursor.NS
+	reader.batch = result.Cursor.FirstBatch
+	reader.startAfter = false
+	return nil
+}
+
+func (reader *ChangeStreamReader) getMore() error {
+	ns := strings.SplitN(reader.cursorNs, ".", 2)
+	if len(ns) != 2 {
+		return fmt.Errorf("change stream cursor namespace[%s] is illegal", reader.cursorNs)
+	}
+
+	var result struct {
+		Cursor commandCursorResult `bson:"cursor"`
+	}
+	if err := reader.conn.Session.DB(ns[0]).Run(bson.D{
+		{"getMore", reader.cursorId},
+		{"collection", ns[1]},
+		{"batchSize", changeStreamBatchSize},
+		{"maxTimeMS", int64(changeStreamAwaitTime / time.Millisecond)}}, &result); err != nil {
+		if reader.isHistoryLost(err) {
+			LOG.Error("change stream resume point is lost: %v", err)
+			return CollectionCappedError
+		}
+		return fmt.Errorf("get next change event failed. release cursor, %v", err)
+	}
+
+	reader.batch = result.Cursor.NextBatch
+	if result.Cursor.Id == 0 {
+		// closed by server. reopen it on next round
+		reader.cursorId = 0
+	}
+	return nil
+}
+
+func (reader *ChangeStreamReader) releaseCursor() {
+	if reader.cursorId != 0 && reader.conn != nil {
+		ns := strings.SplitN(reader.cursorNs, ".", 2)
+		reader.conn.Session.DB(ns[0]).Run(bson.D{
+			{"killCursors", ns[len(ns)-1]},
+			{"cursors", []int64{reader.cursorId}}}, nil)
+	}
+	reader.cursorId = 0
+	reader.batch = nil
+}
+
+func (reader *ChangeStreamReader) isHistoryLost(err error) bool {
+	if e, ok := err.(*mgo.QueryError); ok && (e.Code == ChangeStreamHistoryLost || e.Code == ChangeStreamFatalError) {
+		return true
+	}
+	return strings.Contains(err.Error(), ChangeStreamHistoryLostText)
+}
+
+// convert change event into oplog. returns nil if it needn't be replayed
+func (reader *ChangeStreamReader) convert(event *changeEvent) (*bson.Raw, error) {
+	ns := event.Ns.Db + "." + event.Ns.Coll
+	command := event.Ns.Db + ".$cmd"
+
+	var log bson.D
+	switch event.OperationType {
+	case "insert":
+		log = bson.D{{"op", "i"}, {"ns", ns}, {"o", event.FullDocument}}
+	case "update":
+		var update bson.D
+		if len(event.UpdateDescription.UpdatedFields) != 0 {
+			update = append(update, bson.DocElem{Name: "$set", Value: event.UpdateDescription.UpdatedFields})
+		}
+		if len(event.UpdateDescription.RemovedFields) != 0 {
+			var unset bson.D
+			for _, field := range event.UpdateDescription.RemovedFields {
+				unset = append(unset, bson.DocElem{Name: field, Value: 1})
+			}
+			update = append(update, bson.DocElem{Name: "$unset", Value: unset})
+		}
+		if len(update) == 0 {
+			return nil, nil
+		}
+		log = bson.D{{"op", "u"}, {"ns", ns}, {"o", update}, {"o2", event.DocumentKey}}
+	case "replace":
+		log = bson.D{{"op", "u"}, {"ns", ns}, {"o", event.FullDocument}, {"o2", event.DocumentKey}}
+	case "delete":
+		log = bson.D{{"op", "d"}, {"ns", ns}, {"o", event.DocumentKey}}
+	case "drop":
+		log = bson.D{{"op", "c"}, {"ns", command}, {"o", bson.D{{"drop", event.Ns.Coll}}}}
+	case "rename":
+		log = bson.D{{"op", "c"}, {"ns", "admin.$cmd"}, {"o", bson.D{{"renameCollection", ns},
+			{"to", event.To.Db + "." + event.To.Coll}}}}
+	case "dropDatabase":
+		log = bson.D{{"op", "c"}, {"ns", command}, {"o", bson.D{{"dropDatabase", 1}}}}
+	case "invalidate":
+		return nil, ChangeStreamInvalidatedError
+	default:
+		LOG.Debug("Change stream skip event type[%s] on %s", event.OperationType, ns)
+		return nil, nil
+	}
+
+	data, err := bson.Marshal(append(bson.D{{"ts", event.ClusterTime}}, log...))
+	if err != nil {
+		return nil, fmt.Errorf("encode change event failed. %v", err)
+	}
+	return &bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// commandCursorResult is the cursor returned by aggregate and getMore
+type commandCursorResult struct {
+	FirstBatch []bson.Raw `bson:"firstBatch"`
+	NextBatch  []bson.Raw `bson:"nextBatch"`
+	NS         string     `bson:"ns"`
+	Id         int64      `bson:"id"`
+}
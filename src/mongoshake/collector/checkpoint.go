@@ -21,7 +21,20 @@ func (sync *OplogSyncer) newCheckpointManager(name string) {
 	sync.ckptManager = ckpt.NewCheckpointManager(name)
 }
 
+// suspendCheckpoint stops or resumes updating the checkpoint. the position
+// is persisted by the document copying itself when it's finished
+func (sync *OplogSyncer) suspendCheckpoint(suspend bool) {
+	if suspend {
+		atomic.StoreInt32(&sync.ckptSuspended, 1)
+	} else {
+		atomic.StoreInt32(&sync.ckptSuspended, 0)
+	}
+}
+
 func (sync *OplogSyncer) checkpoint() {
+	if atomic.LoadInt32(&sync.ckptSuspended) != 0 {
+		return
+	}
 	now := time.Now()
 
 	// do checkpoint every once in a while
@@ -44,10 +57,16 @@ func (sync *OplogSyncer) checkpoint() {
 	inMemoryTs := sync.ckptManager.GetInMemory().Timestamp
 	var lowest int64 = 0
 	var err error
-	if lowest, err = sync.calculateWorkerLowestCheckpoint(); lowest > 0 && err == nil {
+	lowest, err = sync.calculateWorkerLowestCheckpoint()
+	if safe := sync.safeTimestamp(); safe > lowest {
+		// idle or all the oplogs are filtered
+		lowest, err = safe, nil
+	}
+	if lowest > 0 && err == nil {
 		switch {
 		case bson.MongoTimestamp(lowest) > inMemoryTs:
-			if err = sync.ckptManager.Update(bson.MongoTimestamp(lowest)); err == nil {
+			position := sync.position(bson.MongoTimestamp(lowest))
+			if err = sync.ckptManager.UpdatePosition(position); err == nil {
 				LOG.Info("CheckpointOperation write success. updated from %d to %d", inMemoryTs, lowest)
 				sync.replMetric.AddCheckpoint(1)
 				sync.replMetric.SetLSNCheckpoint(lowest)
@@ -65,6 +84,39 @@ func (sync *OplogSyncer) checkpoint() {
 		lowest, utils.TimestampToInt64(inMemoryTs), err)
 }
 
+// position returns the checkpoint position of ts. the hash and term are
+// known if ts is the last oplog of a dispatched batch. that's the case of
+// the ack value from worker. positions not bigger than ts are released
+func (sync *OplogSyncer) position(ts bson.MongoTimestamp) *ckpt.Position {
+	position := &ckpt.Position{Timestamp: ts, ResumeToken: sync.reader.ResumeToken(ts)}
+	if dispatched, exist := sync.positions[ts]; exist {
+		position.Hash, position.Term = dispatched.Hash, dispatched.Term
+	}
+	for key := range sync.positions {
+		if key <= ts {
+			delete(sync.positions, key)
+		}
+	}
+	return position
+}
+
+// safeTimestamp returns the timestamp of the last oplog seen by batcher if
+// all the oplogs dispatched have been acked. the oplogs before are either
+// filtered or replayed. so the checkpoint can move there even if nothing is
+// dispatched. 0 if any worker isn't drained
+func (sync *OplogSyncer) safeTimestamp() int64 {
+	seen := sync.batcher.getLastSeen()
+	if seen == nil {
+		return 0
+	}
+	for _, worker := range sync.batcher.workerGroup {
+		if !worker.drained() {
+			return 0
+		}
+	}
+	return utils.TimestampToInt64(seen.Timestamp)
+}
+
 func (sync *OplogSyncer) calculateWorkerLowestCheckpoint() (v int64, err error) {
 	// don't need to lock and eventually consistence is acceptable
 	allAcked := true
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"net/http"
+	"sync"
 
 	"mongoshake/collector/configure"
 	"mongoshake/common"
@@ -29,6 +31,84 @@ const (
 type CheckpointContext struct {
 	Name      string              `bson:"name" json:"name"`
 	Timestamp bson.MongoTimestamp `bson:"ckpt" json:"ckpt"`
+	// resume token of change stream in bson encoding. reading resumes after
+	// the token gets all the oplogs since Timestamp. empty if reader is
+	// located by timestamp only
+	ResumeToken []byte `bson:"resume_token,omitempty" json:"resume_token,omitempty"`
+	// hash and term of the oplog at Timestamp. used to verify that the
+	// entry hasn't been rolled back in source. zero if unknown
+	Hash int64 `bson:"h,omitempty" json:"h,omitempty"`
+	Term int64 `bson:"t,omitempty" json:"t,omitempty"`
+
+	// document sync progress. empty if no document sync is in progress
+	DocumentSync *DocumentSyncContext `bson:"doc_sync,omitempty" json:"doc_sync,omitempty"`
+	// filter rules changed through rest api. they take the place of the
+	// filters in configuration. empty if never changed
+	Filter *FilterContext `bson:"filter,omitempty" json:"filter,omitempty"`
+
+	// checkpoint has been loaded from remote storage rather than
+	// regenerated by start position. never persistent
+	Exist bool `bson:"-" json:"-"`
+}
+
+type DocumentSyncContext struct {
+	Ranges []*DocumentRange `bson:"ranges" json:"ranges"`
+}
+
+// FilterContext is the rules of filters can be changed at runtime. the
+// fields are the same as the configuration
+type FilterContext struct {
+	NamespaceWhite []string `bson:"namespace_white,omitempty" json:"namespace_white,omitempty"`
+	NamespaceBlack []string `bson:"namespace_black,omitempty" json:"namespace_black,omitempty"`
+	OperationBlack []string `bson:"operation_black,omitempty" json:"operation_black,omitempty"`
+	DDLWhite       []string `bson:"ddl_white,omitempty" json:"ddl_white,omitempty"`
+	DDLBlack       []string `bson:"ddl_black,omitempty" json:"ddl_black,omitempty"`
+	Document       string   `bson:"document,omitempty" json:"document,omitempty"`
+}
+
+// DocumentRange is an _id range [Min, Max) of one collection that copied
+// in document sync. Boundaries are kept in bson encoding so that their
+// types are preserved in json storage as well. empty means unbounded
+type DocumentRange struct {
+	Namespace string `bson:"ns" json:"ns"`
+	Min       []byte `bson:"min" json:"min"`
+	Max       []byte `bson:"max" json:"max"`
+	Done      bool   `bson:"done" json:"done"`
+}
+
+func NewDocumentRange(ns string, min, max interface{}) (*DocumentRange, error) {
+	var err error
+	documentRange := &DocumentRange{Namespace: ns}
+	if min != nil {
+		if documentRange.Min, err = bson.Marshal(bson.M{"_id": min}); err != nil {
+			return nil, err
+		}
+	}
+	if max != nil {
+		if documentRange.Max, err = bson.Marshal(bson.M{"_id": max}); err != nil {
+			return nil, err
+		}
+	}
+	return documentRange, nil
+}
+
+// Query returns the statement that matches all documents in this range
+func (documentRange *DocumentRange) Query() (bson.M, error) {
+	condition := bson.M{}
+	for op, bound := range map[string][]byte{"$gte": documentRange.Min, "$lt": documentRange.Max} {
+		if len(bound) == 0 {
+			continue
+		}
+		value := bson.M{}
+		if err := bson.Unmarshal(bound, &value); err != nil {
+			return nil, err
+		}
+		condition[op] = value["_id"]
+	}
+	if len(condition) == 0 {
+		return bson.M{}, nil
+	}
+	return bson.M{"_id": condition}, nil
 }
 
 type Checkpoint struct {
@@ -41,6 +121,8 @@ type CheckpointManager struct {
 
 	ctx      *CheckpointContext
 	delegate CheckpointOperation
+	// the context is changed and persisted by syncer and rest api
+	lock sync.Mutex
 }
 
 func NewCheckpointManager(name string) *CheckpointManager {
@@ -71,6 +153,9 @@ func NewCheckpointManager(name string) *CheckpointManager {
 }
 
 func (manager *CheckpointManager) Get() *CheckpointContext {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
 	manager.ctx = manager.delegate.Get()
 	return manager.ctx
 }
@@ -80,14 +165,147 @@ func (manager *CheckpointManager) GetInMemory() *CheckpointContext {
 }
 
 func (manager *CheckpointManager) Update(ts bson.MongoTimestamp) error {
+	return manager.UpdatePosition(&Position{Timestamp: ts})
+}
+
+// Position locates the oplog that checkpoint updated to
+type Position struct {
+	Timestamp   bson.MongoTimestamp
+	Hash, Term  int64
+	ResumeToken []byte
+}
+
+// UpdatePosition records the hash, term and resume token along with timestamp
+func (manager *CheckpointManager) UpdatePosition(position *Position) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.ctx == nil || len(manager.ctx.Name) == 0 {
+		return errors.New("current ckpt context is empty")
+	}
+
+	manager.ctx.Timestamp = position.Timestamp
+	manager.ctx.Hash = position.Hash
+	manager.ctx.Term = position.Term
+	manager.ctx.ResumeToken = position.ResumeToken
+	return manager.delegate.Insert(manager.ctx)
+}
+
+// Flush persists the in memory context without any changes
+func (manager *CheckpointManager) Flush() error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
 	if manager.ctx == nil || len(manager.ctx.Name) == 0 {
 		return errors.New("current ckpt context is empty")
 	}
 
-	manager.ctx.Timestamp = ts
 	return manager.delegate.Insert(manager.ctx)
 }
 
+// UpdateFilter persists the filter rules along with the position in memory.
+// the rules in memory are kept unchanged if failed
+func (manager *CheckpointManager) UpdateFilter(filter *FilterContext) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.ctx == nil || len(manager.ctx.Name) == 0 {
+		return errors.New("current ckpt context is empty")
+	}
+
+	previous := manager.ctx.Filter
+	manager.ctx.Filter = filter
+	if err := manager.delegate.Insert(manager.ctx); err != nil {
+		manager.ctx.Filter = previous
+		return err
+	}
+	return nil
+}
+
+// StartDocumentSync persists the plan of document sync along with the
+// position that oplog tailing starts from after copying. the context is
+// kept unchanged if failed
+func (manager *CheckpointManager) StartDocumentSync(position *Position, plan *DocumentSyncContext) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.ctx == nil || len(manager.ctx.Name) == 0 {
+		return errors.New("current ckpt context is empty")
+	}
+
+	previous := *manager.ctx
+	manager.ctx.Timestamp = position.Timestamp
+	manager.ctx.Hash = position.Hash
+	manager.ctx.Term = position.Term
+	manager.ctx.ResumeToken = position.ResumeToken
+	manager.ctx.DocumentSync = plan
+	if err := manager.delegate.Insert(manager.ctx); err != nil {
+		*manager.ctx = previous
+		return err
+	}
+	return nil
+}
+
+// UnfinishedRanges returns the position recorded by StartDocumentSync and
+// the ranges not done. exist is false if no document sync is in progress
+func (manager *CheckpointManager) UnfinishedRanges() (ts bson.MongoTimestamp, ranges []*DocumentRange, exist bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.ctx == nil || manager.ctx.DocumentSync == nil {
+		return 0, nil, false
+	}
+	for _, documentRange := range manager.ctx.DocumentSync.Ranges {
+		if !documentRange.Done {
+			ranges = append(ranges, documentRange)
+		}
+	}
+	return manager.ctx.Timestamp, ranges, true
+}
+
+// CountRanges returns the number of all ranges and the done ones in the
+// document sync in progress
+func (manager *CheckpointManager) CountRanges() (total, done int) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.ctx == nil || manager.ctx.DocumentSync == nil {
+		return 0, 0
+	}
+	for _, documentRange := range manager.ctx.DocumentSync.Ranges {
+		total++
+		if documentRange.Done {
+			done++
+		}
+	}
+	return total, done
+}
+
+// FinishRange marks the range returned by UnfinishedRanges done and
+// persists the progress
+func (manager *CheckpointManager) FinishRange(documentRange *DocumentRange) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.ctx == nil || len(manager.ctx.Name) == 0 {
+		return errors.New("current ckpt context is empty")
+	}
+
+	documentRange.Done = true
+	return manager.delegate.Insert(manager.ctx)
+}
+
+// ClearDocumentSync removes the progress of document sync in memory. it's
+// persisted along with the next position updated
+func (manager *CheckpointManager) ClearDocumentSync() {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.ctx != nil {
+		manager.ctx.DocumentSync = nil
+	}
+}
+
 type CheckpointOperation interface {
 	// read checkpoint from remote storage. and encapsulation
 	// with CheckpointContext struct
@@ -142,6 +360,7 @@ func (ckpt *MongoCheckpoint) Get() *CheckpointContext {
 	value := new(CheckpointContext)
 	if err = ckpt.QueryHandle.Find(bson.M{CheckpointName: ckpt.Name}).One(value); err == nil {
 		LOG.Info("Load exist checkpoint. content %v", value)
+		value.Exist = true
 		return value
 	} else if err == mgo.ErrNotFound {
 		// we can't insert Timestamp(0, 0) that will be treat as Now() inserted
@@ -201,6 +420,8 @@ func (ckpt *HttpApiCheckpoint) Get() *CheckpointContext {
 	if value.Timestamp == 0 {
 		// use default start position
 		value.Timestamp = bson.MongoTimestamp(ckpt.StartPosition)
+	} else {
+		value.Exist = true
 	}
 	if len(value.Name) == 0 {
 		// default name
@@ -211,7 +432,14 @@ func (ckpt *HttpApiCheckpoint) Get() *CheckpointContext {
 
 func (ckpt *HttpApiCheckpoint) Insert(insert *CheckpointContext) error {
 	body, _ := json.Marshal(insert)
-	if resp, err := http.Post(ckpt.URL, "application/json", bytes.NewReader(body)); err != nil || resp.StatusCode != http.StatusOK {
+	resp, err := http.Post(ckpt.URL, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("response status %s", resp.Status)
+		}
+	}
+	if err != nil {
 		LOG.Warn("Context api manager write request failed, %v", err)
 		return err
 	}
@@ -3,6 +3,9 @@ package conf
 type Configuration struct {
 	MongoUrls               []string `config:"mongo_urls"`
 	CollectorId             string   `config:"collector.id"`
+	SyncMode                string   `config:"sync_mode"`
+	DocumentSplitSize       int64    `config:"document.split_size"`
+	DocumentIndexAfterCopy  bool     `config:"document.index_after_copy"`
 	CheckpointInterval      int64    `config:"checkpoint.interval"`
 	HTTPListenPort          int      `config:"http_profile"`
 	SystemProfile           int      `config:"system_profile"`
@@ -11,9 +14,19 @@ type Configuration struct {
 	LogBuffer               bool     `config:"log_buffer"`
 	OplogGIDS               string   `config:"oplog.gids"`
 	ShardKey                string   `config:"shard_key"`
+	ShardKeyFields          []string `config:"shard_key.fields"`
 	SyncerReaderBufferTime  uint     `config:"syncer.reader.buffer_time"`
+	SyncerReaderMethod      string   `config:"syncer.reader.method"`
+	SyncerReaderWatchDatabase string `config:"syncer.reader.watch_database"`
+	RollbackPolicy          string   `config:"rollback.policy"`
+	CappedPolicy            string   `config:"capped.policy"`
 	WorkerNum               int      `config:"worker"`
 	WorkerOplogCompressor   string   `config:"worker.oplog_compressor"`
+	WorkerOplogCompressLevel int     `config:"worker.oplog_compressor.level"`
+	WorkerOplogCompressMode string   `config:"worker.oplog_compressor.mode"`
+	WorkerOplogEncryptor    string   `config:"worker.oplog_encryptor"`
+	WorkerOplogEncryptorKeyFile string `config:"worker.oplog_encryptor.key_file"`
+	WorkerOplogEncryptorKeyId uint    `config:"worker.oplog_encryptor.key_id"`
 	WorkerBatchQueueSize    uint64   `config:"worker.batch_queue_size"`
 	AdaptiveBatchingMaxSize int   `config:"adaptive.batching_max_size"`
 	FetcherBufferCapacity   int   `config:"fetcher.buffer_capacity"`
@@ -26,6 +39,15 @@ type Configuration struct {
 	ContextStartPosition    int64    `config:"context.start_position" type:"date"`
 	FilterNamespaceBlack    []string `config:"filter.namespace.black"`
 	FilterNamespaceWhite    []string `config:"filter.namespace.white"`
+	FilterOperationBlack    []string `config:"filter.operation.black"`
+	FilterDDLWhite          []string `config:"filter.ddl.white"`
+	FilterDDLBlack          []string `config:"filter.ddl.black"`
+	FilterDocument          string   `config:"filter.document"`
+	NamespaceMapping        []string `config:"namespace.mapping"`
+	TransformRules          []string `config:"transform.rules"`
+	TransformHashSalt       string   `config:"transform.hash_salt"`
+	TransformPlugins        []string `config:"transform.plugins"`
+	TransactionAtomic       bool     `config:"transaction.atomic"`
 
 	ReplayerDMLOnly                   bool   `config:"replayer.dml_only"`
 	ReplayerExecutor                  int    `config:"replayer.executor"`
@@ -0,0 +1,520 @@
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"mongoshake/collector/ckpt"
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+	"mongoshake/dbpool"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	SyncModeAll      = "all"
+	SyncModeDocument = "document"
+	SyncModeOplog    = "oplog"
+
+	// documents fetched in one round trip while copying collections
+	DocumentBatchSize = 8192
+	// sampled documents for each range while splitVector is unavailable
+	DocumentSamplesPerRange = 10
+)
+
+// DocumentSyncer copies the snapshot of every collection in source MongoDB
+// before oplog tailing. Collections are split into _id ranges and copied
+// concurrently. Every copier owns one worker of the related OplogSyncer and
+// converts documents into insert oplogs. So they go through the same modules
+// and tunnel as the tailed oplogs. A range is marked done in checkpoint only
+// after all of its documents are acked. So a restart only copies the ranges
+// that unfinished.
+type DocumentSyncer struct {
+	// related oplog syncer. not owned
+	syncer *OplogSyncer
+	// source mongo address url
+	src string
+	// only namespace related filters make sense on documents
+	filterList OplogFilterChain
+	// documents are copied only if they match it. nil means all
+	expression bson.M
+	// re-sync only. oplog tailing starts from startTs rather than the
+	// newest if it isn't zero. the collections copied and drops are
+	// dropped on target before copying
+	resync  bool
+	startTs bson.MongoTimestamp
+	drops   []string
+
+	conn *dbpool.MongoConn
+}
+
+func NewDocumentSyncer(syncer *OplogSyncer, src string) *DocumentSyncer {
+	// the rules in use. they may be changed at runtime
+	rules := syncer.batcher.getFilters().rules
+	filterList := OplogFilterChain{new(AutologousFilter)}
+	if len(rules.NamespaceWhite) != 0 || len(rules.NamespaceBlack) != 0 {
+		filterList = append(filterList, NewNamespaceFilter(rules.NamespaceWhite, rules.NamespaceBlack))
+	}
+
+	var expression bson.M
+	if rules.Document != "" {
+		// it's validated already
+		if documentFilter, err := NewDocumentFilter(rules.Document); err == nil {
+			expression = documentFilter.Expression
+		} else {
+			LOG.Critical("Document syncer create document filter failed. %v", err)
+		}
+	}
+
+	return &DocumentSyncer{
+		syncer:     syncer,
+		src:        src,
+		filterList: filterList,
+		expression: expression,
+	}
+}
+
+// NewResyncer creates the syncer that copies the namespaces again. they are
+// given in the form of namespace filter and "db" means the whole database.
+// empty means all the namespaces
+func NewResyncer(syncer *OplogSyncer, src string, namespaces, drops []string,
+	startTs bson.MongoTimestamp) *DocumentSyncer {
+	doc := NewDocumentSyncer(syncer, src)
+	if len(namespaces) != 0 {
+		doc.filterList = append(doc.filterList, NewNamespaceFilter(namespaces, nil))
+	}
+	doc.resync = true
+	doc.startTs = startTs
+	doc.drops = drops
+	return doc
+}
+
+// Run copies all the unfinished ranges and waits until all of them are
+// acked. returns the oplog timestamp recorded before copying, that oplog
+// tailing should start from
+func (doc *DocumentSyncer) Run() (bson.MongoTimestamp, error) {
+	var err error
+	if doc.conn, err = dbpool.NewMongoConn(doc.src, false); err != nil {
+		return 0, fmt.Errorf("connect mongo instance [%s] error. %v", doc.src, err)
+	}
+	defer doc.conn.Close()
+
+	var specs []*dbpool.CollectionSpec
+	manager := doc.syncer.ckptManager
+	startTs, unfinished, exist := manager.UnfinishedRanges()
+	if !exist {
+		if specs, err = doc.prepare(); err != nil {
+			return 0, err
+		}
+		startTs, unfinished, _ = manager.UnfinishedRanges()
+	} else {
+		LOG.Info("Document syncer resume unfinished ranges. replset[%s] start_ts[%d]",
+			doc.syncer.replset, utils.ExtractMongoTimestamp(startTs))
+		if specs, err = doc.loadCollections(); err != nil {
+			return 0, fmt.Errorf("load collections failed. %v", err)
+		}
+	}
+
+	// options like capped and collation can't be changed after documents
+	// inserted. so collections are always created before copying
+	if err = doc.syncMeta(startTs, specs, !conf.Options.DocumentIndexAfterCopy); err != nil {
+		return 0, err
+	}
+
+	ranges := make(chan *ckpt.DocumentRange, len(unfinished))
+	for _, documentRange := range unfinished {
+		ranges <- documentRange
+	}
+	close(ranges)
+	total, _ := manager.CountRanges()
+	LOG.Info("Document syncer start. replset[%s] ranges[%d] unfinished[%d]",
+		doc.syncer.replset, total, len(ranges))
+
+	// every copier owns a worker exclusively
+	errs := make(chan error, len(doc.syncer.batcher.workerGroup))
+	latch := new(sync.WaitGroup)
+	for _, worker := range doc.syncer.batcher.workerGroup {
+		latch.Add(1)
+		go func(worker *Worker) {
+			defer latch.Done()
+			for documentRange := range ranges {
+				if err := doc.copyRange(worker, documentRange, startTs); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(worker)
+	}
+	latch.Wait()
+
+	select {
+	case err = <-errs:
+		return 0, err
+	default:
+	}
+
+	if conf.Options.DocumentIndexAfterCopy {
+		if err = doc.syncIndexes(startTs, specs); err != nil {
+			return 0, err
+		}
+	}
+
+	LOG.Info("Document syncer finished. replset[%s]", doc.syncer.replset)
+	manager.ClearDocumentSync()
+	return startTs, nil
+}
+
+// prepare records the newest oplog timestamp and splits all the collections
+// into ranges. the plan is persisted before any document copied. returns
+// the collections should be synced
+func (doc *DocumentSyncer) prepare() ([]*dbpool.CollectionSpec, error) {
+	// the newest oplog should be recorded firstly. all the changes
+	// happened during copying will be replayed from here
+	startTs := doc.startTs
+	var err error
+	if startTs == 0 {
+		if startTs, err = newestTimestamp(doc.conn); err != nil {
+			return nil, fmt.Errorf("get newest oplog timestamp failed. %v", err)
+		}
+	}
+
+	var specs []*dbpool.CollectionSpec
+	if specs, err = doc.loadCollections(); err != nil {
+		return nil, fmt.Errorf("load collections failed. %v", err)
+	}
+
+	plan := &ckpt.DocumentSyncContext{}
+	for _, spec := range specs {
+		if spec.IsView() {
+			// views have no documents
+			continue
+		}
+		ns := spec.NS
+		ranges, err := doc.split(ns)
+		if err != nil {
+			return nil, fmt.Errorf("split collection %s failed. %v", ns.Str(), err)
+		}
+		LOG.Info("Document syncer split %s into %d ranges", ns.Str(), len(ranges))
+		plan.Ranges = append(plan.Ranges, ranges...)
+	}
+
+	if doc.resync {
+		if err = doc.drop(startTs, specs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = doc.syncer.ckptManager.StartDocumentSync(&ckpt.Position{Timestamp: startTs}, plan); err != nil {
+		return nil, fmt.Errorf("record document sync plan failed. %v", err)
+	}
+	return specs, nil
+}
+
+// drop removes the namespaces should be re-synced on target by command
+// oplogs. it's done before the plan persisted. so they are dropped again if
+// restarted before that
+func (doc *DocumentSyncer) drop(ts bson.MongoTimestamp, specs []*dbpool.CollectionSpec) error {
+	drops := append([]string(nil), doc.drops...)
+	exist := make(map[string]bool)
+	for _, ns := range drops {
+		exist[ns] = true
+	}
+	for _, spec := range specs {
+		if !exist[spec.NS.Str()] {
+			exist[spec.NS.Str()] = true
+			drops = append(drops, spec.NS.Str())
+		}
+	}
+	if len(drops) == 0 {
+		return nil
+	}
+
+	batch := make([]*oplog.GenericOplog, 0, len(drops))
+	for _, ns := range drops {
+		var log *oplog.GenericOplog
+		var err error
+		if dc := strings.SplitN(ns, ".", 2); len(dc) == 1 {
+			log, err = NewCommandOplog(ns, ts, bson.D{{"dropDatabase", 1}})
+		} else {
+			log, err = NewCommandOplog(dc[0], ts, bson.D{{"drop", dc[1]}})
+		}
+		if err != nil {
+			return fmt.Errorf("convert drop of %s failed. %v", ns, err)
+		}
+		batch = append(batch, log)
+	}
+
+	doc.shipCommands(batch)
+	LOG.Info("Document syncer drop %v before re-sync", drops)
+	return nil
+}
+
+func (doc *DocumentSyncer) filter(ns dbpool.NS) bool {
+	if strings.HasPrefix(ns.Collection, "system.") {
+		return true
+	}
+	return doc.filterList.IterateFilter(&oplog.PartialLog{Namespace: ns.Str()})
+}
+
+// split cuts collection into _id ranges by document.split_size. splitVector
+// is preferred and sampling is used if it isn't allowed. the collection will
+// be copied in one range if _id values are in different types. because of
+// query on _id range only matches the values in the same type
+func (doc *DocumentSyncer) split(ns dbpool.NS) ([]*ckpt.DocumentRange, error) {
+	var keys []interface{}
+	if conf.Options.DocumentSplitSize > 0 {
+		var err error
+		if keys, err = doc.splitVector(ns); err != nil {
+			LOG.Info("Document syncer splitVector on %s failed, use sampling instead. %v", ns.Str(), err)
+			if keys, err = doc.sample(ns); err != nil {
+				LOG.Warn("Document syncer sample on %s failed, copy it in one range. %v", ns.Str(), err)
+				keys = nil
+			}
+		}
+	}
+
+	if len(keys) != 0 && !doc.isSameBracket(ns, keys) {
+		LOG.Info("Document syncer found different types of _id in %s, copy it in one range", ns.Str())
+		keys = nil
+	}
+
+	var ranges []*ckpt.DocumentRange
+	var min interface{}
+	for _, key := range append(keys, nil) {
+		documentRange, err := ckpt.NewDocumentRange(ns.Str(), min, key)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, documentRange)
+		min = key
+	}
+	return ranges, nil
+}
+
+func (doc *DocumentSyncer) splitVector(ns dbpool.NS) ([]interface{}, error) {
+	var result struct {
+		SplitKeys []bson.M `bson:"splitKeys"`
+	}
+	if err := doc.conn.Session.DB(ns.Database).Run(bson.D{
+		{"splitVector", ns.Str()},
+		{"keyPattern", bson.M{"_id": 1}},
+		{"maxChunkSizeBytes", conf.Options.DocumentSplitSize * utils.MB}}, &result); err != nil {
+		return nil, err
+	}
+
+	keys := make([]interface{}, 0, len(result.SplitKeys))
+	for _, key := range result.SplitKeys {
+		keys = append(keys, key["_id"])
+	}
+	return keys, nil
+}
+
+func (doc *DocumentSyncer) sample(ns dbpool.NS) ([]interface{}, error) {
+	var stats struct {
+		Size int64 `bson:"size"`
+	}
+	if err := doc.conn.Session.DB(ns.Database).Run(bson.D{{"collStats", ns.Collection}}, &stats); err != nil {
+		return nil, err
+	}
+	rangeNumber := stats.Size / (conf.Options.DocumentSplitSize * utils.MB)
+	if rangeNumber <= 1 {
+		return nil, nil
+	}
+
+	var samples []bson.M
+	if err := doc.conn.Session.DB(ns.Database).C(ns.Collection).Pipe([]bson.M{
+		{"$sample": bson.M{"size": rangeNumber * DocumentSamplesPerRange}},
+		{"$project": bson.M{"_id": 1}},
+		{"$sort": bson.M{"_id": 1}},
+	}).AllowDiskUse().All(&samples); err != nil {
+		return nil, err
+	}
+
+	var keys []interface{}
+	var last []byte
+	for i := DocumentSamplesPerRange; i < len(samples); i += DocumentSamplesPerRange {
+		// $sample may return duplicated documents
+		current, err := bson.Marshal(samples[i])
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(current, last) {
+			keys = append(keys, samples[i]["_id"])
+		}
+		last = current
+	}
+	return keys, nil
+}
+
+// isSameBracket checks the smallest, the biggest _id and all split keys
+// are in the same type bracket
+func (doc *DocumentSyncer) isSameBracket(ns dbpool.NS, keys []interface{}) bool {
+	var min, max bson.M
+	coll := doc.conn.Session.DB(ns.Database).C(ns.Collection)
+	if err := coll.Find(nil).Select(bson.M{"_id": 1}).Sort("_id").Limit(1).One(&min); err != nil {
+		return false
+	}
+	if err := coll.Find(nil).Select(bson.M{"_id": 1}).Sort("-_id").Limit(1).One(&max); err != nil {
+		return false
+	}
+
+	bracket := typeBracket(min["_id"])
+	for _, key := range append(keys, max["_id"]) {
+		if typeBracket(key) != bracket {
+			return false
+		}
+	}
+	return true
+}
+
+func typeBracket(value interface{}) string {
+	switch value.(type) {
+	case int, int32, int64, float64, bson.Decimal128:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// copyRange reads all documents in the range and offers them to worker as
+// the oplogs at startTs. the range is marked done after the worker acked all
+// of them
+func (doc *DocumentSyncer) copyRange(worker *Worker, documentRange *ckpt.DocumentRange,
+	startTs bson.MongoTimestamp) error {
+	query, err := documentRange.Query()
+	if err != nil {
+		return fmt.Errorf("decode range of %s failed. %v", documentRange.Namespace, err)
+	}
+	if doc.expression != nil {
+		query = bson.M{"$and": []bson.M{query, doc.expression}}
+	}
+
+	ns := strings.SplitN(documentRange.Namespace, ".", 2)
+	batch := make([]*oplog.GenericOplog, 0, conf.Options.AdaptiveBatchingMaxSize)
+	var total uint64
+
+	// copiers run concurrently. every one uses an individual socket
+	session := doc.conn.Session.Copy()
+	defer session.Close()
+	iter := session.DB(ns[0]).C(ns[1]).Find(query).Batch(DocumentBatchSize).Iter()
+	raw := new(bson.Raw)
+	for iter.Next(raw) {
+		log, err := NewDocumentOplog(documentRange.Namespace, startTs, raw)
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("convert document of %s failed. %v", documentRange.Namespace, err)
+		}
+		// the documents are transformed as the oplogs
+		logs := []*oplog.GenericOplog{log}
+		if transformers := doc.syncer.batcher.transformers; len(transformers) != 0 {
+			if logs, err = transformers.Transform(log); err != nil {
+				iter.Close()
+				return fmt.Errorf("transform document of %s failed. %v", documentRange.Namespace, err)
+			}
+		}
+
+		if batch = append(batch, logs...); len(batch) >= conf.Options.AdaptiveBatchingMaxSize {
+			worker.AllAcked(false)
+			worker.Offer(batch)
+			total += uint64(len(batch))
+			batch = make([]*oplog.GenericOplog, 0, conf.Options.AdaptiveBatchingMaxSize)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("iterate documents of %s failed. %v", documentRange.Namespace, err)
+	}
+	if len(batch) != 0 {
+		worker.AllAcked(false)
+		worker.Offer(batch)
+		total += uint64(len(batch))
+	}
+
+	// wait until all documents are acked by the tunnel
+	worker.waitAllAcked()
+
+	if err := doc.syncer.ckptManager.FinishRange(documentRange); err != nil {
+		// the range will be copied again after restart. it's acceptable
+		LOG.Warn("Document syncer record range progress of %s failed. %v", documentRange.Namespace, err)
+	}
+	LOG.Info("Document syncer copy range of %s finished by worker-%d. documents %d",
+		documentRange.Namespace, worker.id, total)
+	return nil
+}
+
+// NewDocumentOplog wraps a document into an insert oplog on namespace ns
+func NewDocumentOplog(ns string, ts bson.MongoTimestamp, document *bson.Raw) (*oplog.GenericOplog, error) {
+	raw, err := bson.Marshal(bson.D{{"ts", ts}, {"op", "i"}, {"ns", ns}, {"o", document}})
+	if err != nil {
+		return nil, err
+	}
+
+	log := new(oplog.PartialLog)
+	if err = bson.Unmarshal(raw, log); err != nil {
+		return nil, err
+	}
+	return &oplog.GenericOplog{Raw: raw, Parsed: log}, nil
+}
+
+// NewCommandOplog wraps a command into a command oplog on database. it's
+// marked as meta so that target ignores the namespaces existing or missing
+func NewCommandOplog(database string, ts bson.MongoTimestamp, command bson.D) (*oplog.GenericOplog, error) {
+	raw, err := bson.Marshal(bson.D{{"ts", ts}, {"op", "c"}, {"ns", database + ".$cmd"}, {"o", command},
+		{"meta", true}})
+	if err != nil {
+		return nil, err
+	}
+
+	log := new(oplog.PartialLog)
+	if err = bson.Unmarshal(raw, log); err != nil {
+		return nil, err
+	}
+	return &oplog.GenericOplog{Raw: raw, Parsed: log}, nil
+}
+
+// syncDocument copies the snapshot of source MongoDB if sync mode requires.
+// return false if oplog tailing shouldn't start after that
+func (sync *OplogSyncer) syncDocument() bool {
+	checkpoint := sync.ckptManager.Get()
+	for ; checkpoint == nil; checkpoint = sync.ckptManager.Get() {
+		LOG.Critical("Acquire the existing checkpoint from remote[%s] failed !", conf.Options.ContextAddress)
+		utils.YieldInMs(DurationTime)
+	}
+	// the documents are copied with the filters changed at runtime
+	sync.loadFilterRules(checkpoint)
+	if conf.Options.SyncMode == SyncModeOplog && checkpoint.DocumentSync == nil {
+		// the progress exists if re-sync is unfinished
+		return true
+	}
+	if conf.Options.SyncMode == SyncModeAll && checkpoint.Exist && checkpoint.DocumentSync == nil {
+		// document has been copied already
+		LOG.Info("Checkpoint exists. skip document sync and start with oplog ts[%d]",
+			utils.ExtractMongoTimestamp(checkpoint.Timestamp))
+		return true
+	}
+
+	sync.suspendCheckpoint(true)
+	defer sync.suspendCheckpoint(false)
+	docSyncer := NewDocumentSyncer(sync, sync.src)
+	for {
+		startTs, err := docSyncer.Run()
+		if err == nil {
+			// persist the start position and clean the progress. we won't
+			// copy documents again after restart in sync mode all
+			for err = sync.ckptManager.Update(startTs); err != nil; err = sync.ckptManager.Update(startTs) {
+				LOG.Warn("Document syncer record checkpoint failed. %v", err)
+				utils.YieldInMs(DurationTime)
+			}
+			sync.replMetric.SetLSNCheckpoint(utils.TimestampToInt64(startTs))
+			return conf.Options.SyncMode != SyncModeDocument
+		}
+
+		LOG.Error("Document syncer internal error, retry unfinished ranges: %v", err)
+		sync.replMetric.ReplStatus.Update(utils.FetchBad)
+		utils.YieldInMs(DurationTime)
+	}
+}
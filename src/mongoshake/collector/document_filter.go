@@ -0,0 +1,480 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+// result of evaluating expression on an oplog. the fields in expression may
+// be unknown from update and delete oplog
+type matchResult int
+
+const (
+	matchUnknown matchResult = iota
+	matchYes
+	matchNo
+)
+
+// state of field looked up in oplog
+type fieldState int
+
+const (
+	fieldUnknown fieldState = iota
+	fieldPresent
+	fieldAbsent
+)
+
+func matchOf(match bool) matchResult {
+	if match {
+		return matchYes
+	}
+	return matchNo
+}
+
+// DocumentFilter drops the oplogs of documents not matching the expression.
+// The expression is in MongoDB query syntax with the operators $eq, $ne,
+// $gt, $gte, $lt, $lte, $in, $nin, $exists, $and, $or and $nor. Insert and
+// replacement are evaluated on the whole document. Update is evaluated on
+// the fields of o2 and $set/$unset. Delete is evaluated on the fields of o.
+// The oplog is dropped only if it's known not to match. Commands and noops
+// are never dropped.
+type DocumentFilter struct {
+	// original expression. used as query in document sync
+	Expression bson.M
+	root       documentExpr
+}
+
+func NewDocumentFilter(expression string) (*DocumentFilter, error) {
+	var parsed bson.M
+	if err := bson.UnmarshalJSON([]byte(expression), &parsed); err != nil {
+		return nil, fmt.Errorf("parse document filter %s failed. %v", expression, err)
+	}
+	// normalize the values into the types decoded from oplog
+	data, err := bson.Marshal(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("encode document filter %s failed. %v", expression, err)
+	}
+	normalized := bson.M{}
+	if err = bson.Unmarshal(data, &normalized); err != nil {
+		return nil, fmt.Errorf("decode document filter %s failed. %v", expression, err)
+	}
+
+	root, err := compileDocument(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("compile document filter %s failed. %v", expression, err)
+	}
+	return &DocumentFilter{Expression: normalized, root: root}, nil
+}
+
+func (filter *DocumentFilter) Filter(log *oplog.PartialLog) bool {
+	var view *documentView
+	switch log.Operation {
+	case "i":
+		view = &documentView{complete: log.Object}
+	case "u":
+		view = newUpdateView(log)
+	case "d":
+		view = &documentView{partial: []bson.M{log.Object}}
+	default:
+		return false
+	}
+	return filter.root.evaluate(view) == matchNo
+}
+
+// documentView looks up fields in the document related to oplog
+type documentView struct {
+	// the whole document. missing fields are absent
+	complete bson.M
+	// parts of the document. missing fields are unknown
+	partial []bson.M
+	// fields removed by $unset
+	unset bson.M
+	// nothing but the partial fields are known
+	opaque bool
+}
+
+func newUpdateView(log *oplog.PartialLog) *documentView {
+	view := &documentView{partial: []bson.M{log.Query}}
+	replacement := true
+	for key := range log.Object {
+		if strings.HasPrefix(key, "$") {
+			replacement = false
+			break
+		}
+	}
+	if replacement {
+		view.complete = log.Object
+		return view
+	}
+
+	for key, value := range log.Object {
+		switch key {
+		case "$set":
+			if set, ok := value.(bson.M); ok {
+				view.partial = append(view.partial, set)
+			}
+		case "$unset":
+			if unset, ok := value.(bson.M); ok {
+				view.unset = unset
+			}
+		case "$v":
+		default:
+			// the fields changed are unknown. such as diff of $v:2
+			view.opaque = true
+		}
+	}
+	return view
+}
+
+func (view *documentView) lookup(path string) (interface{}, fieldState) {
+	for _, part := range view.partial {
+		if value, state := lookupPath(part, path, true); state == fieldPresent {
+			return value, state
+		}
+	}
+	if view.complete != nil {
+		return lookupPath(view.complete, path, false)
+	}
+	if !view.opaque && view.unset != nil {
+		if _, state := lookupPath(view.unset, path, true); state == fieldPresent {
+			return nil, fieldAbsent
+		}
+	}
+	return nil, fieldUnknown
+}
+
+// lookupPath finds the dotted path in document. the keys of update modifier
+// are dotted paths themselves if dotted is true
+func lookupPath(document bson.M, path string, dotted bool) (interface{}, fieldState) {
+	if value, exist := document[path]; exist {
+		return value, fieldPresent
+	}
+	if dotted {
+		for key, value := range document {
+			if strings.HasPrefix(path, key+".") {
+				if sub, ok := value.(bson.M); ok {
+					return lookupPath(sub, path[len(key)+1:], false)
+				}
+				return nil, fieldAbsent
+			}
+		}
+		return nil, fieldAbsent
+	}
+
+	dot := strings.Index(path, ".")
+	if dot == -1 {
+		return nil, fieldAbsent
+	}
+	if sub, ok := document[path[:dot]].(bson.M); ok {
+		return lookupPath(sub, path[dot+1:], false)
+	}
+	return nil, fieldAbsent
+}
+
+type documentExpr interface {
+	evaluate(view *documentView) matchResult
+}
+
+// all the expressions should match
+type andExpr []documentExpr
+
+func (expr andExpr) evaluate(view *documentView) matchResult {
+	result := matchYes
+	for _, sub := range expr {
+		switch sub.evaluate(view) {
+		case matchNo:
+			return matchNo
+		case matchUnknown:
+			result = matchUnknown
+		}
+	}
+	return result
+}
+
+// any of the expressions should match
+type orExpr []documentExpr
+
+func (expr orExpr) evaluate(view *documentView) matchResult {
+	result := matchNo
+	for _, sub := range expr {
+		switch sub.evaluate(view) {
+		case matchYes:
+			return matchYes
+		case matchUnknown:
+			result = matchUnknown
+		}
+	}
+	return result
+}
+
+type norExpr []documentExpr
+
+func (expr norExpr) evaluate(view *documentView) matchResult {
+	switch orExpr(expr).evaluate(view) {
+	case matchYes:
+		return matchNo
+	case matchNo:
+		return matchYes
+	}
+	return matchUnknown
+}
+
+type fieldExpr struct {
+	path     string
+	operator string
+	value    interface{}
+}
+
+func (expr *fieldExpr) evaluate(view *documentView) matchResult {
+	value, state := view.lookup(expr.path)
+	switch state {
+	case fieldUnknown:
+		return matchUnknown
+	case fieldAbsent:
+		// same as null
+		value = nil
+		if expr.operator == "$exists" {
+			return matchOf(!truthy(expr.value))
+		}
+	case fieldPresent:
+		if expr.operator == "$exists" {
+			return matchOf(truthy(expr.value))
+		}
+	}
+
+	switch expr.operator {
+	case "$eq":
+		return matchOf(matchAny(value, func(v interface{}) bool { return equalValue(v, expr.value) }))
+	case "$ne":
+		return matchOf(!matchAny(value, func(v interface{}) bool { return equalValue(v, expr.value) }))
+	case "$in":
+		return matchOf(matchAny(value, func(v interface{}) bool { return containsValue(expr.value, v) }))
+	case "$nin":
+		return matchOf(!matchAny(value, func(v interface{}) bool { return containsValue(expr.value, v) }))
+	default:
+		// $gt, $gte, $lt, $lte
+		return matchOf(matchAny(value, func(v interface{}) bool {
+			compared, ok := compareValue(v, expr.value)
+			if !ok {
+				return false
+			}
+			switch expr.operator {
+			case "$gt":
+				return compared > 0
+			case "$gte":
+				return compared >= 0
+			case "$lt":
+				return compared < 0
+			default:
+				return compared <= 0
+			}
+		}))
+	}
+}
+
+func compileDocument(document bson.M) (documentExpr, error) {
+	var exprs andExpr
+	for key, value := range document {
+		switch key {
+		case "$and", "$or", "$nor":
+			list, ok := value.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, fmt.Errorf("%s needs a nonempty array", key)
+			}
+			var subs []documentExpr
+			for _, item := range list {
+				sub, ok := item.(bson.M)
+				if !ok {
+					return nil, fmt.Errorf("%s needs an array of documents", key)
+				}
+				expr, err := compileDocument(sub)
+				if err != nil {
+					return nil, err
+				}
+				subs = append(subs, expr)
+			}
+			switch key {
+			case "$and":
+				exprs = append(exprs, andExpr(subs))
+			case "$or":
+				exprs = append(exprs, orExpr(subs))
+			default:
+				exprs = append(exprs, norExpr(subs))
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("operator %s is not supported", key)
+			}
+			expr, err := compileField(key, value)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, expr...)
+		}
+	}
+	return exprs, nil
+}
+
+func compileField(path string, value interface{}) (andExpr, error) {
+	operators, ok := value.(bson.M)
+	if !ok || len(operators) == 0 {
+		return andExpr{&fieldExpr{path: path, operator: "$eq", value: value}}, nil
+	}
+	for operator := range operators {
+		if !strings.HasPrefix(operator, "$") {
+			// document equality
+			return andExpr{&fieldExpr{path: path, operator: "$eq", value: value}}, nil
+		}
+	}
+
+	var exprs andExpr
+	for operator, operand := range operators {
+		switch operator {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$exists":
+		case "$in", "$nin":
+			if _, ok := operand.([]interface{}); !ok {
+				return nil, fmt.Errorf("%s of %s needs an array", operator, path)
+			}
+		default:
+			return nil, fmt.Errorf("operator %s of %s is not supported", operator, path)
+		}
+		exprs = append(exprs, &fieldExpr{path: path, operator: operator, value: operand})
+	}
+	return exprs, nil
+}
+
+// matchAny applies match on the value or any element of array value
+func matchAny(value interface{}, match func(interface{}) bool) bool {
+	if match(value) {
+		return true
+	}
+	if array, ok := value.([]interface{}); ok {
+		for _, element := range array {
+			if match(element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsValue(list interface{}, value interface{}) bool {
+	for _, element := range list.([]interface{}) {
+		if equalValue(value, element) {
+			return true
+		}
+	}
+	return false
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	default:
+		if number, ok := numberValue(v); ok {
+			return number != 0
+		}
+		return true
+	}
+}
+
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bson.Decimal128:
+		// NaN and infinity are parsed also
+		if number, err := strconv.ParseFloat(v.String(), 64); err == nil {
+			return number, true
+		}
+	}
+	return 0, false
+}
+
+func equalValue(a, b interface{}) bool {
+	if x, ok := numberValue(a); ok {
+		y, ok := numberValue(b)
+		return ok && x == y
+	}
+	switch x := a.(type) {
+	case bson.M:
+		y, ok := b.(bson.M)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			if other, exist := y[key]; !exist || !equalValue(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalValue(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValue compares the values in the same type bracket. returns false
+// if they can't be compared
+func compareValue(a, b interface{}) (int, bool) {
+	if x, ok := numberValue(a); ok {
+		y, ok := numberValue(b)
+		if !ok {
+			return 0, false
+		}
+		// NaN only equals NaN
+		if math.IsNaN(x) || math.IsNaN(y) {
+			return 0, math.IsNaN(x) && math.IsNaN(y)
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,107 @@
+package collector
+
+import (
+	"testing"
+
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func decimal(value string) bson.Decimal128 {
+	number, err := bson.ParseDecimal128(value)
+	if err != nil {
+		panic(err)
+	}
+	return number
+}
+
+func TestDocumentFilter(t *testing.T) {
+	insert := func(object bson.M) *oplog.PartialLog {
+		return &oplog.PartialLog{Operation: "i", Namespace: "db.c", Object: object}
+	}
+	update := func(object bson.M) *oplog.PartialLog {
+		return &oplog.PartialLog{Operation: "u", Namespace: "db.c", Object: object, Query: bson.M{"_id": 1}}
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		log        *oplog.PartialLog
+		filtered   bool
+	}{
+		{"equal", `{"a": 5}`, insert(bson.M{"a": 5}), false},
+		{"not equal", `{"a": 5}`, insert(bson.M{"a": 6}), true},
+		{"int32 equals double", `{"a": 5.0}`, insert(bson.M{"a": int32(5)}), false},
+		{"int64 equals int", `{"a": 5}`, insert(bson.M{"a": int64(5)}), false},
+		{"decimal equals int", `{"a": 12}`, insert(bson.M{"a": decimal("12.0")}), false},
+		{"decimal gt", `{"a": {"$gt": 10}}`, insert(bson.M{"a": decimal("12.5")}), false},
+		{"decimal lt", `{"a": {"$lt": 10}}`, insert(bson.M{"a": decimal("12.5")}), true},
+		{"decimal nan", `{"a": {"$gte": 0}}`, insert(bson.M{"a": decimal("NaN")}), true},
+		{"decimal infinity", `{"a": {"$gt": 1e300}}`, insert(bson.M{"a": decimal("Inf")}), false},
+		{"gte equal", `{"a": {"$gte": 5}}`, insert(bson.M{"a": 5.0}), false},
+		{"lte bigger", `{"a": {"$lte": 5}}`, insert(bson.M{"a": 6}), true},
+		{"range", `{"a": {"$gt": 1, "$lt": 3}}`, insert(bson.M{"a": 2}), false},
+		{"out of range", `{"a": {"$gt": 1, "$lt": 3}}`, insert(bson.M{"a": 3}), true},
+		{"string compare", `{"a": {"$gte": "m"}}`, insert(bson.M{"a": "z"}), false},
+		{"string less", `{"a": {"$gte": "m"}}`, insert(bson.M{"a": "b"}), true},
+		{"different type", `{"a": {"$gt": 5}}`, insert(bson.M{"a": "6"}), true},
+		{"ne", `{"a": {"$ne": 5}}`, insert(bson.M{"a": 5}), true},
+		{"ne absent", `{"a": {"$ne": 5}}`, insert(bson.M{}), false},
+		{"in", `{"a": {"$in": [1, 2]}}`, insert(bson.M{"a": int64(2)}), false},
+		{"not in", `{"a": {"$in": [1, 2]}}`, insert(bson.M{"a": 3}), true},
+		{"nin", `{"a": {"$nin": [1, 2]}}`, insert(bson.M{"a": 1}), true},
+		{"exists", `{"a": {"$exists": true}}`, insert(bson.M{"b": 1}), true},
+		{"not exists", `{"a": {"$exists": false}}`, insert(bson.M{"b": 1}), false},
+		{"null matches absent", `{"a": null}`, insert(bson.M{"b": 1}), false},
+		{"array element", `{"a": "y"}`, insert(bson.M{"a": []interface{}{"x", "y"}}), false},
+		{"array no element", `{"a": "z"}`, insert(bson.M{"a": []interface{}{"x", "y"}}), true},
+		{"dotted path", `{"a.b": 1}`, insert(bson.M{"a": bson.M{"b": 1}}), false},
+		{"dotted path absent", `{"a.b": 1}`, insert(bson.M{"a": 1}), true},
+		{"sub document", `{"a": {"b": 1}}`, insert(bson.M{"a": bson.M{"b": 1.0}}), false},
+		{"and", `{"$and": [{"a": 1}, {"b": 2}]}`, insert(bson.M{"a": 1, "b": 3}), true},
+		{"or", `{"$or": [{"a": 1}, {"b": 2}]}`, insert(bson.M{"a": 0, "b": 2}), false},
+		{"nor", `{"$nor": [{"a": 1}, {"b": 2}]}`, insert(bson.M{"a": 1}), true},
+
+		{"replacement", `{"a": 5}`, update(bson.M{"a": 6}), true},
+		{"set matches", `{"a": 5}`, update(bson.M{"$set": bson.M{"a": 5}}), false},
+		{"set not matches", `{"a": 5}`, update(bson.M{"$set": bson.M{"a": 6}}), true},
+		{"set dotted", `{"a.b": 5}`, update(bson.M{"$set": bson.M{"a.b": 6}}), true},
+		{"set other field", `{"a": 5}`, update(bson.M{"$set": bson.M{"b": 6}}), false},
+		{"unset", `{"a": {"$exists": true}}`, update(bson.M{"$unset": bson.M{"a": ""}}), true},
+		{"diff unknown", `{"a": 5}`, update(bson.M{"$v": 2, "diff": bson.M{"u": bson.M{"a": 6}}}), false},
+		{"unknown in or", `{"$or": [{"a": 1}, {"b": 2}]}`, update(bson.M{"$set": bson.M{"a": 0}}), false},
+		{"known in and", `{"$and": [{"a": 1}, {"b": 2}]}`, update(bson.M{"$set": bson.M{"a": 0}}), true},
+
+		{"delete unknown", `{"a": 5}`, &oplog.PartialLog{Operation: "d", Object: bson.M{"_id": 1}}, false},
+		{"delete by _id", `{"_id": 2}`, &oplog.PartialLog{Operation: "d", Object: bson.M{"_id": 1}}, true},
+		{"command", `{"a": 5}`, &oplog.PartialLog{Operation: "c", Object: bson.M{"drop": "c"}}, false},
+		{"noop", `{"a": 5}`, &oplog.PartialLog{Operation: "n", Object: bson.M{"msg": "x"}}, false},
+	}
+
+	for _, test := range tests {
+		filter, err := NewDocumentFilter(test.expression)
+		if err != nil {
+			t.Fatalf("%s: create filter failed. %v", test.name, err)
+		}
+		if filtered := filter.Filter(test.log); filtered != test.filtered {
+			t.Errorf("%s: filter %s on %v got %t, want %t", test.name, test.expression, test.log.Object,
+				filtered, test.filtered)
+		}
+	}
+}
+
+func TestDocumentFilterInvalid(t *testing.T) {
+	for _, expression := range []string{
+		`{"a": `,
+		`{"$where": "true"}`,
+		`{"a": {"$mod": [2, 0]}}`,
+		`{"a": {"$in": 1}}`,
+		`{"$or": []}`,
+		`{"$and": [1]}`,
+	} {
+		if _, err := NewDocumentFilter(expression); err == nil {
+			t.Errorf("filter %s should be invalid", expression)
+		}
+	}
+}
@@ -0,0 +1,650 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	TransformDrop    = "drop"
+	TransformRename  = "rename"
+	TransformHash    = "hash"
+	TransformReplace = "replace"
+)
+
+// FieldTransformer rewrites the fields of documents in oplogs before they
+// are dispatched. A rule is "namespace:action:path[:argument]" and the
+// namespace is "db.collection" or "db". The actions are:
+//   drop     removes the field
+//   rename   moves the field to the path given in argument
+//   hash     replaces the value by hex of sha256 on salt and value
+//   replace  replaces the value by the argument in extended json
+// Inserts, replacements, $set/$unset and $v:2 diffs of updates and the
+// queries in o2 and delete are transformed. The oplogs in applyOps are
+// transformed also. _id isn't transformed.
+type FieldTransformer struct {
+	// keyed by namespace of rule
+	rules map[string][]*fieldRule
+	salt  []byte
+}
+
+type fieldRule struct {
+	action string
+	path   []string
+	// rename only
+	target []string
+	// replace only
+	value interface{}
+}
+
+// NewFieldTransformer parses the rules. nil is returned if no rule given
+func NewFieldTransformer(rules []string, salt string) (*FieldTransformer, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	transformer := &FieldTransformer{rules: make(map[string][]*fieldRule), salt: []byte(salt)}
+	for _, rule := range rules {
+		parsed, ns, err := parseFieldRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("transform rule[%s] is invalid. %v", rule, err)
+		}
+		transformer.rules[ns] = append(transformer.rules[ns], parsed)
+	}
+	return transformer, nil
+}
+
+func parseFieldRule(rule string) (*fieldRule, string, error) {
+	parts := strings.SplitN(rule, ":", 4)
+	if len(parts) < 3 || parts[0] == "" {
+		return nil, "", fmt.Errorf("should be namespace:action:path[:argument]")
+	}
+	path, err := splitFieldPath(parts[2])
+	if err != nil {
+		return nil, "", err
+	}
+
+	parsed := &fieldRule{action: parts[1], path: path}
+	hasArgument := len(parts) == 4
+	switch parsed.action {
+	case TransformDrop, TransformHash:
+		if hasArgument {
+			return nil, "", fmt.Errorf("%s has no argument", parsed.action)
+		}
+	case TransformRename:
+		if !hasArgument {
+			return nil, "", fmt.Errorf("rename needs the target path")
+		}
+		if parsed.target, err = splitFieldPath(parts[3]); err != nil {
+			return nil, "", err
+		}
+		if isPathPrefix(parsed.path, parsed.target) || isPathPrefix(parsed.target, parsed.path) {
+			return nil, "", fmt.Errorf("the paths of rename shouldn't overlap")
+		}
+		if parsed.target[0] == "_id" {
+			return nil, "", fmt.Errorf("_id can't be renamed to")
+		}
+	case TransformReplace:
+		if !hasArgument {
+			return nil, "", fmt.Errorf("replace needs the value")
+		}
+		var document bson.M
+		if err := bson.UnmarshalJSON([]byte(`{"v":`+parts[3]+`}`), &document); err == nil {
+			parsed.value = document["v"]
+		} else {
+			// plain string
+			parsed.value = parts[3]
+		}
+	default:
+		return nil, "", fmt.Errorf("action %s is unknown", parsed.action)
+	}
+	// the documents are located by _id on target
+	if path[0] == "_id" {
+		return nil, "", fmt.Errorf("_id can't be transformed")
+	}
+	return parsed, parts[0], nil
+}
+
+func splitFieldPath(path string) ([]string, error) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, "$") {
+			return nil, fmt.Errorf("field path %s is invalid", path)
+		}
+	}
+	return parts, nil
+}
+
+// isPathPrefix tells whether prefix is or is the parent of path
+func isPathPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the rules of namespace. the database rules come first
+func (transformer *FieldTransformer) match(ns string) []*fieldRule {
+	database := strings.SplitN(ns, ".", 2)[0]
+	rules := transformer.rules[database]
+	if collection := transformer.rules[ns]; len(collection) != 0 {
+		rules = append(append([]*fieldRule{}, rules...), collection...)
+	}
+	return rules
+}
+
+// Transform returns the oplog transformed. the oplog given is returned if
+// no rule applied and it's never changed
+func (transformer *FieldTransformer) Transform(log *oplog.GenericOplog) ([]*oplog.GenericOplog, error) {
+	transformed, err := transformer.transform(log)
+	if err != nil {
+		return nil, err
+	}
+	return []*oplog.GenericOplog{transformed}, nil
+}
+
+func (transformer *FieldTransformer) transform(log *oplog.GenericOplog) (*oplog.GenericOplog, error) {
+	switch log.Parsed.Operation {
+	case "i", "u", "d":
+		if len(transformer.match(log.Parsed.Namespace)) == 0 {
+			return log, nil
+		}
+	case "c":
+		if _, ok := log.Parsed.Object["applyOps"]; !ok {
+			return log, nil
+		}
+	default:
+		return log, nil
+	}
+
+	var document bson.D
+	if err := bson.Unmarshal(log.Raw, &document); err != nil {
+		return nil, fmt.Errorf("decode oplog failed. %v", err)
+	}
+	document, changed, err := transformer.transformOplog(document)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return log, nil
+	}
+
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("encode oplog transformed failed. %v", err)
+	}
+	parsed := new(oplog.PartialLog)
+	if err = bson.Unmarshal(raw, parsed); err != nil {
+		return nil, fmt.Errorf("decode oplog transformed failed. %v", err)
+	}
+	return &oplog.GenericOplog{Raw: raw, Parsed: parsed}, nil
+}
+
+// transformOplog transforms the oplog in place. returns the oplog and true
+// if anything changed
+func (transformer *FieldTransformer) transformOplog(document bson.D) (bson.D, bool, error) {
+	var operation, ns string
+	for _, field := range document {
+		switch field.Name {
+		case "op":
+			operation, _ = field.Value.(string)
+		case "ns":
+			ns, _ = field.Value.(string)
+		}
+	}
+	objectIndex, queryIndex := findField(document, "o"), findField(document, "o2")
+	if objectIndex == -1 {
+		return document, false, nil
+	}
+	object, ok := document[objectIndex].Value.(bson.D)
+	if !ok || len(object) == 0 {
+		return document, false, nil
+	}
+
+	changed, modifier, diff := false, isModifier(object), isDiff(object)
+	if operation == "c" {
+		if ops, ok := object[0].Value.([]interface{}); ok && object[0].Name == "applyOps" {
+			for i, op := range ops {
+				if op, ok := op.(bson.D); ok {
+					var opChanged bool
+					var err error
+					if ops[i], opChanged, err = transformer.transformOplog(op); err != nil {
+						return document, false, err
+					}
+					changed = opChanged || changed
+				}
+			}
+		}
+		return document, changed, nil
+	}
+
+	for _, rule := range transformer.match(ns) {
+		var objectChanged bool
+		switch operation {
+		case "i":
+			object, objectChanged = transformer.applyDocument(object, rule, true)
+		case "u":
+			switch {
+			case diff:
+				var err error
+				if object, objectChanged, err = transformer.applyDiffUpdate(object, rule); err != nil {
+					return document, false, err
+				}
+			case modifier:
+				object, objectChanged = transformer.applyModifier(object, rule)
+			default:
+				object, objectChanged = transformer.applyDocument(object, rule, true)
+			}
+		case "d":
+			object, objectChanged = transformer.applyDocument(object, rule, false)
+		}
+		changed = objectChanged || changed
+
+		if queryIndex != -1 {
+			if query, ok := document[queryIndex].Value.(bson.D); ok {
+				var queryChanged bool
+				document[queryIndex].Value, queryChanged = transformer.applyDocument(query, rule, false)
+				changed = queryChanged || changed
+			}
+		}
+	}
+	document[objectIndex].Value = object
+
+	if operation == "u" && (modifier && !hasModification(object) || diff && isEmptyDiff(object)) {
+		// only the fields dropped are modified. it's nothing to do on target
+		noop := bson.D{}
+		for _, field := range document {
+			switch field.Name {
+			case "op":
+				field.Value = "n"
+			case "o":
+				field.Value = bson.D{{"msg", "update of fields dropped by transform"}}
+			case "o2":
+				continue
+			}
+			noop = append(noop, field)
+		}
+		document = noop
+	}
+	return document, changed, nil
+}
+
+func isModifier(object bson.D) bool {
+	for _, field := range object {
+		if strings.HasPrefix(field.Name, "$") && field.Name != "$v" {
+			return true
+		}
+	}
+	return false
+}
+
+// isDiff tells whether the update is in the format of $v:2 since MongoDB
+// 5.0. the fields changed are in the sections of diff
+func isDiff(object bson.D) bool {
+	return findField(object, "$v") != -1 && findField(object, "diff") != -1
+}
+
+func isEmptyDiff(object bson.D) bool {
+	diff, ok := object[findField(object, "diff")].Value.(bson.D)
+	return ok && len(diff) == 0
+}
+
+func hasModification(object bson.D) bool {
+	for _, field := range object {
+		if field.Name != "$v" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDocument applies the rule on document. the document is a query if
+// whole is false, where the fields removed aren't added by rename
+func (transformer *FieldTransformer) applyDocument(document bson.D, rule *fieldRule, whole bool) (bson.D, bool) {
+	switch rule.action {
+	case TransformDrop:
+		return removePath(document, rule.path)
+	case TransformRename:
+		var value interface{}
+		var found bool
+		document, value, found = takePath(document, rule.path)
+		if !found {
+			return document, false
+		}
+		if !whole {
+			// dotted path in query matches the field only
+			return append(document, bson.DocElem{Name: strings.Join(rule.target, "."), Value: value}), true
+		}
+		return setPath(document, rule.target, value), true
+	default:
+		changed := false
+		document = mapPath(document, rule.path, func(value interface{}) interface{} {
+			changed = true
+			return transformer.apply(rule, value)
+		})
+		return document, changed
+	}
+}
+
+// applyModifier applies the rule on $set and $unset whose keys are dotted
+// paths
+func (transformer *FieldTransformer) applyModifier(object bson.D, rule *fieldRule) (bson.D, bool) {
+	changed := false
+	var moved bson.D
+	for i := range object {
+		modifier, ok := object[i].Value.(bson.D)
+		if !ok {
+			continue
+		}
+		var kept bson.D
+		for _, field := range modifier {
+			path := strings.Split(field.Name, ".")
+			switch {
+			case isPathPrefix(rule.path, path):
+				// the field or its children
+				if object[i].Name == "$unset" && rule.action != TransformRename {
+					break
+				}
+				changed = true
+				switch rule.action {
+				case TransformDrop:
+					continue
+				case TransformRename:
+					field.Name = strings.Join(append(append([]string{}, rule.target...), path[len(rule.path):]...), ".")
+				default:
+					if len(path) != len(rule.path) {
+						// the children of field masked
+						continue
+					}
+					field.Value = transformer.apply(rule, field.Value)
+				}
+			case isPathPrefix(path, rule.path) && object[i].Name == "$set":
+				// the parent of field
+				sub, ok := field.Value.(bson.D)
+				if !ok {
+					break
+				}
+				subRule := *rule
+				subRule.path = rule.path[len(path):]
+				if rule.action == TransformRename && !isPathPrefix(path, rule.target) {
+					// moved out of the parent
+					var value interface{}
+					var found bool
+					if sub, value, found = takePath(sub, subRule.path); found {
+						moved = append(moved, bson.DocElem{Name: strings.Join(rule.target, "."), Value: value})
+						changed = true
+					}
+				} else {
+					if rule.action == TransformRename {
+						subRule.target = rule.target[len(path):]
+					}
+					var subChanged bool
+					sub, subChanged = transformer.applyDocument(sub, &subRule, true)
+					changed = subChanged || changed
+				}
+				field.Value = sub
+			}
+			kept = append(kept, field)
+		}
+		if object[i].Name == "$set" {
+			kept = append(kept, moved...)
+		}
+		object[i].Value = kept
+	}
+
+	// the empty modifiers are rejected by MongoDB
+	result := object[:0]
+	for _, field := range object {
+		if modifier, ok := field.Value.(bson.D); !ok || len(modifier) != 0 {
+			result = append(result, field)
+		}
+	}
+	return result, changed
+}
+
+// applyDiffUpdate applies the rule on the diff of $v:2 update
+func (transformer *FieldTransformer) applyDiffUpdate(object bson.D, rule *fieldRule) (bson.D, bool, error) {
+	index := findField(object, "diff")
+	diff, ok := object[index].Value.(bson.D)
+	if !ok {
+		return object, false, nil
+	}
+	diff, changed, err := transformer.applyDiff(diff, rule, rule.path, rule.target)
+	object[index].Value = diff
+	return object, changed, err
+}
+
+// applyDiff applies the rule on the diff of a document. path and target
+// are relative to the document. the diff has the sections d(fields
+// deleted), u(fields updated), i(fields inserted) and s<field>(diff of the
+// sub document or array). the values in u and i are whole, while the fields
+// not in diff are kept on target. so rename is applied only if the paths
+// are in the same field or both at this level
+func (transformer *FieldTransformer) applyDiff(diff bson.D, rule *fieldRule, path, target []string) (bson.D, bool, error) {
+	if findField(diff, "a") != -1 {
+		return transformer.applyArrayDiff(diff, rule, path)
+	}
+
+	name := path[0]
+	if rule.action == TransformRename && !(len(path) == 1 && len(target) == 1) &&
+		!(len(path) > 1 && len(target) > 1 && path[0] == target[0]) {
+		for _, section := range diff {
+			fields, _ := section.Value.(bson.D)
+			if section.Name == "s"+name || findField(fields, name) != -1 {
+				return diff, false, fmt.Errorf("rename of %s can't be applied on $v:2 update of %s",
+					strings.Join(rule.path, "."), name)
+			}
+		}
+		return diff, false, nil
+	}
+
+	changed := false
+	result := diff[:0]
+	for _, section := range diff {
+		switch section.Name {
+		case "u", "i", "d":
+			fields, ok := section.Value.(bson.D)
+			if !ok {
+				break
+			}
+			if len(path) == 1 {
+				index := findField(fields, name)
+				if index == -1 {
+					break
+				}
+				switch {
+				case rule.action == TransformDrop:
+					fields = append(fields[:index], fields[index+1:]...)
+				case rule.action == TransformRename:
+					fields[index].Name = target[0]
+				case section.Name != "d":
+					fields[index].Value = transformer.apply(rule, fields[index].Value)
+				}
+				changed = true
+			} else if section.Name != "d" {
+				// the parent is updated as a whole
+				subRule := *rule
+				subRule.path, subRule.target = path, target
+				var subChanged bool
+				fields, subChanged = transformer.applyDocument(fields, &subRule, true)
+				changed = subChanged || changed
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			section.Value = fields
+		case "s" + name:
+			sub, ok := section.Value.(bson.D)
+			if !ok {
+				break
+			}
+			if len(path) == 1 {
+				changed = true
+				if rule.action != TransformRename {
+					// the field is dropped, replaced or hashed as a whole
+					continue
+				}
+				section.Name = "s" + target[0]
+				break
+			}
+			var subTarget []string
+			if rule.action == TransformRename {
+				subTarget = target[1:]
+			}
+			sub, subChanged, err := transformer.applyDiff(sub, rule, path[1:], subTarget)
+			if err != nil {
+				return diff, false, err
+			}
+			changed = subChanged || changed
+			if len(sub) == 0 {
+				continue
+			}
+			section.Value = sub
+		}
+		result = append(result, section)
+	}
+	return result, changed, nil
+}
+
+// applyArrayDiff applies the rule on the documents in array like mapPath.
+// the diff has the sections u<index>(element updated) and s<index>(diff of
+// element) besides a and l(length). arrays aren't walked by rename
+func (transformer *FieldTransformer) applyArrayDiff(diff bson.D, rule *fieldRule, path []string) (bson.D, bool, error) {
+	if rule.action == TransformRename {
+		return diff, false, nil
+	}
+
+	changed := false
+	for i, section := range diff {
+		element, ok := section.Value.(bson.D)
+		if !ok {
+			continue
+		}
+		var elementChanged bool
+		switch {
+		case strings.HasPrefix(section.Name, "u"):
+			subRule := *rule
+			subRule.path = path
+			diff[i].Value, elementChanged = transformer.applyDocument(element, &subRule, true)
+		case strings.HasPrefix(section.Name, "s"):
+			var err error
+			if diff[i].Value, elementChanged, err = transformer.applyDiff(element, rule, path, nil); err != nil {
+				return diff, false, err
+			}
+		}
+		changed = elementChanged || changed
+	}
+	return diff, changed, nil
+}
+
+// apply returns the value replaced or hashed
+func (transformer *FieldTransformer) apply(rule *fieldRule, value interface{}) interface{} {
+	if rule.action == TransformReplace {
+		return rule.value
+	}
+	// the type is hashed together so that 1 and "1" differ
+	data, err := bson.Marshal(bson.D{{"v", value}})
+	if err != nil {
+		data = []byte(fmt.Sprint(value))
+	}
+	digest := sha256.Sum256(append(append([]byte{}, transformer.salt...), data...))
+	return hex.EncodeToString(digest[:])
+}
+
+// mapPath replaces the values at path. the documents in arrays are walked
+func mapPath(document bson.D, path []string, fn func(interface{}) interface{}) bson.D {
+	index := findField(document, path[0])
+	if index == -1 {
+		return document
+	}
+	if len(path) == 1 {
+		document[index].Value = fn(document[index].Value)
+		return document
+	}
+	switch value := document[index].Value.(type) {
+	case bson.D:
+		document[index].Value = mapPath(value, path[1:], fn)
+	case []interface{}:
+		for i, element := range value {
+			if sub, ok := element.(bson.D); ok {
+				value[i] = mapPath(sub, path[1:], fn)
+			}
+		}
+	}
+	return document
+}
+
+// removePath removes the fields at path. the documents in arrays are walked
+func removePath(document bson.D, path []string) (bson.D, bool) {
+	index := findField(document, path[0])
+	if index == -1 {
+		return document, false
+	}
+	if len(path) == 1 {
+		return append(document[:index], document[index+1:]...), true
+	}
+	changed := false
+	switch value := document[index].Value.(type) {
+	case bson.D:
+		document[index].Value, changed = removePath(value, path[1:])
+	case []interface{}:
+		for i, element := range value {
+			if sub, ok := element.(bson.D); ok {
+				var removed bool
+				value[i], removed = removePath(sub, path[1:])
+				changed = removed || changed
+			}
+		}
+	}
+	return document, changed
+}
+
+// takePath removes the field at path and returns its value. arrays aren't
+// walked
+func takePath(document bson.D, path []string) (bson.D, interface{}, bool) {
+	index := findField(document, path[0])
+	if index == -1 {
+		return document, nil, false
+	}
+	if len(path) == 1 {
+		value := document[index].Value
+		return append(document[:index], document[index+1:]...), value, true
+	}
+	sub, ok := document[index].Value.(bson.D)
+	if !ok {
+		return document, nil, false
+	}
+	sub, value, found := takePath(sub, path[1:])
+	document[index].Value = sub
+	return document, value, found
+}
+
+// setPath sets the field at path. the parent documents are created if
+// missing
+func setPath(document bson.D, path []string, value interface{}) bson.D {
+	index := findField(document, path[0])
+	if len(path) == 1 {
+		if index == -1 {
+			return append(document, bson.DocElem{Name: path[0], Value: value})
+		}
+		document[index].Value = value
+		return document
+	}
+	if index == -1 {
+		return append(document, bson.DocElem{Name: path[0], Value: setPath(bson.D{}, path[1:], value)})
+	}
+	sub, _ := document[index].Value.(bson.D)
+	document[index].Value = setPath(sub, path[1:], value)
+	return document
+}
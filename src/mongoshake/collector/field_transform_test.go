@@ -0,0 +1,307 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func transformOplogDocument(op, ns string, object, query bson.D) bson.D {
+	document := bson.D{{"ts", bson.MongoTimestamp(1)}, {"op", op}, {"ns", ns}}
+	if query != nil {
+		document = append(document, bson.DocElem{Name: "o2", Value: query})
+	}
+	return append(document, bson.DocElem{Name: "o", Value: object})
+}
+
+func TestNewFieldTransformer(t *testing.T) {
+	if transformer, err := NewFieldTransformer(nil, ""); transformer != nil || err != nil {
+		t.Errorf("no rule should create nothing. %v %v", transformer, err)
+	}
+	for _, rule := range []string{
+		"db.c",
+		"db.c:drop",
+		":drop:a",
+		"db.c:unknown:a",
+		"db.c:drop:a:b",
+		"db.c:hash:a:b",
+		"db.c:drop:a..b",
+		"db.c:drop:$a",
+		"db.c:drop:_id",
+		"db.c:rename:_id:a",
+		"db.c:rename:a",
+		"db.c:rename:a:a.b",
+		"db.c:rename:a.b:a",
+		"db.c:rename:a:_id",
+		"db.c:hash:_id",
+		`db.c:replace:_id:1`,
+		"db.c:drop:_id.a",
+		"db.c:replace:a",
+	} {
+		if _, err := NewFieldTransformer([]string{rule}, ""); err == nil {
+			t.Errorf("rule %s should be invalid", rule)
+		}
+	}
+}
+
+func TestFieldTransformerTransform(t *testing.T) {
+	transformer, err := NewFieldTransformer([]string{
+		"db.c:drop:a.b",
+		"db.c:rename:x:y.z",
+		`db.c:replace:r:"hidden"`,
+		"db.c:replace:s:masked",
+		"db:drop:secret",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		source bson.D
+		target bson.D
+	}{
+		{
+			name:   "insert drop",
+			source: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"a", bson.D{{"b", 1}, {"c", 2}}}}, nil),
+			target: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"a", bson.D{{"c", 2}}}}, nil),
+		},
+		{
+			name:   "insert drop in array",
+			source: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"a", []interface{}{bson.D{{"b", 1}, {"c", 1}}, bson.D{{"c", 2}}}}}, nil),
+			target: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"a", []interface{}{bson.D{{"c", 1}}, bson.D{{"c", 2}}}}}, nil),
+		},
+		{
+			name:   "insert rename",
+			source: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"x", 5}}, nil),
+			target: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"y", bson.D{{"z", 5}}}}, nil),
+		},
+		{
+			name:   "insert replace",
+			source: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"r", 1}, {"s", 2}}, nil),
+			target: transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"r", "hidden"}, {"s", "masked"}}, nil),
+		},
+		{
+			name:   "database rule",
+			source: transformOplogDocument("i", "db.other", bson.D{{"_id", 1}, {"secret", 1}, {"a", bson.D{{"b", 1}}}}, nil),
+			target: transformOplogDocument("i", "db.other", bson.D{{"_id", 1}, {"a", bson.D{{"b", 1}}}}, nil),
+		},
+		{
+			name: "update set",
+			source: transformOplogDocument("u", "db.c",
+				bson.D{{"$set", bson.D{{"a.b", 1}, {"k", 2}, {"x", 3}}}}, bson.D{{"_id", 1}}),
+			target: transformOplogDocument("u", "db.c",
+				bson.D{{"$set", bson.D{{"k", 2}, {"y.z", 3}}}}, bson.D{{"_id", 1}}),
+		},
+		{
+			name: "update set parent",
+			source: transformOplogDocument("u", "db.c",
+				bson.D{{"$set", bson.D{{"a", bson.D{{"b", 1}, {"c", 2}}}}}}, bson.D{{"_id", 1}}),
+			target: transformOplogDocument("u", "db.c",
+				bson.D{{"$set", bson.D{{"a", bson.D{{"c", 2}}}}}}, bson.D{{"_id", 1}}),
+		},
+		{
+			name: "update unset rename",
+			source: transformOplogDocument("u", "db.c",
+				bson.D{{"$unset", bson.D{{"x", true}, {"a.b", true}}}}, bson.D{{"_id", 1}}),
+			target: transformOplogDocument("u", "db.c",
+				bson.D{{"$unset", bson.D{{"y.z", true}, {"a.b", true}}}}, bson.D{{"_id", 1}}),
+		},
+		{
+			name: "update replacement",
+			source: transformOplogDocument("u", "db.c",
+				bson.D{{"_id", 1}, {"x", 5}}, bson.D{{"_id", 1}}),
+			target: transformOplogDocument("u", "db.c",
+				bson.D{{"_id", 1}, {"y", bson.D{{"z", 5}}}}, bson.D{{"_id", 1}}),
+		},
+		{
+			name: "update query",
+			source: transformOplogDocument("u", "db.c",
+				bson.D{{"$set", bson.D{{"k", 1}}}}, bson.D{{"_id", 1}, {"x", 5}}),
+			target: transformOplogDocument("u", "db.c",
+				bson.D{{"$set", bson.D{{"k", 1}}}}, bson.D{{"_id", 1}, {"y.z", 5}}),
+		},
+		{
+			name: "update of dropped fields only",
+			source: transformOplogDocument("u", "db.c",
+				bson.D{{"$v", 1}, {"$set", bson.D{{"a.b", 1}}}}, bson.D{{"_id", 1}}),
+			target: transformOplogDocument("n", "db.c",
+				bson.D{{"msg", "update of fields dropped by transform"}}, nil),
+		},
+		{
+			name:   "delete",
+			source: transformOplogDocument("d", "db.c", bson.D{{"_id", 1}, {"x", 5}, {"r", 1}}, nil),
+			target: transformOplogDocument("d", "db.c", bson.D{{"_id", 1}, {"r", "hidden"}, {"y.z", 5}}, nil),
+		},
+		{
+			name: "applyOps",
+			source: transformOplogDocument("c", "admin.$cmd", bson.D{{"applyOps", []interface{}{
+				bson.D{{"op", "i"}, {"ns", "db.c"}, {"o", bson.D{{"_id", 1}, {"a", bson.D{{"b", 1}}}}}},
+				bson.D{{"op", "i"}, {"ns", "db2.c"}, {"o", bson.D{{"_id", 1}, {"a", bson.D{{"b", 1}}}}}},
+			}}}, nil),
+			target: transformOplogDocument("c", "admin.$cmd", bson.D{{"applyOps", []interface{}{
+				bson.D{{"op", "i"}, {"ns", "db.c"}, {"o", bson.D{{"_id", 1}, {"a", bson.D{}}}}},
+				bson.D{{"op", "i"}, {"ns", "db2.c"}, {"o", bson.D{{"_id", 1}, {"a", bson.D{{"b", 1}}}}}},
+			}}}, nil),
+		},
+	}
+	for _, test := range tests {
+		transformed, err := transformer.Transform(newRawOplog(t, test.source))
+		if err != nil {
+			t.Errorf("%s: transform failed. %v", test.name, err)
+			continue
+		}
+		if len(transformed) != 1 {
+			t.Errorf("%s: transformed to %d oplogs", test.name, len(transformed))
+			continue
+		}
+		var document bson.D
+		if err := bson.Unmarshal(transformed[0].Raw, &document); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(document, test.target) {
+			t.Errorf("%s: transformed is %v, should be %v", test.name, document, test.target)
+		}
+		if transformed[0].Parsed.Operation != test.target[1].Value {
+			t.Errorf("%s: parsed operation is %s", test.name, transformed[0].Parsed.Operation)
+		}
+	}
+}
+
+func TestFieldTransformerDiff(t *testing.T) {
+	transformer, err := NewFieldTransformer([]string{
+		"db.c:drop:a.b",
+		"db.c:rename:x:y",
+		"db.c:rename:m.p:m.q",
+		`db.c:replace:r:"hidden"`,
+		"db.c:drop:arr.secret",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(diff bson.D) bson.D {
+		return transformOplogDocument("u", "db.c", bson.D{{"$v", 2}, {"diff", diff}}, bson.D{{"_id", 1}})
+	}
+
+	tests := []struct {
+		name   string
+		source bson.D
+		target bson.D
+	}{
+		{
+			name: "updated and inserted",
+			source: update(bson.D{{"u", bson.D{{"x", 1}, {"r", 2}, {"m", bson.D{{"p", 1}}}, {"k", 3}}},
+				{"i", bson.D{{"a", bson.D{{"b", 1}, {"c", 2}}}}}}),
+			target: update(bson.D{{"u", bson.D{{"y", 1}, {"r", "hidden"}, {"m", bson.D{{"q", 1}}}, {"k", 3}}},
+				{"i", bson.D{{"a", bson.D{{"c", 2}}}}}}),
+		},
+		{
+			name:   "deleted",
+			source: update(bson.D{{"d", bson.D{{"x", false}, {"a", false}, {"r", false}}}}),
+			target: update(bson.D{{"d", bson.D{{"y", false}, {"a", false}, {"r", false}}}}),
+		},
+		{
+			name: "sub document",
+			source: update(bson.D{{"sa", bson.D{{"d", bson.D{{"b", false}}}, {"u", bson.D{{"c", 1}}}}},
+				{"sm", bson.D{{"u", bson.D{{"p", 1}}}}}, {"sx", bson.D{{"u", bson.D{{"k", 1}}}}},
+				{"sr", bson.D{{"u", bson.D{{"k", 1}}}}}}),
+			target: update(bson.D{{"sa", bson.D{{"u", bson.D{{"c", 1}}}}},
+				{"sm", bson.D{{"u", bson.D{{"q", 1}}}}}, {"sy", bson.D{{"u", bson.D{{"k", 1}}}}}}),
+		},
+		{
+			name: "array",
+			source: update(bson.D{{"sarr", bson.D{{"a", true}, {"u0", bson.D{{"secret", 1}, {"v", 1}}},
+				{"s1", bson.D{{"d", bson.D{{"secret", false}}}, {"u", bson.D{{"v", 2}}}}}}}}),
+			target: update(bson.D{{"sarr", bson.D{{"a", true}, {"u0", bson.D{{"v", 1}}},
+				{"s1", bson.D{{"u", bson.D{{"v", 2}}}}}}}}),
+		},
+		{
+			name:   "update of dropped fields only",
+			source: update(bson.D{{"sa", bson.D{{"u", bson.D{{"b", 1}}}}}}),
+			target: transformOplogDocument("n", "db.c",
+				bson.D{{"msg", "update of fields dropped by transform"}}, nil),
+		},
+	}
+	for _, test := range tests {
+		transformed, err := transformer.Transform(newRawOplog(t, test.source))
+		if err != nil {
+			t.Errorf("%s: transform failed. %v", test.name, err)
+			continue
+		}
+		var document bson.D
+		if err := bson.Unmarshal(transformed[0].Raw, &document); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(document, test.target) {
+			t.Errorf("%s: transformed is %v, should be %v", test.name, document, test.target)
+		}
+	}
+
+	// the field renamed to another parent can't be moved by diff
+	transformer, err = NewFieldTransformer([]string{"db.c:rename:x:y.z"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transformer.Transform(newRawOplog(t, update(bson.D{{"u", bson.D{{"x", 1}}}}))); err == nil {
+		t.Errorf("rename to another parent is applied on diff")
+	}
+	log := newRawOplog(t, update(bson.D{{"u", bson.D{{"k", 1}}}}))
+	if transformed, err := transformer.Transform(log); err != nil || transformed[0] != log {
+		t.Errorf("diff without the field renamed is transformed. %v", err)
+	}
+}
+
+func TestFieldTransformerUnaffected(t *testing.T) {
+	transformer, err := NewFieldTransformer([]string{"db.c:drop:a"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, document := range []bson.D{
+		transformOplogDocument("i", "db.other", bson.D{{"_id", 1}, {"a", 1}}, nil),
+		transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"b", 1}}, nil),
+		transformOplogDocument("c", "db.$cmd", bson.D{{"drop", "c"}}, nil),
+		transformOplogDocument("n", "", bson.D{{"msg", "noop"}}, nil),
+	} {
+		log := newRawOplog(t, document)
+		transformed, err := transformer.Transform(log)
+		if err != nil || len(transformed) != 1 || transformed[0] != log {
+			t.Errorf("oplog %v shouldn't be transformed. %v %v", document, transformed, err)
+		}
+	}
+}
+
+func TestFieldTransformerHash(t *testing.T) {
+	hash := func(salt string, value interface{}) interface{} {
+		transformer, err := NewFieldTransformer([]string{"db.c:hash:h"}, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transformed, err := transformer.Transform(newRawOplog(t,
+			transformOplogDocument("i", "db.c", bson.D{{"_id", 1}, {"h", value}}, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var document struct {
+			Object bson.M `bson:"o"`
+		}
+		if err := bson.Unmarshal(transformed[0].Raw, &document); err != nil {
+			t.Fatal(err)
+		}
+		return document.Object["h"]
+	}
+
+	hashed := hash("salt", 1)
+	if digest, ok := hashed.(string); !ok || len(digest) != 64 {
+		t.Fatalf("hashed should be hex of sha256. is %v", hashed)
+	}
+	if again := hash("salt", 1); again != hashed {
+		t.Errorf("the same value is hashed to %v and %v", hashed, again)
+	}
+	if other := hash("salt", "1"); other == hashed {
+		t.Errorf("1 and \"1\" are hashed to the same")
+	}
+	if other := hash("pepper", 1); other == hashed {
+		t.Errorf("the different salts hash to the same")
+	}
+}
@@ -1,12 +1,17 @@
 package collector
 
 import (
+	"errors"
 	"strings"
 	"fmt"
 	"regexp"
+	"sort"
 
 	"mongoshake/common"
+	"mongoshake/executor"
 	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
 )
 
 var NsShouldBeIgnore = [...]string{
@@ -28,12 +33,37 @@ type OplogFilter interface {
 type OplogFilterChain []OplogFilter
 
 func (chain OplogFilterChain) IterateFilter(log *oplog.PartialLog) bool {
-	for _, filter := range chain {
+	return chain.Match(log) != -1
+}
+
+// Match returns the index of the first filter drops the oplog. -1 if none
+func (chain OplogFilterChain) Match(log *oplog.PartialLog) int {
+	for i, filter := range chain {
 		if filter.Filter(log) {
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
+}
+
+// QueryFilter is implemented by the filters that can be pushed down into
+// the oplog query of source. the condition matches all the oplogs that pass
+// the filter and maybe more. so the filter is still applied in collector
+type QueryFilter interface {
+	Query() bson.M
+}
+
+// Query returns the conditions of all the filters can be pushed down
+func (chain OplogFilterChain) Query() []bson.M {
+	var conditions []bson.M
+	for _, filter := range chain {
+		if query, ok := filter.(QueryFilter); ok {
+			if condition := query.Query(); condition != nil {
+				conditions = append(conditions, condition)
+			}
+		}
+	}
+	return conditions
 }
 
 type GidFilter struct {
@@ -45,6 +75,13 @@ func (filter *GidFilter) Filter(log *oplog.PartialLog) bool {
 	return len(filter.Gid) != 0 && log.Gid != filter.Gid
 }
 
+func (filter *GidFilter) Query() bson.M {
+	if len(filter.Gid) == 0 {
+		return nil
+	}
+	return bson.M{"g": filter.Gid}
+}
+
 type AutologousFilter struct {
 }
 
@@ -66,11 +103,135 @@ func (filter *NoopFilter) Filter(log *oplog.PartialLog) bool {
 	return log.Operation == "n"
 }
 
+// DDLFilter drops the commands by name. the names are the commands known
+// by executor. the index built by inserting into system.indexes is taken as
+// createIndexes. only one of white and black list is given
 type DDLFilter struct {
+	white map[string]bool
+	black map[string]bool
+}
+
+func NewDDLFilter(white, black []string) (*DDLFilter, error) {
+	if len(white) != 0 && len(black) != 0 {
+		return nil, errors.New("only one of ddl white and black list can be given")
+	}
+	var err error
+	filter := &DDLFilter{}
+	if filter.white, err = commandSet(white); err != nil {
+		return nil, err
+	}
+	if filter.black, err = commandSet(black); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func commandSet(names []string) (map[string]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool)
+	for _, name := range names {
+		if !executor.IsCommand(name) {
+			return nil, fmt.Errorf("ddl command %s is unknown", name)
+		}
+		set[name] = true
+	}
+	return set, nil
 }
 
 func (filter *DDLFilter) Filter(log *oplog.PartialLog) bool {
-	return log.Operation == "c" || strings.HasSuffix(log.Namespace, "system.indexes")
+	var name string
+	switch {
+	case log.Operation == "c":
+		name, _ = executor.CommandName(log.Object)
+	case log.Operation == "i" && strings.HasSuffix(log.Namespace, ".system.indexes"):
+		name = "createIndexes"
+	default:
+		return false
+	}
+
+	if filter.white != nil {
+		return !filter.white[name]
+	}
+	return filter.black[name]
+}
+
+var operationNames = map[string]string{
+	"i":      "i",
+	"insert": "i",
+	"u":      "u",
+	"update": "u",
+	"d":      "d",
+	"delete": "d",
+}
+
+// OperationFilter drops the inserts, updates or deletes of namespaces. a
+// rule is "[namespace:]operations" where namespace is "db" or
+// "db.collection" and operations are split by comma. the rule without
+// namespace is applied to all. commands are never dropped by it
+type OperationFilter struct {
+	// keyed by namespace of rule. "" means all
+	rules map[string]map[string]bool
+}
+
+func NewOperationFilter(rules []string) (*OperationFilter, error) {
+	filter := &OperationFilter{rules: make(map[string]map[string]bool)}
+	for _, rule := range rules {
+		var ns, operations string
+		if index := strings.LastIndex(rule, ":"); index == -1 {
+			operations = rule
+		} else if ns, operations = rule[:index], rule[index+1:]; ns == "" {
+			return nil, fmt.Errorf("operation filter rule[%s] has empty namespace", rule)
+		}
+
+		if filter.rules[ns] == nil {
+			filter.rules[ns] = make(map[string]bool)
+		}
+		for _, operation := range strings.Split(operations, ",") {
+			op, exist := operationNames[strings.TrimSpace(operation)]
+			if !exist {
+				return nil, fmt.Errorf("operation filter rule[%s] has unknown operation %s", rule, operation)
+			}
+			filter.rules[ns][op] = true
+		}
+	}
+	return filter, nil
+}
+
+func (filter *OperationFilter) Filter(log *oplog.PartialLog) bool {
+	op := log.Operation
+	if strings.HasSuffix(log.Namespace, ".system.indexes") {
+		// the index built. leave it to ddl filter
+		return false
+	}
+	if op != "i" && op != "u" && op != "d" {
+		return false
+	}
+	if filter.rules[""][op] || filter.rules[log.Namespace][op] {
+		return true
+	}
+	database := strings.SplitN(log.Namespace, ".", 2)[0]
+	return filter.rules[database][op]
+}
+
+// Query pushes the operations dropped on all namespaces down
+func (filter *OperationFilter) Query() bson.M {
+	global := filter.rules[""]
+	if len(global) == 0 {
+		return nil
+	}
+	operations := make([]string, 0, len(global))
+	for op := range global {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+	condition := bson.M{"op": bson.M{"$nin": operations}}
+	if global["i"] {
+		// the index built is kept
+		return bson.M{"$or": []bson.M{condition, {"ns": bson.RegEx{Pattern: `\.system\.indexes$`}}}}
+	}
+	return condition
 }
 
 // because regexp use the default perl engine which is not support inverse match, so
@@ -126,4 +287,25 @@ func (filter *NamespaceFilter) Filter(log *oplog.PartialLog) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// Query keeps all the commands even if the database isn't in white list.
+// because transactions are on admin.$cmd and the operations are checked
+// after expanded
+func (filter *NamespaceFilter) Query() bson.M {
+	var conditions []bson.M
+	if filter.whiteRule != "" {
+		conditions = append(conditions, bson.M{"ns": bson.RegEx{Pattern: filter.whiteRule + `|\.\$cmd$`}})
+	}
+	if filter.blackRule != "" {
+		conditions = append(conditions, bson.M{"ns": bson.M{"$not": bson.RegEx{Pattern: filter.blackRule}}})
+	}
+	switch len(conditions) {
+	case 0:
+		return nil
+	case 1:
+		return conditions[0]
+	default:
+		return bson.M{"$and": conditions}
+	}
+}
@@ -0,0 +1,247 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"mongoshake/collector/ckpt"
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/gugemichael/nimo4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+// filterState is the filters used by batcher. it's replaced entirely while
+// rules changed so that batcher needn't lock
+type filterState struct {
+	rules *ckpt.FilterContext
+	chain OplogFilterChain
+	// oplogs dropped by every filter in chain
+	drops []uint64
+}
+
+// configFilterRules returns the rules of filters in configuration
+func configFilterRules() *ckpt.FilterContext {
+	return &ckpt.FilterContext{
+		NamespaceWhite: conf.Options.FilterNamespaceWhite,
+		NamespaceBlack: conf.Options.FilterNamespaceBlack,
+		OperationBlack: conf.Options.FilterOperationBlack,
+		DDLWhite:       conf.Options.FilterDDLWhite,
+		DDLBlack:       conf.Options.FilterDDLBlack,
+		Document:       conf.Options.FilterDocument,
+	}
+}
+
+// newFilterChain creates the filters of rules. the filters of internal
+// namespaces, noops and gid are always in front
+func newFilterChain(gid string, rules *ckpt.FilterContext) (OplogFilterChain, error) {
+	filterList := OplogFilterChain{new(AutologousFilter), new(NoopFilter)}
+	if gid != "" {
+		filterList = append(filterList, &GidFilter{Gid: gid})
+	}
+
+	if len(rules.NamespaceWhite) != 0 && len(rules.NamespaceBlack) != 0 {
+		return nil, errors.New("at most one of black lists and white lists option can be given")
+	}
+	if len(rules.NamespaceWhite) != 0 || len(rules.NamespaceBlack) != 0 {
+		filterList = append(filterList, NewNamespaceFilter(rules.NamespaceWhite, rules.NamespaceBlack))
+	}
+	if len(rules.OperationBlack) != 0 {
+		operationFilter, err := NewOperationFilter(rules.OperationBlack)
+		if err != nil {
+			return nil, err
+		}
+		filterList = append(filterList, operationFilter)
+	}
+	if len(rules.DDLWhite) != 0 || len(rules.DDLBlack) != 0 {
+		ddlFilter, err := NewDDLFilter(rules.DDLWhite, rules.DDLBlack)
+		if err != nil {
+			return nil, err
+		}
+		filterList = append(filterList, ddlFilter)
+	}
+	if rules.Document != "" {
+		documentFilter, err := NewDocumentFilter(rules.Document)
+		if err != nil {
+			return nil, err
+		}
+		filterList = append(filterList, documentFilter)
+	}
+	return filterList, nil
+}
+
+func filterName(filter OplogFilter) string {
+	switch filter.(type) {
+	case *AutologousFilter:
+		return "autologous"
+	case *NoopFilter:
+		return "noop"
+	case *GidFilter:
+		return "gid"
+	case *NamespaceFilter:
+		return "namespace"
+	case *OperationFilter:
+		return "operation"
+	case *DDLFilter:
+		return "ddl"
+	case *DocumentFilter:
+		return "document"
+	default:
+		return fmt.Sprintf("%T", filter)
+	}
+}
+
+func (batcher *Batcher) getFilters() *filterState {
+	return batcher.filters.Load().(*filterState)
+}
+
+// setFilterRules replaces the filters of syncer by rules
+func (sync *OplogSyncer) setFilterRules(rules *ckpt.FilterContext) error {
+	state, err := sync.newFilterState(rules)
+	if err != nil {
+		return err
+	}
+	sync.setFilterState(state)
+	return nil
+}
+
+func (sync *OplogSyncer) newFilterState(rules *ckpt.FilterContext) (*filterState, error) {
+	filterList, err := newFilterChain(sync.gid, rules)
+	if err != nil {
+		return nil, err
+	}
+	return &filterState{
+		rules: rules,
+		chain: filterList,
+		drops: make([]uint64, len(filterList)),
+	}, nil
+}
+
+// setFilterState replaces the filters of syncer. the filters are pushed
+// down into source also
+func (sync *OplogSyncer) setFilterState(state *filterState) {
+	sync.batcher.filters.Store(state)
+
+	// the filters are pushed down into source if possible. they are still
+	// applied in batcher
+	if pushdown, ok := sync.reader.(FilterPushdown); ok {
+		conditions := state.chain.Query()
+		if len(conditions) != 0 {
+			// noops are still fetched. they are the heartbeats of idle source
+			// that advance the checkpoint
+			conditions = []bson.M{{"$or": []bson.M{{"op": "n"}, {QueryAnd: conditions}}}}
+		}
+		LOG.Info("Oplog syncer push filters down into source query %v", conditions)
+		pushdown.SetQueryFilter(conditions)
+	}
+}
+
+// loadFilterRules takes the rules persisted in checkpoint if they differ
+// from the ones in use
+func (sync *OplogSyncer) loadFilterRules(checkpoint *ckpt.CheckpointContext) {
+	if checkpoint.Filter == nil || reflect.DeepEqual(checkpoint.Filter, sync.batcher.getFilters().rules) {
+		return
+	}
+	if err := sync.setFilterRules(checkpoint.Filter); err != nil {
+		LOG.Critical("Oplog syncer load filter rules from checkpoint failed, keep the ones in use. %v", err)
+		return
+	}
+	LOG.Info("Oplog syncer load filter rules from checkpoint %v", checkpoint.Filter)
+}
+
+// filterRestAPI manages the filters of all the syncers. the rules posted
+// replace all the runtime filters and are persisted in checkpoint
+func (coordinator *ReplicationCoordinator) filterRestAPI() {
+	// the rules posted are applied one by one
+	var rulesLock sync.Mutex
+
+	type Filter struct {
+		Name    string `json:"name"`
+		Dropped uint64 `json:"dropped"`
+	}
+	type SyncerFilters struct {
+		Replset string              `json:"replset"`
+		Rules   *ckpt.FilterContext `json:"rules"`
+		Filters []*Filter           `json:"filters"`
+	}
+
+	utils.HttpApi.RegisterAPI("/filter", nimo.HttpGet, func([]byte) interface{} {
+		var syncers []*SyncerFilters
+		for _, syncer := range coordinator.syncerGroup {
+			state := syncer.batcher.getFilters()
+			filters := &SyncerFilters{Replset: syncer.replset, Rules: state.rules}
+			for i, filter := range state.chain {
+				filters.Filters = append(filters.Filters, &Filter{
+					Name:    filterName(filter),
+					Dropped: atomic.LoadUint64(&state.drops[i]),
+				})
+			}
+			syncers = append(syncers, filters)
+		}
+		return syncers
+	})
+
+	// the same location can't serve both of the methods
+	utils.HttpApi.RegisterAPI("/filter/rules", nimo.HttpPost, func(body []byte) interface{} {
+		rules := new(ckpt.FilterContext)
+		if err := json.Unmarshal(body, rules); err != nil {
+			return map[string]string{"filter": fmt.Sprintf("request json rules wrong format. %v", err)}
+		}
+		rulesLock.Lock()
+		defer rulesLock.Unlock()
+		if err := coordinator.updateFilterRules(rules); err != nil {
+			return map[string]string{"filter": err.Error()}
+		}
+		return map[string]string{"filter": "success"}
+	})
+}
+
+// updateFilterRules replaces the filters of all the syncers by rules and
+// persists them. the rules are validated on all the syncers firstly. all
+// of them are rolled back if any fails to persist
+func (coordinator *ReplicationCoordinator) updateFilterRules(rules *ckpt.FilterContext) error {
+	states := make([]*filterState, len(coordinator.syncerGroup))
+	for i, syncer := range coordinator.syncerGroup {
+		if syncer.ckptManager == nil {
+			return fmt.Errorf("checkpoint of replset[%s] isn't loaded yet", syncer.replset)
+		}
+		state, err := syncer.newFilterState(rules)
+		if err != nil {
+			return fmt.Errorf("rules are invalid. %v", err)
+		}
+		states[i] = state
+	}
+
+	previous := make([]*filterState, len(coordinator.syncerGroup))
+	persisted := make([]*ckpt.FilterContext, len(coordinator.syncerGroup))
+	for i, syncer := range coordinator.syncerGroup {
+		previous[i], persisted[i] = syncer.batcher.getFilters(), syncer.ckptManager.GetInMemory().Filter
+		syncer.setFilterState(states[i])
+	}
+	for i, syncer := range coordinator.syncerGroup {
+		if err := syncer.ckptManager.UpdateFilter(rules); err != nil {
+			for j, rollback := range coordinator.syncerGroup {
+				rollback.setFilterState(previous[j])
+				if j >= i {
+					continue
+				}
+				if err := rollback.ckptManager.UpdateFilter(persisted[j]); err != nil {
+					LOG.Critical("Oplog syncer replset[%s] roll back filter rules persisted failed. %v",
+						rollback.replset, err)
+				}
+			}
+			return fmt.Errorf("persist rules of replset[%s] failed, all the rules are rolled back. %v",
+				syncer.replset, err)
+		}
+	}
+	for _, syncer := range coordinator.syncerGroup {
+		LOG.Info("Oplog syncer replset[%s] filter rules changed to %v", syncer.replset, rules)
+	}
+	return nil
+}
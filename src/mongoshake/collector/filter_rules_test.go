@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"mongoshake/collector/ckpt"
+	"mongoshake/collector/configure"
+)
+
+// testContextServer stores the checkpoint posted. posting fails if broken
+type testContextServer struct {
+	broken int32
+	filter *ckpt.FilterContext
+}
+
+func (server *testContextServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Write([]byte("{}"))
+		return
+	}
+	if atomic.LoadInt32(&server.broken) != 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	checkpoint := new(ckpt.CheckpointContext)
+	json.Unmarshal(body, checkpoint)
+	server.filter = checkpoint.Filter
+}
+
+func newTestFilterSyncer(t *testing.T, replset string, server *httptest.Server) *OplogSyncer {
+	storage, address := conf.Options.ContextStorage, conf.Options.ContextAddress
+	defer func() { conf.Options.ContextStorage, conf.Options.ContextAddress = storage, address }()
+	conf.Options.ContextStorage, conf.Options.ContextAddress = ckpt.StorageTypeAPI, server.URL
+
+	syncer := &OplogSyncer{replset: replset, batcher: &Batcher{}, ckptManager: ckpt.NewCheckpointManager(replset)}
+	syncer.batcher.syncer = syncer
+	if err := syncer.setFilterRules(&ckpt.FilterContext{}); err != nil {
+		t.Fatalf("set filter rules failed. %v", err)
+	}
+	if syncer.ckptManager.Get() == nil {
+		t.Fatal("checkpoint isn't loaded")
+	}
+	return syncer
+}
+
+func TestUpdateFilterRules(t *testing.T) {
+	contexts := []*testContextServer{new(testContextServer), new(testContextServer)}
+	coordinator := &ReplicationCoordinator{}
+	for i, replset := range []string{"rs0", "rs1"} {
+		server := httptest.NewServer(contexts[i])
+		defer server.Close()
+		coordinator.syncerGroup = append(coordinator.syncerGroup, newTestFilterSyncer(t, replset, server))
+	}
+	previous := []*filterState{coordinator.syncerGroup[0].batcher.getFilters(),
+		coordinator.syncerGroup[1].batcher.getFilters()}
+	checkUnchanged := func(name string) {
+		for i, syncer := range coordinator.syncerGroup {
+			if syncer.batcher.getFilters() != previous[i] {
+				t.Errorf("%s: filters of %s are changed", name, syncer.replset)
+			}
+			if syncer.ckptManager.GetInMemory().Filter != nil || contexts[i].filter != nil {
+				t.Errorf("%s: filter rules of %s are persisted", name, syncer.replset)
+			}
+		}
+	}
+
+	// invalid on all the syncers
+	invalid := &ckpt.FilterContext{NamespaceWhite: []string{"a.b"}, NamespaceBlack: []string{"c.d"}}
+	if err := coordinator.updateFilterRules(invalid); err == nil {
+		t.Error("invalid rules are updated")
+	}
+	checkUnchanged("invalid")
+
+	// the second fails to persist. the first is rolled back
+	rules := &ckpt.FilterContext{NamespaceWhite: []string{"a.b"}}
+	atomic.StoreInt32(&contexts[1].broken, 1)
+	if err := coordinator.updateFilterRules(rules); err == nil {
+		t.Error("rules are updated while persisting failed")
+	}
+	checkUnchanged("persist failed")
+
+	atomic.StoreInt32(&contexts[1].broken, 0)
+	if err := coordinator.updateFilterRules(rules); err != nil {
+		t.Fatalf("update rules failed. %v", err)
+	}
+	for i, syncer := range coordinator.syncerGroup {
+		if syncer.batcher.getFilters().rules != rules || syncer.ckptManager.GetInMemory().Filter != rules {
+			t.Errorf("filters of %s aren't updated", syncer.replset)
+		}
+		if contexts[i].filter == nil || len(contexts[i].filter.NamespaceWhite) != 1 {
+			t.Errorf("filter rules of %s persisted are %v", syncer.replset, contexts[i].filter)
+		}
+	}
+}
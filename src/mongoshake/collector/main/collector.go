@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"syscall"
 
@@ -143,17 +144,78 @@ func sanitizeOptions() error {
 	if conf.Options.HTTPListenPort <= 1024 && conf.Options.HTTPListenPort > 0 {
 		return errors.New("http listen port too low numeric")
 	}
+	if conf.Options.SyncMode == "" {
+		conf.Options.SyncMode = collector.SyncModeOplog
+	}
+	if conf.Options.SyncMode != collector.SyncModeAll &&
+		conf.Options.SyncMode != collector.SyncModeDocument &&
+		conf.Options.SyncMode != collector.SyncModeOplog {
+		return errors.New("sync mode is unknown")
+	}
+	if conf.Options.DocumentSplitSize < 0 {
+		return errors.New("document split size is negative")
+	}
 	if conf.Options.CheckpointInterval <= 0 {
 		return errors.New("checkpoint batch size is negative")
 	}
 	if conf.Options.ShardKey != oplog.ShardByNamespace &&
 		conf.Options.ShardKey != oplog.ShardByID &&
-		conf.Options.ShardKey != oplog.ShardAutomatic {
+		conf.Options.ShardKey != oplog.ShardAutomatic &&
+		conf.Options.ShardKey != oplog.ShardByField {
 		return errors.New("shard key type is unknown")
 	}
+	if conf.Options.ShardKey == oplog.ShardByField {
+		if len(conf.Options.ShardKeyFields) == 0 {
+			return errors.New("shard key fields should be given while sharding by field")
+		}
+		if _, err := oplog.NewFieldHasher(conf.Options.ShardKeyFields); err != nil {
+			return err
+		}
+	}
 	if conf.Options.SyncerReaderBufferTime == 0 {
 		return errors.New("syncer buffer time can't be 0")
 	}
+	if conf.Options.SyncerReaderMethod == "" {
+		conf.Options.SyncerReaderMethod = collector.ReaderMethodOplog
+	}
+	if conf.Options.SyncerReaderMethod != collector.ReaderMethodOplog &&
+		conf.Options.SyncerReaderMethod != collector.ReaderMethodChangeStream {
+		return errors.New("syncer reader method is unknown")
+	}
+	if conf.Options.SyncerReaderMethod == collector.ReaderMethodChangeStream && conf.Options.OplogGIDS != "" {
+		return errors.New("oplog gids is not supported in change stream")
+	}
+	if _, err := collector.NewOperationFilter(conf.Options.FilterOperationBlack); err != nil {
+		return err
+	}
+	if _, err := collector.NewDDLFilter(conf.Options.FilterDDLWhite, conf.Options.FilterDDLBlack); err != nil {
+		return err
+	}
+	if conf.Options.FilterDocument != "" {
+		if _, err := collector.NewDocumentFilter(conf.Options.FilterDocument); err != nil {
+			return err
+		}
+	}
+	if _, err := collector.NewNamespaceMapper(conf.Options.NamespaceMapping); err != nil {
+		return err
+	}
+	if _, err := collector.NewTransformerChain(); err != nil {
+		return err
+	}
+	if conf.Options.RollbackPolicy == "" {
+		conf.Options.RollbackPolicy = collector.RollbackPolicyStop
+	}
+	if conf.Options.RollbackPolicy != collector.RollbackPolicyStop &&
+		conf.Options.RollbackPolicy != collector.RollbackPolicyResync {
+		return errors.New("rollback policy is unknown")
+	}
+	if conf.Options.CappedPolicy == "" {
+		conf.Options.CappedPolicy = collector.CappedPolicyStop
+	}
+	if conf.Options.CappedPolicy != collector.CappedPolicyStop &&
+		conf.Options.CappedPolicy != collector.CappedPolicyResync {
+		return errors.New("capped policy is unknown")
+	}
 	if conf.Options.WorkerNum <= 0 || conf.Options.WorkerNum > 256 {
 		return errors.New("worker numeric is not valid")
 	}
@@ -168,9 +230,38 @@ func sanitizeOptions() error {
 	if conf.Options.WorkerOplogCompressor != module.CompressionNone &&
 		conf.Options.WorkerOplogCompressor != module.CompressionGzip &&
 		conf.Options.WorkerOplogCompressor != module.CompressionZlib &&
-		conf.Options.WorkerOplogCompressor != module.CompressionDeflate {
+		conf.Options.WorkerOplogCompressor != module.CompressionDeflate &&
+		conf.Options.WorkerOplogCompressor != module.CompressionSnappy &&
+		conf.Options.WorkerOplogCompressor != module.CompressionLZ4 &&
+		conf.Options.WorkerOplogCompressor != module.CompressionZstd {
 		return errors.New("compressor is not supported")
 	}
+	if err := module.CheckCompressLevel(conf.Options.WorkerOplogCompressor,
+		conf.Options.WorkerOplogCompressLevel); err != nil {
+		return err
+	}
+	if conf.Options.WorkerOplogCompressMode == "" {
+		conf.Options.WorkerOplogCompressMode = module.CompressModeLog
+	} else if conf.Options.WorkerOplogCompressMode != module.CompressModeLog &&
+		conf.Options.WorkerOplogCompressMode != module.CompressModeMessage {
+		return errors.New("compress mode is not supported")
+	}
+	if conf.Options.WorkerOplogEncryptor == "" {
+		conf.Options.WorkerOplogEncryptor = module.EncryptionNone
+	} else if conf.Options.WorkerOplogEncryptor != module.EncryptionNone &&
+		conf.Options.WorkerOplogEncryptor != module.EncryptionAESGCM {
+		return errors.New("encryptor is not supported")
+	}
+	if conf.Options.WorkerOplogEncryptor != module.EncryptionNone {
+		ring, err := module.LoadKeyRing(conf.Options.WorkerOplogEncryptorKeyFile)
+		if err != nil {
+			return fmt.Errorf("load encryption key file failed. %v", err)
+		}
+		if conf.Options.WorkerOplogEncryptorKeyId > math.MaxUint32 ||
+			!ring.Has(uint32(conf.Options.WorkerOplogEncryptorKeyId)) {
+			return errors.New("encryption key id isn't in key file")
+		}
+	}
 	if conf.Options.MasterQuorum && conf.Options.ContextStorage != ckpt.StorageTypeDB {
 		return errors.New("context storage should set to 'database' while master election enabled")
 	}
@@ -0,0 +1,119 @@
+package collector
+
+import (
+	"fmt"
+
+	"mongoshake/dbpool"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+// loadCollections lists all the collections and views should be synced
+func (doc *DocumentSyncer) loadCollections() ([]*dbpool.CollectionSpec, error) {
+	databases, err := doc.conn.Session.DatabaseNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var specs []*dbpool.CollectionSpec
+	for _, database := range databases {
+		if database == "admin" || database == "local" {
+			continue
+		}
+		all, err := doc.conn.GetCollectionSpecs(database)
+		if err != nil {
+			return nil, fmt.Errorf("list collections of %s failed. %v", database, err)
+		}
+		for _, spec := range all {
+			if doc.filter(spec.NS) {
+				LOG.Info("Document syncer skip namespace %s", spec.NS.Str())
+				continue
+			}
+			specs = append(specs, spec)
+		}
+	}
+	return specs, nil
+}
+
+// syncMeta creates the collections and views with the same options of
+// source on target. indexes are built also if withIndex is true. they are
+// shipped as command oplogs at ts through the tunnel. so target gets them
+// in any tunnel and renamed as the other oplogs. both of them are
+// idempotent and done again after restart
+func (doc *DocumentSyncer) syncMeta(ts bson.MongoTimestamp, specs []*dbpool.CollectionSpec, withIndex bool) error {
+	batch := make([]*oplog.GenericOplog, 0, len(specs))
+	for _, spec := range specs {
+		create := append(bson.D{{"create", spec.NS.Collection}}, spec.Options...)
+		log, err := NewCommandOplog(spec.NS.Database, ts, create)
+		if err != nil {
+			return fmt.Errorf("convert create of %s failed. %v", spec.NS.Str(), err)
+		}
+		batch = append(batch, log)
+	}
+	if len(batch) != 0 {
+		doc.shipCommands(batch)
+		LOG.Info("Document syncer create %d collections and views on target", len(batch))
+	}
+
+	if withIndex {
+		return doc.syncIndexes(ts, specs)
+	}
+	return nil
+}
+
+// syncIndexes builds the indexes of source collections on target. every
+// index is shipped as one createIndexes oplog in the form of MongoDB 4.2
+func (doc *DocumentSyncer) syncIndexes(ts bson.MongoTimestamp, specs []*dbpool.CollectionSpec) error {
+	var batch []*oplog.GenericOplog
+	for _, spec := range specs {
+		if spec.IsView() {
+			continue
+		}
+
+		indexes, err := doc.conn.GetIndexSpecs(spec.NS)
+		if err != nil {
+			return fmt.Errorf("list indexes of %s failed. %v", spec.NS.Str(), err)
+		}
+
+		for _, index := range indexes {
+			create := bson.D{{"createIndexes", spec.NS.Collection}}
+			var name interface{}
+			for _, field := range index {
+				switch field.Name {
+				case "ns":
+					// deprecated. the namespace is given in command
+				case "name":
+					name = field.Value
+					fallthrough
+				default:
+					create = append(create, field)
+				}
+			}
+			// _id index is created along with the collection
+			if name == "_id_" {
+				continue
+			}
+			log, err := NewCommandOplog(spec.NS.Database, ts, create)
+			if err != nil {
+				return fmt.Errorf("convert index %v of %s failed. %v", name, spec.NS.Str(), err)
+			}
+			batch = append(batch, log)
+		}
+	}
+	if len(batch) != 0 {
+		doc.shipCommands(batch)
+		LOG.Info("Document syncer create %d indexes on target", len(batch))
+	}
+	return nil
+}
+
+// shipCommands offers the command oplogs to the first worker and waits
+// until all of them are acked
+func (doc *DocumentSyncer) shipCommands(batch []*oplog.GenericOplog) {
+	worker := doc.syncer.batcher.workerGroup[0]
+	worker.AllAcked(false)
+	worker.Offer(batch)
+	worker.waitAllAcked()
+}
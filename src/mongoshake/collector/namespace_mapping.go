@@ -0,0 +1,300 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+
+	"mongoshake/dbpool"
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+// the commands whose first field is the collection operated on
+var collectionCommands = map[string]bool{
+	"create":           true,
+	"drop":             true,
+	"collMod":          true,
+	"createIndexes":    true,
+	"dropIndexes":      true,
+	"deleteIndexes":    true,
+	"convertToCapped":  true,
+	"emptycapped":      true,
+	"startIndexBuild":  true,
+	"commitIndexBuild": true,
+	"abortIndexBuild":  true,
+}
+
+// NamespaceMapper renames the namespaces of oplogs from source to target.
+// A rule is "source:target" and both sides are databases or collections.
+// The collection rules take precedence over the database rules. The
+// namespaces embedded in commands are renamed also.
+type NamespaceMapper struct {
+	databases   map[string]string
+	collections map[string]string
+	// databases that have collection rules
+	collectionDatabases map[string]bool
+}
+
+// NewNamespaceMapper parses the rules. nil is returned if no rule given
+func NewNamespaceMapper(rules []string) (*NamespaceMapper, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	mapper := &NamespaceMapper{
+		databases:           make(map[string]string),
+		collections:         make(map[string]string),
+		collectionDatabases: make(map[string]bool),
+	}
+	for _, rule := range rules {
+		pair := strings.Split(rule, ":")
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("namespace mapping rule[%s] should be source:target", rule)
+		}
+		source, target := pair[0], pair[1]
+		sourceDc := strings.SplitN(source, ".", 2)
+		targetDc := strings.SplitN(target, ".", 2)
+		if len(sourceDc) != len(targetDc) {
+			return nil, fmt.Errorf("namespace mapping rule[%s] should map database to database or "+
+				"collection to collection", rule)
+		}
+		if _, exist := mapper.databases[source]; exist {
+			return nil, fmt.Errorf("namespace mapping rule of %s is duplicated", source)
+		}
+		if _, exist := mapper.collections[source]; exist {
+			return nil, fmt.Errorf("namespace mapping rule of %s is duplicated", source)
+		}
+
+		if len(sourceDc) == 1 {
+			mapper.databases[source] = target
+		} else {
+			mapper.collections[source] = target
+			mapper.collectionDatabases[sourceDc[0]] = true
+		}
+	}
+	return mapper, nil
+}
+
+// MapNamespace returns the target namespace of "db.collection"
+func (mapper *NamespaceMapper) MapNamespace(ns string) string {
+	if target, exist := mapper.collections[ns]; exist {
+		return target
+	}
+	dc := strings.SplitN(ns, ".", 2)
+	if target, exist := mapper.databases[dc[0]]; exist {
+		dc[0] = target
+		return strings.Join(dc, ".")
+	}
+	return ns
+}
+
+// MapNS is MapNamespace on NS
+func (mapper *NamespaceMapper) MapNS(ns dbpool.NS) dbpool.NS {
+	dc := strings.SplitN(mapper.MapNamespace(ns.Str()), ".", 2)
+	return dbpool.NS{Database: dc[0], Collection: dc[1]}
+}
+
+// MapDatabase returns the target of database. it's only renamed by the
+// database rules
+func (mapper *NamespaceMapper) MapDatabase(database string) string {
+	if target, exist := mapper.databases[database]; exist {
+		return target
+	}
+	return database
+}
+
+// MapAll renames the oplogs. the oplogs renamed are new ones and the given
+// ones aren't changed. so it's safe to map the retransmitted oplogs again
+func (mapper *NamespaceMapper) MapAll(logs []*oplog.GenericOplog) ([]*oplog.GenericOplog, error) {
+	var mapped []*oplog.GenericOplog
+	for i, log := range logs {
+		if !mapper.affected(log.Parsed) {
+			if mapped != nil {
+				mapped = append(mapped, log)
+			}
+			continue
+		}
+
+		renamed, err := mapper.Map(log)
+		if err != nil {
+			return nil, err
+		}
+		if mapped == nil && renamed != log {
+			mapped = append(make([]*oplog.GenericOplog, 0, len(logs)), logs[:i]...)
+		}
+		if mapped != nil {
+			mapped = append(mapped, renamed)
+		}
+	}
+	if mapped == nil {
+		return logs, nil
+	}
+	return mapped, nil
+}
+
+// affected tells whether the oplog may be renamed
+func (mapper *NamespaceMapper) affected(log *oplog.PartialLog) bool {
+	database := strings.SplitN(log.Namespace, ".", 2)[0]
+	if _, exist := mapper.databases[database]; exist || mapper.collectionDatabases[database] {
+		return true
+	}
+	// renameCollection and applyOps
+	return database == "admin" && log.Operation == "c"
+}
+
+// Map renames the oplog. the oplog given is returned if nothing renamed
+func (mapper *NamespaceMapper) Map(log *oplog.GenericOplog) (*oplog.GenericOplog, error) {
+	var document bson.D
+	if err := bson.Unmarshal(log.Raw, &document); err != nil {
+		return nil, fmt.Errorf("decode oplog failed. %v", err)
+	}
+	if !mapper.mapOplog(document) {
+		return log, nil
+	}
+
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("encode oplog renamed failed. %v", err)
+	}
+	parsed := new(oplog.PartialLog)
+	if err = bson.Unmarshal(raw, parsed); err != nil {
+		return nil, fmt.Errorf("decode oplog renamed failed. %v", err)
+	}
+	parsed.Txn = log.Parsed.Txn
+	return &oplog.GenericOplog{Raw: raw, Parsed: parsed}, nil
+}
+
+// mapOplog renames the oplog in place. returns true if anything changed
+func (mapper *NamespaceMapper) mapOplog(document bson.D) bool {
+	var operation, ns string
+	nsIndex, objectIndex := -1, -1
+	for i, field := range document {
+		switch field.Name {
+		case "op":
+			operation, _ = field.Value.(string)
+		case "ns":
+			ns, _ = field.Value.(string)
+			nsIndex = i
+		case "o":
+			objectIndex = i
+		}
+	}
+	if nsIndex == -1 || ns == "" {
+		return false
+	}
+
+	var object bson.D
+	if objectIndex != -1 {
+		object, _ = document[objectIndex].Value.(bson.D)
+	}
+
+	var target string
+	changed := false
+	switch {
+	case operation == "c":
+		var database string
+		database, changed = mapper.mapCommand(strings.TrimSuffix(ns, ".$cmd"), object)
+		target = database + ".$cmd"
+	case strings.HasSuffix(ns, ".system.indexes"):
+		// index built before 4.2 is an insert of the spec
+		target = ns
+		if index := findField(object, "ns"); index != -1 {
+			if indexNs, ok := object[index].Value.(string); ok {
+				object[index].Value = mapper.MapNamespace(indexNs)
+				changed = object[index].Value != indexNs
+				target = strings.SplitN(object[index].Value.(string), ".", 2)[0] + ".system.indexes"
+			}
+		}
+	default:
+		target = mapper.MapNamespace(ns)
+	}
+
+	document[nsIndex].Value = target
+	return changed || target != ns
+}
+
+// mapCommand renames the namespaces in command of database. returns the
+// target database and whether the command changed
+func (mapper *NamespaceMapper) mapCommand(database string, command bson.D) (string, bool) {
+	if len(command) == 0 {
+		return mapper.MapDatabase(database), false
+	}
+
+	name := command[0].Name
+	switch {
+	case collectionCommands[name]:
+		collection, ok := command[0].Value.(string)
+		if !ok {
+			break
+		}
+		dc := strings.SplitN(mapper.MapNamespace(database+"."+collection), ".", 2)
+		changed := dc[1] != collection
+		command[0].Value = dc[1]
+		// the view is in the same database
+		if index := findField(command, "viewOn"); index != -1 {
+			if viewOn, ok := command[index].Value.(string); ok {
+				command[index].Value = strings.SplitN(mapper.MapNamespace(database+"."+viewOn), ".", 2)[1]
+				changed = changed || command[index].Value != viewOn
+			}
+		}
+		// the index specs may have namespace
+		for i, field := range command {
+			switch value := field.Value.(type) {
+			case string:
+				if field.Name == "ns" {
+					command[i].Value = mapper.MapNamespace(value)
+					changed = changed || command[i].Value != value
+				}
+			case []interface{}:
+				if field.Name == "indexes" {
+					for _, spec := range value {
+						if spec, ok := spec.(bson.D); ok {
+							changed = mapper.mapField(spec, "ns") || changed
+						}
+					}
+				}
+			}
+		}
+		return dc[0], changed
+	case name == "renameCollection":
+		changed := mapper.mapField(command, "renameCollection")
+		changed = mapper.mapField(command, "to") || changed
+		return database, changed
+	case name == "applyOps":
+		changed := false
+		if ops, ok := command[0].Value.([]interface{}); ok {
+			for _, op := range ops {
+				if op, ok := op.(bson.D); ok {
+					changed = mapper.mapOplog(op) || changed
+				}
+			}
+		}
+		return mapper.MapDatabase(database), changed
+	}
+	// dropDatabase and the others operated on database
+	return mapper.MapDatabase(database), false
+}
+
+// mapField renames the namespace in field of document
+func (mapper *NamespaceMapper) mapField(document bson.D, name string) bool {
+	index := findField(document, name)
+	if index == -1 {
+		return false
+	}
+	ns, ok := document[index].Value.(string)
+	if !ok {
+		return false
+	}
+	document[index].Value = mapper.MapNamespace(ns)
+	return document[index].Value != ns
+}
+
+func findField(document bson.D, name string) int {
+	for i, field := range document {
+		if field.Name == name {
+			return i
+		}
+	}
+	return -1
+}
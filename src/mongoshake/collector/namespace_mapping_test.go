@@ -0,0 +1,184 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func newRawOplog(t *testing.T, document bson.D) *oplog.GenericOplog {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		t.Fatalf("encode oplog failed. %v", err)
+	}
+	parsed := new(oplog.PartialLog)
+	if err = bson.Unmarshal(raw, parsed); err != nil {
+		t.Fatalf("decode oplog failed. %v", err)
+	}
+	return &oplog.GenericOplog{Raw: raw, Parsed: parsed}
+}
+
+func TestNewNamespaceMapper(t *testing.T) {
+	if mapper, err := NewNamespaceMapper(nil); mapper != nil || err != nil {
+		t.Errorf("no rule should create nothing. %v %v", mapper, err)
+	}
+	for _, rules := range [][]string{
+		{"a"},
+		{"a:"},
+		{"a:b:c"},
+		{"a.b:c"},
+		{"a:b.c"},
+		{"a:b", "a:c"},
+		{"a.b:c.d", "a.b:e.f"},
+	} {
+		if _, err := NewNamespaceMapper(rules); err == nil {
+			t.Errorf("rules %v should be invalid", rules)
+		}
+	}
+}
+
+func TestMapNamespace(t *testing.T) {
+	mapper, err := NewNamespaceMapper([]string{"db1:db2", "db1.special:other.renamed", "db3.c:db3.d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source, target string
+	}{
+		{"db1.c", "db2.c"},
+		{"db1.special", "other.renamed"},
+		{"db1.a.b", "db2.a.b"},
+		{"db3.c", "db3.d"},
+		{"db3.e", "db3.e"},
+		{"db4.c", "db4.c"},
+	}
+	for _, test := range tests {
+		if target := mapper.MapNamespace(test.source); target != test.target {
+			t.Errorf("map %s got %s, want %s", test.source, target, test.target)
+		}
+	}
+	if database := mapper.MapDatabase("db3"); database != "db3" {
+		t.Errorf("database with collection rules only shouldn't be renamed. got %s", database)
+	}
+}
+
+func TestNamespaceMapperMap(t *testing.T) {
+	mapper, err := NewNamespaceMapper([]string{"db1:db2", "db3.c:db3.d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		source bson.D
+		target bson.D
+	}{
+		{
+			"insert",
+			bson.D{{"op", "i"}, {"ns", "db1.c"}, {"o", bson.D{{"_id", 1}}}},
+			bson.D{{"op", "i"}, {"ns", "db2.c"}, {"o", bson.D{{"_id", 1}}}},
+		},
+		{
+			"collection rule",
+			bson.D{{"op", "u"}, {"ns", "db3.c"}, {"o", bson.D{{"a", 1}}}, {"o2", bson.D{{"_id", 1}}}},
+			bson.D{{"op", "u"}, {"ns", "db3.d"}, {"o", bson.D{{"a", 1}}}, {"o2", bson.D{{"_id", 1}}}},
+		},
+		{
+			"create view",
+			bson.D{{"op", "c"}, {"ns", "db3.$cmd"}, {"o", bson.D{{"create", "v"}, {"viewOn", "c"},
+				{"pipeline", []interface{}{}}}}},
+			bson.D{{"op", "c"}, {"ns", "db3.$cmd"}, {"o", bson.D{{"create", "v"}, {"viewOn", "d"},
+				{"pipeline", []interface{}{}}}}},
+		},
+		{
+			"create indexes",
+			bson.D{{"op", "c"}, {"ns", "db1.$cmd"}, {"o", bson.D{{"createIndexes", "c"},
+				{"key", bson.D{{"a", 1}}}, {"name", "a_1"}}}},
+			bson.D{{"op", "c"}, {"ns", "db2.$cmd"}, {"o", bson.D{{"createIndexes", "c"},
+				{"key", bson.D{{"a", 1}}}, {"name", "a_1"}}}},
+		},
+		{
+			"drop database",
+			bson.D{{"op", "c"}, {"ns", "db1.$cmd"}, {"o", bson.D{{"dropDatabase", 1}}}},
+			bson.D{{"op", "c"}, {"ns", "db2.$cmd"}, {"o", bson.D{{"dropDatabase", 1}}}},
+		},
+		{
+			"rename collection",
+			bson.D{{"op", "c"}, {"ns", "admin.$cmd"}, {"o", bson.D{{"renameCollection", "db1.a"},
+				{"to", "db3.c"}}}},
+			bson.D{{"op", "c"}, {"ns", "admin.$cmd"}, {"o", bson.D{{"renameCollection", "db2.a"},
+				{"to", "db3.d"}}}},
+		},
+		{
+			"apply ops",
+			bson.D{{"op", "c"}, {"ns", "admin.$cmd"}, {"o", bson.D{{"applyOps", []interface{}{
+				bson.D{{"op", "i"}, {"ns", "db1.c"}, {"o", bson.D{{"_id", 1}}}}}}}}},
+			bson.D{{"op", "c"}, {"ns", "admin.$cmd"}, {"o", bson.D{{"applyOps", []interface{}{
+				bson.D{{"op", "i"}, {"ns", "db2.c"}, {"o", bson.D{{"_id", 1}}}}}}}}},
+		},
+		{
+			"index spec before 4.2",
+			bson.D{{"op", "i"}, {"ns", "db3.system.indexes"}, {"o", bson.D{{"ns", "db3.c"},
+				{"key", bson.D{{"a", 1}}}}}},
+			bson.D{{"op", "i"}, {"ns", "db3.system.indexes"}, {"o", bson.D{{"ns", "db3.d"},
+				{"key", bson.D{{"a", 1}}}}}},
+		},
+	}
+
+	for _, test := range tests {
+		source := newRawOplog(t, test.source)
+		mapped, err := mapper.MapAll([]*oplog.GenericOplog{source})
+		if err != nil {
+			t.Fatalf("%s: map failed. %v", test.name, err)
+		}
+		var got bson.D
+		if err = bson.Unmarshal(mapped[0].Raw, &got); err != nil {
+			t.Fatalf("%s: decode mapped failed. %v", test.name, err)
+		}
+		// compare in the same decoded form
+		var want bson.D
+		if err = bson.Unmarshal(newRawOplog(t, test.target).Raw, &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+		if mapped[0].Parsed.Namespace != test.target[1].Value {
+			t.Errorf("%s: parsed namespace isn't updated", test.name)
+		}
+		// the source is kept for retransmission
+		if source.Parsed.Namespace != test.source[1].Value {
+			t.Errorf("%s: source is changed to %s", test.name, source.Parsed.Namespace)
+		}
+	}
+}
+
+func TestNamespaceMapperUnaffected(t *testing.T) {
+	mapper, err := NewNamespaceMapper([]string{"db1:db2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := []*oplog.GenericOplog{
+		newRawOplog(t, bson.D{{"op", "i"}, {"ns", "db4.c"}, {"o", bson.D{{"_id", 1}}}}),
+		newRawOplog(t, bson.D{{"op", "i"}, {"ns", "db1.c"}, {"o", bson.D{{"_id", 2}}}}),
+	}
+	mapped, err := mapper.MapAll(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mapped) != 2 || mapped[0] != logs[0] || mapped[1] == logs[1] {
+		t.Errorf("only the affected oplog should be renamed. %v", mapped)
+	}
+	if mapped[1].Parsed.Namespace != "db2.c" {
+		t.Errorf("renamed namespace is %s", mapped[1].Parsed.Namespace)
+	}
+
+	unchanged := logs[:1]
+	if mapped, _ = mapper.MapAll(unchanged); &mapped[0] != &unchanged[0] {
+		t.Errorf("the logs should be returned if nothing renamed")
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"sync"
 	"strings"
 
+	"mongoshake/common"
 	"mongoshake/dbpool"
 	"mongoshake/oplog"
+	"mongoshake/collector/ckpt"
 	"mongoshake/collector/configure"
 
 	LOG "github.com/vinllen/log4go"
@@ -21,6 +23,7 @@ const (
 	QueryGid   = "g"
 	QueryOpGT  = "$gt"
 	QueryOpGTE = "$gte"
+	QueryAnd   = "$and"
 
 	tailTimeout   = 7
 	oplogChanSize = 0
@@ -37,6 +40,19 @@ const (
 var TimeoutError = errors.New("read next log timeout, It shouldn't be happen")
 var CollectionCappedError = errors.New("collection capped error")
 
+// RollbackError. oplogs shipped have been rolled back in source. From is
+// the newest oplog both before and after rollback and all the oplogs in
+// (From, To] may be discarded
+type RollbackError struct {
+	From, To   bson.MongoTimestamp
+	Hash, Term int64 // of From
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("oplogs rolled back in source. from ts[%d] to ts[%d]",
+		utils.ExtractMongoTimestamp(e.From), utils.ExtractMongoTimestamp(e.To))
+}
+
 // used in internal channel
 type retOplog struct {
 	log     *bson.Raw // log content
@@ -52,8 +68,10 @@ type OplogReader struct {
 	conn           *dbpool.MongoConn
 	oplogsIterator *mgo.Iter
 
-	// query statement and current max cursor
-	query bson.M
+	// query statement and current max cursor. the timestamp is updated by
+	// batcher while fetcher reads it and sets the filter conditions
+	query     bson.M
+	queryLock sync.Mutex
 
 	// oplog channel
 	oplogChan    chan *retOplog
@@ -61,6 +79,22 @@ type OplogReader struct {
 	fetcherLock  sync.Mutex
 
 	firstRead bool
+
+	// oplog verified on reconnecting. nil if unknown
+	verify     *ckpt.Position
+	verifyLock sync.Mutex
+	// fetcher waits on it after the errors need recovery
+	rewind chan struct{}
+
+	// conditions of filters replacing those in query. they are taken by
+	// fetcher that owns the iterator
+	filter        []bson.M
+	filterChanged bool
+	filterLock    sync.Mutex
+	// the last oplog fetched. the oplogs not after skipUntil are fetched
+	// again after the iterator rebuilt by filter change and skipped
+	last      *bson.Raw
+	skipUntil bson.MongoTimestamp
 }
 
 // NewOplogReader creates reader with mongodb url
@@ -70,19 +104,120 @@ func NewOplogReader(src string) *OplogReader {
 		query: bson.M{},
 		oplogChan: make(chan *retOplog, oplogChanSize),
 		firstRead: true,
+		rewind:    make(chan struct{}),
 	}
 }
 
 // SetQueryTimestampOnEmpty set internal timestamp if
 // not exist in this reader. initial stage most of the time
 func (reader *OplogReader) SetQueryTimestampOnEmpty(ts bson.MongoTimestamp) {
-	if _, exist := reader.query[QueryTs]; !exist {
+	if _, exist := reader.queryTimestamp(); !exist {
 		reader.UpdateQueryTimestamp(ts)
 	}
 }
 
 func (reader *OplogReader) UpdateQueryTimestamp(ts bson.MongoTimestamp) {
+	reader.queryLock.Lock()
 	reader.query[QueryTs] = bson.M{QueryOpGTE: ts}
+	reader.queryLock.Unlock()
+}
+
+// queryTimestamp returns the timestamp fetching from
+func (reader *OplogReader) queryTimestamp() (bson.MongoTimestamp, bool) {
+	reader.queryLock.Lock()
+	defer reader.queryLock.Unlock()
+	if condition, exist := reader.query[QueryTs]; exist {
+		return condition.(bson.M)[QueryOpGTE].(bson.MongoTimestamp), true
+	}
+	return 0, false
+}
+
+// copyQuery returns a copy of query so that it's used without lock
+func (reader *OplogReader) copyQuery() bson.M {
+	reader.queryLock.Lock()
+	defer reader.queryLock.Unlock()
+	query := make(bson.M, len(reader.query))
+	for key, value := range reader.query {
+		query[key] = value
+	}
+	return query
+}
+
+func (reader *OplogReader) SetStartPositionOnEmpty(checkpoint *ckpt.CheckpointContext) {
+	if _, exist := reader.queryTimestamp(); !exist {
+		reader.UpdateQueryTimestamp(checkpoint.Timestamp)
+		reader.SetVerifyPosition(checkpoint.Timestamp, checkpoint.Hash, checkpoint.Term)
+	}
+}
+
+// SetVerifyPosition records the oplog should exist in source. it's ignored
+// if both hash and term are unknown
+func (reader *OplogReader) SetVerifyPosition(ts bson.MongoTimestamp, hash, term int64) {
+	var verify *ckpt.Position
+	if hash != 0 || term != 0 {
+		verify = &ckpt.Position{Timestamp: ts, Hash: hash, Term: term}
+	}
+	reader.verifyLock.Lock()
+	reader.verify = verify
+	reader.verifyLock.Unlock()
+}
+
+// Rewind restarts fetching from ts after recovery
+func (reader *OplogReader) Rewind(ts bson.MongoTimestamp, hash, term int64) {
+	reader.UpdateQueryTimestamp(ts)
+	reader.SetVerifyPosition(ts, hash, term)
+	reader.rewind <- struct{}{}
+}
+
+// SetQueryFilter adds the conditions of filters into the query. so the
+// oplogs filtered aren't transferred from source. the iterator is rebuilt
+// after the oplogs fetched if it's changed while fetching
+func (reader *OplogReader) SetQueryFilter(conditions []bson.M) {
+	reader.filterLock.Lock()
+	reader.filter, reader.filterChanged = conditions, true
+	reader.filterLock.Unlock()
+}
+
+// applyQueryFilter takes the conditions set by SetQueryFilter into query.
+// it's invoked by fetcher only
+func (reader *OplogReader) applyQueryFilter() {
+	reader.filterLock.Lock()
+	changed, conditions := reader.filterChanged, reader.filter
+	reader.filterChanged = false
+	reader.filterLock.Unlock()
+	if !changed {
+		return
+	}
+
+	reader.queryLock.Lock()
+	if len(conditions) == 0 {
+		delete(reader.query, QueryAnd)
+	} else {
+		reader.query[QueryAnd] = conditions
+	}
+	reader.queryLock.Unlock()
+	if reader.oplogsIterator == nil || reader.last == nil {
+		return
+	}
+
+	// continue from the last oplog fetched rather than the one dispatched
+	var last struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+	if err := reader.last.Unmarshal(&last); err != nil {
+		LOG.Warn("Oplog reader decode the last oplog fetched failed. %v", err)
+		return
+	}
+	reader.releaseIterator()
+	reader.UpdateQueryTimestamp(last.Timestamp)
+	reader.skipUntil = last.Timestamp
+	LOG.Info("Oplog reader rebuild iterator from ts[%d] with query filter changed",
+		utils.ExtractMongoTimestamp(last.Timestamp))
+}
+
+// ResumeToken returns nil. oplogs are located by timestamp
+func (reader *OplogReader) ResumeToken(ts bson.MongoTimestamp) []byte {
+	return nil
 }
 
 // Next returns an oplog by raw bytes which is []byte
@@ -131,8 +266,15 @@ func (reader *OplogReader) StartFetcher() {
 func (reader *OplogReader) fetcher() {
 	var log *bson.Raw
 	for {
+		reader.applyQueryFilter()
 		if err := reader.ensureNetwork(); err != nil {
 			reader.oplogChan <- &retOplog{nil, err}
+			if waitRewind(err) {
+				// the oplogs read after shouldn't be shipped until the
+				// target is recovered
+				<-reader.rewind
+				reader.last, reader.skipUntil = nil, 0
+			}
 			continue
 		}
 
@@ -144,6 +286,10 @@ func (reader *OplogReader) fetcher() {
 				if reader.isCollectionCappedError(err) { // print it
 					LOG.Error("oplog collection capped may happen: %v", err)
 					reader.oplogChan <- &retOplog{nil, CollectionCappedError}
+					if waitRewind(CollectionCappedError) {
+						<-reader.rewind
+						reader.last, reader.skipUntil = nil, 0
+					}
 				} else {
 					reader.oplogChan <- &retOplog{nil, fmt.Errorf("get next oplog failed. release oplogsIterator, %s", err.Error())}
 				}
@@ -153,6 +299,17 @@ func (reader *OplogReader) fetcher() {
 			}
 			continue
 		}
+		if reader.skipUntil != 0 {
+			var entry struct {
+				Timestamp bson.MongoTimestamp `bson:"ts"`
+			}
+			if err := log.Unmarshal(&entry); err == nil && entry.Timestamp <= reader.skipUntil {
+				// fetched before the iterator rebuilt
+				continue
+			}
+			reader.skipUntil = 0
+		}
+		reader.last = log
 		reader.oplogChan <- &retOplog{log, nil}
 	}
 }
@@ -174,12 +331,17 @@ func (reader *OplogReader) ensureNetwork() (err error) {
 		}
 	}
 
-	var queryTs bson.MongoTimestamp
+	// the oplog shipped should still exist
+	if err = reader.verifyPosition(); err != nil {
+		return err
+	}
+
+	query := reader.copyQuery()
+	queryTs := query[QueryTs].(bson.M)[QueryOpGTE].(bson.MongoTimestamp)
 	// the given oplog timestamp shouldn't bigger than the newest
 	if reader.firstRead == true {
 		// check whether the starting fetching timestamp is less than the oldest timestamp exist in the oplog
 		newestTs := reader.getNewestTimestamp()
-		queryTs = reader.query[QueryTs].(bson.M)[QueryOpGTE].(bson.MongoTimestamp)
 		if newestTs < queryTs {
 			return fmt.Errorf("current starting point[%v] is bigger than the newest timestamp[%v]", queryTs, newestTs)
 		}
@@ -190,7 +352,6 @@ func (reader *OplogReader) ensureNetwork() (err error) {
 	 * this may happen when collection capped.
 	 */
 	oldestTs := reader.getOldestTimestamp()
-	queryTs = reader.query[QueryTs].(bson.M)[QueryOpGTE].(bson.MongoTimestamp)
 	if oldestTs > queryTs && !reader.firstRead {
 		return CollectionCappedError
 	}
@@ -200,10 +361,61 @@ func (reader *OplogReader) ensureNetwork() (err error) {
 	reader.conn.Session.SetBatch(8192) //
 	reader.conn.Session.SetPrefetch(0.2)
 	reader.oplogsIterator = reader.conn.Session.DB(localDB).C(dbpool.OplogNS).
-		Find(reader.query).LogReplay().Tail(time.Second * tailTimeout) // this timeout is useless
+		Find(query).LogReplay().Tail(time.Second * tailTimeout) // this timeout is useless
 	return
 }
 
+// verifyPosition checks the oplog verified hasn't been rolled back. the ts
+// and term of an entry identify it exactly since protocol version 1 and
+// the hash is compared for older versions
+func (reader *OplogReader) verifyPosition() error {
+	reader.verifyLock.Lock()
+	verify := reader.verify
+	reader.verifyLock.Unlock()
+	if verify == nil {
+		return nil
+	}
+
+	oplogs := reader.conn.Session.DB(localDB).C(dbpool.OplogNS)
+	entry := new(oplog.PartialLog)
+	err := oplogs.Find(bson.M{QueryTs: verify.Timestamp}).One(entry)
+	switch {
+	case err == nil && entry.Hash == verify.Hash && entry.Term == verify.Term:
+		return nil
+	case err == mgo.ErrNotFound && reader.getOldestTimestamp() > verify.Timestamp:
+		// oplog capped. it's checked later
+		return nil
+	case err != nil && err != mgo.ErrNotFound:
+		return fmt.Errorf("find oplog ts[%d] failed. %v", utils.ExtractMongoTimestamp(verify.Timestamp), err)
+	}
+
+	queryTs, _ := reader.queryTimestamp()
+	rollback := &RollbackError{To: queryTs}
+	if rollback.To < verify.Timestamp {
+		rollback.To = verify.Timestamp
+	}
+	if verify.Term != 0 {
+		// entries of newer terms are written after rollback. so the newest
+		// one of the same or older terms before verified is the common point
+		common := new(oplog.PartialLog)
+		if err = oplogs.Find(bson.M{QueryTs: bson.M{"$lt": verify.Timestamp}, "t": bson.M{"$lte": verify.Term}}).
+			Sort("-$natural").Limit(1).One(common); err != nil {
+			if err == mgo.ErrNotFound {
+				return CollectionCappedError
+			}
+			return fmt.Errorf("find common point of rollback failed. %v", err)
+		}
+		rollback.From, rollback.Hash, rollback.Term = common.Timestamp, common.Hash, common.Term
+	} else {
+		// the common point can't be located without term. all the oplogs
+		// left may be affected
+		rollback.From = reader.getOldestTimestamp()
+	}
+	LOG.Critical("Oplog ts[%d] hash[%d] term[%d] shipped doesn't exist in source. %v", utils.ExtractMongoTimestamp(verify.Timestamp),
+		verify.Hash, verify.Term, rollback)
+	return rollback
+}
+
 // get newest oplog
 func (reader *OplogReader) getNewestTimestamp() bson.MongoTimestamp {
 	var retMap map[string]interface{}
@@ -239,7 +451,9 @@ type GidOplogReader struct {
 }
 
 func (reader *GidOplogReader) SetQueryGid(gid string) {
+	reader.queryLock.Lock()
 	reader.query[QueryGid] = gid
+	reader.queryLock.Unlock()
 }
 
 func NewGidOplogReader(src string) *GidOplogReader {
@@ -0,0 +1,80 @@
+package collector
+
+import (
+	"mongoshake/collector/ckpt"
+	"mongoshake/collector/configure"
+	"mongoshake/dbpool"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	ReaderMethodOplog        = "oplog"
+	ReaderMethodChangeStream = "change_stream"
+)
+
+// Reader fetches oplogs from source MongoDB. Entries are returned in raw
+// oplog format whatever the source is. OplogReader tails local.oplog.rs
+// directly and ChangeStreamReader converts events of $changeStream
+type Reader interface {
+	// set start position with checkpoint if reader hasn't started
+	SetStartPositionOnEmpty(checkpoint *ckpt.CheckpointContext)
+	// update the latest timestamp dispatched
+	UpdateQueryTimestamp(ts bson.MongoTimestamp)
+	// start fetcher if not exist
+	StartFetcher()
+	// next oplog in raw bytes
+	Next() (*bson.Raw, error)
+	// ResumeToken returns the token that reading resumes from ts. nil if
+	// reader only locates by timestamp
+	ResumeToken(ts bson.MongoTimestamp) []byte
+	// Rewind restarts reading from the oplog given. reading stops after
+	// the errors that need recovery until rewound. see waitRewind
+	Rewind(ts bson.MongoTimestamp, hash, term int64)
+}
+
+// RollbackDetector is implemented by the readers that detect rollback of
+// source. the position verified is the last oplog dispatched or the one
+// checkpoint located. it should still exist in source on reconnecting.
+// otherwise RollbackError is returned and reading stops until rewound
+type RollbackDetector interface {
+	// SetVerifyPosition records the oplog dispatched. it's verified on
+	// reconnecting
+	SetVerifyPosition(ts bson.MongoTimestamp, hash, term int64)
+}
+
+// FilterPushdown is implemented by the readers that filter oplogs in
+// source query
+type FilterPushdown interface {
+	// SetQueryFilter sets the conditions should be matched by all the oplogs
+	// fetched. it replaces the conditions set before and takes effect on the
+	// oplogs not fetched yet
+	SetQueryFilter(conditions []bson.M)
+}
+
+// waitRewind tells whether the fetcher should stop after err until the
+// syncer rewinds it. the oplogs can't be read any more without recovery
+func waitRewind(err error) bool {
+	if _, ok := err.(*RollbackError); ok {
+		return true
+	}
+	return err == CollectionCappedError && conf.Options.CappedPolicy == CappedPolicyResync
+}
+
+// newestTimestamp returns the timestamp that the changes after it haven't
+// happened in source. local.oplog.rs isn't read in change stream mode
+func newestTimestamp(conn *dbpool.MongoConn) (bson.MongoTimestamp, error) {
+	if conf.Options.SyncerReaderMethod == ReaderMethodChangeStream {
+		return conn.GetOperationTime()
+	}
+	return conn.GetNewestOplogTimestamp()
+}
+
+func NewReader(src string) Reader {
+	switch conf.Options.SyncerReaderMethod {
+	case ReaderMethodChangeStream:
+		return NewChangeStreamReader(src, conf.Options.SyncerReaderWatchDatabase)
+	default:
+		return NewOplogReader(src)
+	}
+}
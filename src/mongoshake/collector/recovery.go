@@ -0,0 +1,180 @@
+package collector
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"mongoshake/collector/ckpt"
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+
+	"github.com/gugemichael/nimo4go"
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	RollbackPolicyStop   = "stop"
+	RollbackPolicyResync = "resync"
+
+	CappedPolicyStop   = "stop"
+	CappedPolicyResync = "resync"
+)
+
+const (
+	RecoveryReasonRollback = "rollback"
+	RecoveryReasonCapped   = "capped"
+
+	RecoveryDraining = "draining"
+	RecoveryCopying  = "copying"
+	RecoveryStopped  = "stopped"
+	RecoveryDone     = "done"
+)
+
+// Recovery is the progress of recovering the target after oplogs are lost.
+// it's replaced entirely on every change so that readers needn't lock
+type Recovery struct {
+	Reason string
+	State  string
+	// namespaces re-synced. empty means all the namespaces
+	Namespaces []string
+	// oplog tailing restarts from here
+	StartTs  bson.MongoTimestamp
+	Begin    time.Time
+	Finished time.Time
+}
+
+func (sync *OplogSyncer) setRecoveryState(state string) {
+	recovery := *sync.recovery
+	recovery.State = state
+	if state == RecoveryDone {
+		recovery.Finished = time.Now()
+	}
+	sync.recovery = &recovery
+}
+
+// handleRollback is invoked while the reader found the oplogs shipped have
+// been rolled back in source. the target has the writes that no longer
+// exist. policy stop crashes the collector and users should fix it manually.
+// policy resync drops the affected namespaces on target, copies them again
+// and tails from the common point. the oplogs replayed from there converge
+// on the documents copied
+func (sync *OplogSyncer) handleRollback(rollback *RollbackError) {
+	sync.recovery = &Recovery{Reason: RecoveryReasonRollback, State: RecoveryDraining, Begin: time.Now()}
+	// all the oplogs fetched before should reach the target firstly
+	sync.drain()
+
+	namespaces := sync.shippedAfter(rollback.From)
+	sync.rollback, sync.rollbackNamespaces = rollback, namespaces
+	sync.replMetric.ReplStatus.Update(utils.FetchBad)
+	LOG.Critical("Oplog syncer found rollback in source. replset[%s] policy[%s] namespaces affected %v. %v",
+		sync.replset, conf.Options.RollbackPolicy, namespaces, rollback)
+
+	if conf.Options.RollbackPolicy != RollbackPolicyResync {
+		sync.setRecoveryState(RecoveryStopped)
+		nimo.AssertTrue(false, "Oplog syncer stop tailing by rollback in source, users should fix it manually")
+		return
+	}
+
+	if len(namespaces) != 0 {
+		sync.resync(namespaces, namespaces, rollback.From)
+	}
+	sync.restart(&ckpt.Position{Timestamp: rollback.From, Hash: rollback.Hash, Term: rollback.Term})
+}
+
+// handleCapped is invoked while the oplogs needed have been overwritten in
+// source. any namespace may be changed during the lost oplogs. so all of
+// them are dropped on target and copied again. oplog tailing restarts from
+// the newest oplog recorded before copying
+func (sync *OplogSyncer) handleCapped() {
+	sync.recovery = &Recovery{Reason: RecoveryReasonCapped, State: RecoveryDraining, Begin: time.Now()}
+	sync.drain()
+
+	// the collections shipped may be dropped in source already. the others
+	// are dropped while being copied
+	var drops []string
+	for _, ns := range sync.shippedAfter(0) {
+		if strings.Contains(ns, ".") {
+			drops = append(drops, ns)
+		}
+	}
+	sync.replMetric.ReplStatus.Update(utils.FetchBad)
+	LOG.Critical("Oplog syncer lost oplogs by collection capped. replset[%s] resync all the namespaces", sync.replset)
+
+	startTs := sync.resync(nil, drops, 0)
+	sync.restart(&ckpt.Position{Timestamp: startTs})
+}
+
+// resync drops the namespaces on target and copies them again until
+// succeed. returns the timestamp that oplog tailing should start from
+func (sync *OplogSyncer) resync(namespaces, drops []string, startTs bson.MongoTimestamp) bson.MongoTimestamp {
+	recovery := *sync.recovery
+	recovery.State, recovery.Namespaces = RecoveryCopying, namespaces
+	sync.recovery = &recovery
+	// resumed by restart(). all the oplogs fetched are drained already and
+	// the batcher offers nothing
+	sync.suspendCheckpoint(true)
+	atomic.StoreInt32(&sync.batcher.paused, 1)
+
+	resyncer := NewResyncer(sync, sync.src, namespaces, drops, startTs)
+	for {
+		if ts, err := resyncer.Run(); err == nil {
+			return ts
+		} else {
+			LOG.Error("Oplog syncer resync namespaces failed. %v", err)
+		}
+		utils.YieldInMs(DurationTime)
+	}
+}
+
+// restart persists the checkpoint at position and restarts reading from it
+func (sync *OplogSyncer) restart(position *ckpt.Position) {
+	sync.suspendCheckpoint(true)
+	// the batcher resets the positions and acks dispatched before
+	sync.batcher.restarts <- position
+	tsInt64 := utils.TimestampToInt64(position.Timestamp)
+	for err := sync.ckptManager.UpdatePosition(position); err != nil; err = sync.ckptManager.UpdatePosition(position) {
+		LOG.Warn("Oplog syncer record checkpoint of recovery failed. %v", err)
+		utils.YieldInMs(DurationTime)
+	}
+	sync.suspendCheckpoint(false)
+	sync.replMetric.SetLSNCheckpoint(tsInt64)
+
+	recovery := *sync.recovery
+	recovery.StartTs = position.Timestamp
+	sync.recovery = &recovery
+	sync.setRecoveryState(RecoveryDone)
+	LOG.Info("Oplog syncer recovery from %s finished. tail from ts[%d]", sync.recovery.Reason,
+		utils.ExtractMongoTimestamp(position.Timestamp))
+	sync.replMetric.ReplStatus.Clear(utils.FetchBad)
+	sync.reader.Rewind(position.Timestamp, position.Hash, position.Term)
+}
+
+// drain waits until all the oplogs fetched are dispatched and acked
+func (sync *OplogSyncer) drain() {
+	sync.transfer(nil)
+	for atomic.LoadUint64(&sync.batcher.dispatched) < sync.nextQueuePosition {
+		utils.DelayFor(100)
+	}
+	for _, worker := range sync.batcher.workerGroup {
+		worker.waitAllAcked()
+	}
+}
+
+// shippedAfter returns the namespaces shipped after ts. the commands are
+// recorded on database
+func (sync *OplogSyncer) shippedAfter(ts bson.MongoTimestamp) []string {
+	sync.shippedLock.Lock()
+	defer sync.shippedLock.Unlock()
+
+	var namespaces []string
+	for ns, shipped := range sync.shipped {
+		if shipped > ts {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
@@ -0,0 +1,72 @@
+package collector
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mongoshake/collector/ckpt"
+	"mongoshake/common"
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func newTestBatcher() *Batcher {
+	worker, _ := newTestWorker(true)
+	syncer := &OplogSyncer{
+		logsQueue: []chan []*oplog.GenericOplog{make(chan []*oplog.GenericOplog, 1)},
+		positions: map[bson.MongoTimestamp]*ckpt.Position{bson.MongoTimestamp(9 << 32): {}},
+	}
+	return &Batcher{
+		syncer:      syncer,
+		workerGroup: []*Worker{worker},
+		lastSeen:    &oplog.PartialLog{Timestamp: bson.MongoTimestamp(9 << 32)},
+		restarts:    make(chan *ckpt.Position),
+	}
+}
+
+func checkRestarted(t *testing.T, name string, batcher *Batcher, position *ckpt.Position) {
+	if len(batcher.syncer.positions) != 0 || batcher.lastSeen != nil || atomic.LoadInt32(&batcher.paused) != 0 {
+		t.Errorf("%s: batcher isn't reset. positions %d, last seen %v, paused %d", name,
+			len(batcher.syncer.positions), batcher.lastSeen, batcher.paused)
+	}
+	ts := utils.TimestampToInt64(position.Timestamp)
+	if worker := batcher.workerGroup[0]; atomic.LoadInt64(&worker.ack) != ts || atomic.LoadInt64(&worker.unack) != ts {
+		t.Errorf("%s: worker ack %d unack %d, should be %d", name, worker.ack, worker.unack, ts)
+	}
+}
+
+func TestBatcherRestart(t *testing.T) {
+	position := &ckpt.Position{Timestamp: bson.MongoTimestamp(5 << 32)}
+
+	// blocked on logs queue
+	batcher := newTestBatcher()
+	atomic.StoreInt32(&batcher.paused, 1)
+	go func() { batcher.restarts <- position }()
+	if group := batcher.batchMore(); len(group) != 1 || group[0] != nil || batcher.merged != 0 {
+		t.Errorf("restart dispatches %v, merged %d", group, batcher.merged)
+	}
+	checkRestarted(t, "blocked", batcher, position)
+
+	// the oplogs received while paused are held until restart
+	batcher = newTestBatcher()
+	atomic.StoreInt32(&batcher.paused, 1)
+	batcher.syncer.logsQueue[0] <- []*oplog.GenericOplog{}
+	done := make(chan struct{})
+	go func() {
+		batcher.batchMore()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("oplogs are batched while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	batcher.restarts <- position
+	<-done
+	if batcher.merged != 1 {
+		t.Errorf("merged %d after restart", batcher.merged)
+	}
+	checkRestarted(t, "paused", batcher, position)
+}
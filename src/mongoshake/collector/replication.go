@@ -7,7 +7,6 @@ import (
 	"mongoshake/collector/configure"
 	"mongoshake/common"
 	"mongoshake/dbpool"
-	"mongoshake/oplog"
 
 	LOG "github.com/vinllen/log4go"
 	"github.com/gugemichael/nimo4go"
@@ -55,15 +54,15 @@ func (coordinator *ReplicationCoordinator) Run() error {
 func (coordinator *ReplicationCoordinator) sanitizeMongoDB() error {
 	var conn *dbpool.MongoConn
 	var err error
-	var hasUniqIndex = false
 	rs := map[string]int{}
 	for i, src := range coordinator.Sources {
 		if conn, err = dbpool.NewMongoConn(src.URL, false); conn == nil || !conn.IsGood() || err != nil {
 			LOG.Critical("Connect mongo server error. %v, url : %s", err, src.URL)
 			return err
 		}
-		// a conventional ReplicaSet should have local.oplog.rs collection
-		if !conn.HasOplogNs() {
+		// a conventional ReplicaSet should have local.oplog.rs collection.
+		// change stream needs no privilege on it
+		if conf.Options.SyncerReaderMethod != ReaderMethodChangeStream && !conn.HasOplogNs() {
 			LOG.Critical("There has no oplog collection in mongo db server")
 			conn.Close()
 			return errors.New("no oplog ns in mongo")
@@ -85,25 +84,10 @@ func (coordinator *ReplicationCoordinator) sanitizeMongoDB() error {
 		}
 		rs[rsName] = 1
 		src.ReplicaName = rsName
-
-		// look around if there has uniq index
-		if !hasUniqIndex {
-			hasUniqIndex = conn.HasUniqueIndex()
-		}
 		// doesn't reuse current connection
 		conn.Close()
 	}
 
-	// we choose sharding by collection if there are unique index
-	// existing in collections
-	if conf.Options.ShardKey == oplog.ShardAutomatic {
-		if hasUniqIndex {
-			conf.Options.ShardKey = oplog.ShardByNamespace
-		} else {
-			conf.Options.ShardKey = oplog.ShardByID
-		}
-	}
-
 	return nil
 }
 
@@ -119,6 +103,7 @@ func (coordinator *ReplicationCoordinator) startReplication() error {
 		syncer.init()
 		coordinator.syncerGroup = append(coordinator.syncerGroup, syncer)
 	}
+	coordinator.filterRestAPI()
 
 	// prepare worker routine and bind it to syncer
 	for i := 0; i != conf.Options.WorkerNum; i++ {
@@ -2,6 +2,9 @@ package collector
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"mongoshake/collector/ckpt"
@@ -40,6 +43,8 @@ type OplogSyncer struct {
 	coordinator *ReplicationCoordinator
 	// source mongodb replica set name
 	replset string
+	// oplogs of other gid are filtered
+	gid string
 
 	ckptManager *ckpt.CheckpointManager
 
@@ -53,17 +58,37 @@ type OplogSyncer struct {
 	pendingQueue      []chan []*bson.Raw
 	logsQueue         []chan []*oplog.GenericOplog
 	nextQueuePosition uint64
+	// expand transactions in deserializer
+	assembler *TxnAssembler
 
+	// source mongo address url
+	src string
 	// source mongo oplog reader
-	reader *OplogReader
+	reader Reader
 	// journal log that records all oplogs
 	journal *utils.Journal
 	// oplogs dispatcher
 	batcher *Batcher
+	// hash and term of the last oplog in every dispatched batch. keyed by
+	// timestamp and released after checkpoint passed
+	positions map[bson.MongoTimestamp]*ckpt.Position
+	// the biggest timestamp shipped of every namespace. used to find the
+	// namespaces affected by rollback
+	shipped     map[string]bson.MongoTimestamp
+	shippedLock sync.Mutex
+	// the last rollback detected and the namespaces affected. nil if never
+	// happened
+	rollback           *RollbackError
+	rollbackNamespaces []string
+	// the last recovery. nil if never happened
+	recovery *Recovery
 
 	// timers for inner event
 	startTime time.Time
 	ckptTime  time.Time
+	// checkpoint isn't updated while documents are copied. the documents
+	// are acked by the start position before all of them reach the target
+	ckptSuspended int32
 
 	replMetric *utils.ReplicationMetric
 }
@@ -84,9 +109,14 @@ func NewOplogSyncer(
 	syncer := &OplogSyncer{
 		coordinator: coordinator,
 		replset:     replset,
+		gid:         gid,
 		journal: utils.NewJournal(utils.JournalFileName(
 			fmt.Sprintf("%s.%s", conf.Options.CollectorId, replset))),
-		reader: NewOplogReader(mongoUrl),
+		src:       mongoUrl,
+		reader:    NewReader(mongoUrl),
+		assembler: NewTxnAssembler(mongoUrl),
+		positions: make(map[bson.MongoTimestamp]*ckpt.Position),
+		shipped:   make(map[string]bson.MongoTimestamp),
 	}
 
 	// concurrent level hasher
@@ -95,25 +125,42 @@ func NewOplogSyncer(
 		syncer.hasher = &oplog.TableHasher{}
 	case oplog.ShardByID:
 		syncer.hasher = &oplog.PrimaryKeyHasher{}
+	case oplog.ShardAutomatic:
+		hasher, err := NewAutoHasher(mongoUrl)
+		if err != nil {
+			LOG.Critical("Oplog syncer list unique indexes failed, distribute all by namespace. %v", err)
+			syncer.hasher = &oplog.TableHasher{}
+		} else {
+			syncer.hasher = hasher
+		}
+	case oplog.ShardByField:
+		// it's validated already
+		hasher, err := oplog.NewFieldHasher(conf.Options.ShardKeyFields)
+		if err != nil {
+			LOG.Critical("Oplog syncer create field hasher failed. %v", err)
+		}
+		syncer.hasher = hasher
 	}
 
-	filterList := OplogFilterChain{new(AutologousFilter), new(NoopFilter)}
-	if gid != "" {
-		filterList = append(filterList, &GidFilter{Gid: gid})
-	}
-	if len(conf.Options.FilterNamespaceWhite) != 0 || len(conf.Options.FilterNamespaceBlack) != 0 {
-		namespaceFilter := NewNamespaceFilter(conf.Options.FilterNamespaceWhite,
-			conf.Options.FilterNamespaceBlack)
-		filterList = append(filterList, namespaceFilter)
+	// it's validated already
+	transformers, err := NewTransformerChain()
+	if err != nil {
+		LOG.Critical("Oplog syncer create transformers failed. %v", err)
 	}
 
-	// oplog filters. drop the oplog if any of the filter
-	// list returns true. The order of all filters is not significant
 	syncer.batcher = &Batcher{
-		syncer:      syncer,
-		filterList:  filterList,
-		handler:     syncer,
-		workerGroup: []*Worker{}, // assign later by syncer.bind()
+		syncer:       syncer,
+		transformers: transformers,
+		handler:      syncer,
+		workerGroup:  []*Worker{}, // assign later by syncer.bind()
+		txnHashed:    make(map[uint32]uint32),
+		restarts:     make(chan *ckpt.Position),
+	}
+	// oplog filters. drop the oplog if any of the filter list returns true.
+	// they are replaced by the rules in checkpoint after loaded. the rules
+	// are validated already
+	if err := syncer.setFilterRules(configFilterRules()); err != nil {
+		LOG.Critical("Oplog syncer create filters failed. %v", err)
 	}
 	return syncer
 }
@@ -134,8 +181,9 @@ func (sync *OplogSyncer) bind(w *Worker) {
 
 // start to polling oplog
 func (sync *OplogSyncer) start() {
-	LOG.Info("Poll oplog syncer start. ckpt_interval[%dms], gid[%s], shard_key[%s]",
-		conf.Options.CheckpointInterval, conf.Options.OplogGIDS, conf.Options.ShardKey)
+	LOG.Info("Poll oplog syncer start. ckpt_interval[%dms], gid[%s], shard_key[%s], sync_mode[%s], reader[%s]",
+		conf.Options.CheckpointInterval, conf.Options.OplogGIDS, conf.Options.ShardKey, conf.Options.SyncMode,
+		conf.Options.SyncerReaderMethod)
 
 	sync.startTime = time.Now()
 
@@ -150,6 +198,12 @@ func (sync *OplogSyncer) start() {
 	sync.startDeserializer()
 	sync.startBatcher()
 
+	// copy documents firstly if sync mode isn't oplog only
+	if !sync.syncDocument() {
+		LOG.Info("Oplog syncer exit without tailing. sync_mode[%s]", conf.Options.SyncMode)
+		return
+	}
+
 	// for ever fetching next oplog entry
 	for {
 		sync.poll()
@@ -168,11 +222,17 @@ func (sync *OplogSyncer) startBatcher() {
 		// As much as we can batch more from logs queue. batcher can merge
 		// a sort of oplogs from different logs queue one by one. the max number
 		// of oplogs in batch is limited by AdaptiveBatchingMaxSize
-		if worked := batcher.dispatchBatches(batcher.batchMore()); worked {
-			sync.replMetric.SetLSN(utils.TimestampToInt64(batcher.getLastOplog().Timestamp))
+		batcher.dispatchBatches(batcher.batchMore())
+		// the filtered oplogs move the position also
+		if seen := batcher.getLastSeen(); seen != nil {
+			sync.replMetric.SetLSN(utils.TimestampToInt64(seen.Timestamp))
 			// update latest fetched timestamp in memory
-			sync.reader.UpdateQueryTimestamp(batcher.getLastOplog().Timestamp)
+			sync.reader.UpdateQueryTimestamp(seen.Timestamp)
+			if detector, ok := sync.reader.(RollbackDetector); ok {
+				detector.SetVerifyPosition(seen.Timestamp, seen.Hash, seen.Term)
+			}
 		}
+		atomic.AddUint64(&batcher.dispatched, batcher.merged)
 
 		// flush checkpoint value
 		sync.checkpoint()
@@ -201,7 +261,9 @@ func (sync *OplogSyncer) startDeserializer() {
 }
 
 func (sync *OplogSyncer) deserializer(index int) {
-	for {
+	// pending queues are pushed in turn. so the sequence of batch is known
+	parallel := uint64(len(sync.pendingQueue))
+	for round := uint64(0); ; round++ {
 		batchRawLogs := <-sync.pendingQueue[index]
 		nimo.AssertTrue(len(batchRawLogs) != 0, "pending queue batch logs has zero length")
 		var deserializeLogs = make([]*oplog.GenericOplog, 0, len(batchRawLogs))
@@ -211,7 +273,10 @@ func (sync *OplogSyncer) deserializer(index int) {
 			bson.Unmarshal(rawLog.Data, log)
 			deserializeLogs = append(deserializeLogs, &oplog.GenericOplog{Raw: rawLog.Data, Parsed: log})
 		}
-		sync.logsQueue[index] <- deserializeLogs
+		// transactions may be split into several batches. expand them in
+		// fetching order. the result may be empty and we still push it to
+		// keep the order of logs queues
+		sync.logsQueue[index] <- sync.assembler.Assemble(round*parallel+uint64(index), deserializeLogs)
 	}
 }
 
@@ -227,7 +292,8 @@ func (sync *OplogSyncer) poll() {
 		LOG.Critical("Acquire the existing checkpoint from remote[%s] failed !", conf.Options.ContextAddress)
 		return
 	}
-	sync.reader.SetQueryTimestampOnEmpty(checkpoint.Timestamp)
+	sync.loadFilterRules(checkpoint)
+	sync.reader.SetStartPositionOnEmpty(checkpoint)
 	sync.reader.StartFetcher() // start reader fetcher if not exist
 
 	// every syncer should under the control of global rate limiter
@@ -270,8 +336,15 @@ func (sync *OplogSyncer) next() bool {
 		sync.replMetric.SetOplogAvg(payload)
 		sync.replMetric.ReplStatus.Clear(utils.FetchBad)
 	} else if err == CollectionCappedError {
+		if conf.Options.CappedPolicy == CappedPolicyResync {
+			sync.handleCapped()
+			return false
+		}
 		LOG.Error("oplog collection capped error, users should fix it manually")
 		return false
+	} else if rollback, ok := err.(*RollbackError); ok {
+		sync.handleRollback(rollback)
+		return false
 	} else if err != nil && err != TimeoutError {
 		LOG.Error("oplog syncer internal error: %v", err)
 		// error is nil indicate that only timeout incur syncer.next()
@@ -311,6 +384,15 @@ func (sync *OplogSyncer) transfer(log *bson.Raw) bool {
 func (sync *OplogSyncer) Handle(log *oplog.PartialLog) {
 	// 1. records audit log if need
 	sync.journal.WriteRecord(log)
+
+	// 2. records the namespace shipped. commands are recorded on database
+	ns := log.Namespace
+	if strings.HasSuffix(ns, ".$cmd") {
+		ns = strings.TrimSuffix(ns, ".$cmd")
+	}
+	sync.shippedLock.Lock()
+	sync.shipped[ns] = log.Timestamp
+	sync.shippedLock.Unlock()
 }
 
 func (sync *OplogSyncer) RestAPI() {
@@ -323,6 +405,28 @@ func (sync *OplogSyncer) RestAPI() {
 		TimestampMongo string `json:"ts"`
 	}
 
+	type Rollback struct {
+		From       *MongoTime `json:"from"`
+		To         *MongoTime `json:"to"`
+		Namespaces []string   `json:"namespaces"`
+		Policy     string     `json:"policy"`
+	}
+	type Recovery struct {
+		Reason     string     `json:"reason"`
+		State      string     `json:"state"`
+		Namespaces []string   `json:"namespaces"`
+		Ranges     int        `json:"ranges"`
+		RangesDone int        `json:"ranges_done"`
+		StartTs    *MongoTime `json:"start_ts"`
+		Begin      *Time      `json:"begin"`
+		Finished   *Time      `json:"finished,omitempty"`
+	}
+	mongoTime := func(ts int64) *MongoTime {
+		return &MongoTime{TimestampMongo: utils.Int64ToString(ts),
+			Time: Time{TimestampUnix: utils.ExtractMongoTimestamp(ts),
+				TimestampTime: utils.TimestampToString(utils.ExtractMongoTimestamp(ts))}}
+	}
+
 	type Info struct {
 		Who         string     `json:"who"`
 		Tag         string     `json:"tag"`
@@ -334,9 +438,37 @@ func (sync *OplogSyncer) RestAPI() {
 		LsnAck      *MongoTime `json:"lsn_ack"`
 		LsnCkpt     *MongoTime `json:"lsn_ckpt"`
 		Now         *Time      `json:"now"`
+		Rollback    *Rollback  `json:"rollback,omitempty"`
+		Recovery    *Recovery  `json:"recovery,omitempty"`
 	}
 
 	utils.HttpApi.RegisterAPI("/repl", nimo.HttpGet, func([]byte) interface{} {
+		var rollback *Rollback
+		if detected := sync.rollback; detected != nil {
+			rollback = &Rollback{
+				From:       mongoTime(utils.TimestampToInt64(detected.From)),
+				To:         mongoTime(utils.TimestampToInt64(detected.To)),
+				Namespaces: sync.rollbackNamespaces,
+				Policy:     conf.Options.RollbackPolicy,
+			}
+		}
+		var recovery *Recovery
+		if progress := sync.recovery; progress != nil {
+			recovery = &Recovery{
+				Reason:     progress.Reason,
+				State:      progress.State,
+				Namespaces: progress.Namespaces,
+				StartTs:    mongoTime(utils.TimestampToInt64(progress.StartTs)),
+				Begin:      &Time{TimestampUnix: progress.Begin.Unix(), TimestampTime: utils.TimestampToString(progress.Begin.Unix())},
+			}
+			if !progress.Finished.IsZero() {
+				recovery.Finished = &Time{TimestampUnix: progress.Finished.Unix(),
+					TimestampTime: utils.TimestampToString(progress.Finished.Unix())}
+			}
+			if progress.State == RecoveryCopying {
+				recovery.Ranges, recovery.RangesDone = sync.ckptManager.CountRanges()
+			}
+		}
 		return &Info{
 			Who:         conf.Options.CollectorId,
 			Tag:         utils.BRANCH,
@@ -354,6 +486,8 @@ func (sync *OplogSyncer) RestAPI() {
 				Time: Time{TimestampUnix: utils.ExtractMongoTimestamp(sync.replMetric.LSNAck),
 					TimestampTime: utils.TimestampToString(utils.ExtractMongoTimestamp(sync.replMetric.LSNAck))}},
 			Now: &Time{TimestampUnix: time.Now().Unix(), TimestampTime: utils.TimestampToString(time.Now().Unix())},
+			Rollback: rollback,
+			Recovery: recovery,
 		}
 	})
 }
@@ -363,8 +497,10 @@ type Batcher struct {
 	// related oplog syncer. not owned
 	syncer *OplogSyncer
 
-	// filter functionality by gid
-	filterList OplogFilterChain
+	// oplog filters. *filterState swapped while rules changed
+	filters atomic.Value
+	// rewrite the oplogs passed filters before hashing
+	transformers OplogTransformerChain
 	// oplog handler
 	handler OplogHandler
 
@@ -374,14 +510,39 @@ type Batcher struct {
 	workerGroup []*Worker
 
 	lastOplog *oplog.PartialLog
+	// the last oplog merged including the filtered ones
+	lastSeen *oplog.PartialLog
+	// worker of current transaction
+	txnWorker uint32
+	// the workers that oplogs of transactions are hashed to but not
+	// dispatched to, and the worker of the transaction. the oplogs hashed
+	// to them later should be replayed after the transaction
+	txnHashed map[uint32]uint32
+
+	// number of logs queue batches merged in the last batchMore and all the
+	// batches have been dispatched
+	merged     uint64
+	dispatched uint64
+	// nothing is offered to workers while it's set. recovery uses the
+	// workers exclusively
+	paused int32
+	// recovery restarts the batcher from the position after the workers
+	// are used. the state of batcher is reset in its own goroutine
+	restarts chan *ckpt.Position
 }
 
 func (batcher *Batcher) getLastOplog() *oplog.PartialLog {
 	return batcher.lastOplog
 }
+
+func (batcher *Batcher) getLastSeen() *oplog.PartialLog {
+	return batcher.lastSeen
+}
 func (batcher *Batcher) filter(log *oplog.PartialLog) bool {
 	// filter oplog suchlike Noop or Gid-filtered
-	if batcher.filterList.IterateFilter(log) {
+	state := batcher.getFilters()
+	if i := state.chain.Match(log); i != -1 {
+		atomic.AddUint64(&state.drops[i], 1)
 		LOG.Debug("Oplog is filtered. %v", log)
 		batcher.syncer.replMetric.AddFilter(1)
 		return true
@@ -395,12 +556,37 @@ func (batcher *Batcher) dispatchBatches(batchGroup [][]*oplog.GenericOplog) (wor
 		if batch != nil {
 			work = true
 			batcher.workerGroup[i].AllAcked(false)
+			if len(batch) != 0 {
+				last := batch[len(batch)-1].Parsed
+				batcher.syncer.positions[last.Timestamp] = &ckpt.Position{
+					Timestamp: last.Timestamp, Hash: last.Hash, Term: last.Term}
+			}
 		}
 		batcher.workerGroup[i].Offer(batch)
 	}
 	return
 }
 
+// transform rewrites the oplog by transformers. the collector exits if it
+// fails. the oplog shouldn't leave in original or be skipped, and the
+// checkpoint mustn't pass it
+func (batcher *Batcher) transform(log *oplog.GenericOplog) []*oplog.GenericOplog {
+	if len(batcher.transformers) == 0 {
+		return []*oplog.GenericOplog{log}
+	}
+	transformed, err := batcher.transformers.Transform(log)
+	if err != nil {
+		LOG.Critical("Oplog transform failed. %v. %v", err, log.Parsed)
+		nimo.AssertTrue(false, "Oplog transform failed, users should fix the transform rules or plugins")
+		return nil
+	}
+	// the marker of transaction isn't in the oplog transformed
+	for _, emitted := range transformed {
+		emitted.Parsed.Txn = log.Parsed.Txn
+	}
+	return transformed
+}
+
 func (batcher *Batcher) batchMore() [][]*oplog.GenericOplog {
 	// picked raw oplogs and batching in sequence
 	batchGroup := make([][]*oplog.GenericOplog, len(batcher.workerGroup))
@@ -408,7 +594,19 @@ func (batcher *Batcher) batchMore() [][]*oplog.GenericOplog {
 
 	// first part of merge batch is from current logs queue.
 	// It's allowed to be blocked !
-	mergeBatch := <-syncer.logsQueue[batcher.currentQueue()]
+	var mergeBatch []*oplog.GenericOplog
+	batcher.merged = 0
+	select {
+	case mergeBatch = <-syncer.logsQueue[batcher.currentQueue()]:
+	case position := <-batcher.restarts:
+		batcher.restart(position)
+		return batchGroup
+	}
+	if atomic.LoadInt32(&batcher.paused) != 0 {
+		// hold the oplogs until recovery finishes
+		batcher.restart(<-batcher.restarts)
+	}
+	batcher.merged = 1
 	// move to next available logs queue
 	batcher.moveToNextQueue()
 	for len(mergeBatch) < conf.Options.AdaptiveBatchingMaxSize &&
@@ -416,25 +614,116 @@ func (batcher *Batcher) batchMore() [][]*oplog.GenericOplog {
 		// there has more pushed oplogs in next logs queue (read can't to be block)
 		// Hence, we fetch them by the way. and merge together
 		mergeBatch = append(mergeBatch, <-syncer.logsQueue[batcher.nextQueue]...)
+		batcher.merged++
 		batcher.moveToNextQueue()
 	}
-	nimo.AssertTrue(len(mergeBatch) != 0, "logs queue batch logs has zero length")
+	// merged batch may be empty if all the oplogs are uncommitted transactions
+	if len(mergeBatch) != 0 {
+		batcher.lastSeen = mergeBatch[len(mergeBatch)-1].Parsed
+		syncer.positions[batcher.lastSeen.Timestamp] = &ckpt.Position{Timestamp: batcher.lastSeen.Timestamp,
+			Hash: batcher.lastSeen.Hash, Term: batcher.lastSeen.Term}
+	}
 
-	for _, genericLog := range mergeBatch {
+	for _, mergedLog := range mergeBatch {
 		// filter oplog such like Noop or Gid-filtered
-		if batcher.filter(genericLog.Parsed) {
+		if batcher.filter(mergedLog.Parsed) {
 			// doesn't push to worker
 			continue
 		}
-		batcher.handler.Handle(genericLog.Parsed)
+		// the oplogs transformed are hashed and dispatched in order
+		for _, genericLog := range batcher.transform(mergedLog) {
+			batchGroup = batcher.dispatch(batchGroup, genericLog)
+		}
+	}
+	return batchGroup
+}
+
+// restart drops the positions of oplogs dispatched before recovery and
+// resumes dispatching. the workers ack the offsets of oplogs before. reset
+// them so that the checkpoint isn't beyond the position
+func (batcher *Batcher) restart(position *ckpt.Position) {
+	tsInt64 := utils.TimestampToInt64(position.Timestamp)
+	for _, worker := range batcher.workerGroup {
+		atomic.StoreInt64(&worker.unack, tsInt64)
+		atomic.StoreInt64(&worker.ack, tsInt64)
+	}
+	batcher.syncer.positions = make(map[bson.MongoTimestamp]*ckpt.Position)
+	batcher.lastSeen = nil
+	atomic.StoreInt32(&batcher.paused, 0)
+}
+
+// dispatch appends the oplog to the batch of worker it's hashed to. returns
+// the batches that may be renewed by barrier
+func (batcher *Batcher) dispatch(batchGroup [][]*oplog.GenericOplog, genericLog *oplog.GenericOplog) [][]*oplog.GenericOplog {
+	batcher.handler.Handle(genericLog.Parsed)
+
+	if hasher, ok := batcher.syncer.hasher.(*AutoHasher); ok && hasher.Observe(genericLog.Parsed) &&
+		len(batcher.workerGroup) > 1 && !(genericLog.Parsed.Txn && conf.Options.TransactionAtomic) {
+		// the oplogs of namespace distributed the old way should be
+		// replayed completely
+		batchGroup = batcher.barrier(batchGroup)
+	}
 
-		which := syncer.hasher.DistributeOplogByMod(genericLog.Parsed, len(batcher.workerGroup))
-		batchGroup[which] = append(batchGroup[which], genericLog)
-		batcher.lastOplog = genericLog.Parsed
+	which := batcher.syncer.hasher.DistributeOplogByMod(genericLog.Parsed, len(batcher.workerGroup))
+	if conf.Options.TransactionAtomic && len(batcher.workerGroup) > 1 {
+		batchGroup, which = batcher.dispatchTxn(batchGroup, genericLog.Parsed, which)
 	}
+	batchGroup[which] = append(batchGroup[which], genericLog)
+	batcher.lastOplog = genericLog.Parsed
 	return batchGroup
 }
 
+// dispatchTxn sends the whole transaction to the worker of its first oplog.
+// the oplogs of transaction hashed to another worker may conflict with the
+// ones in that worker. so the transaction waits until the ones before are
+// acked, and the ones after wait until the transaction is acked. only the
+// workers overlapped are waited for. returns the worker of log
+func (batcher *Batcher) dispatchTxn(batchGroup [][]*oplog.GenericOplog, log *oplog.PartialLog,
+	hashed uint32) ([][]*oplog.GenericOplog, uint32) {
+	which := hashed
+	if log.Txn {
+		if batcher.lastOplog == nil || !oplog.SameTxnGroup(batcher.lastOplog, log) {
+			batcher.txnWorker = hashed
+		}
+		which = batcher.txnWorker
+	}
+
+	// hashed to the worker that a transaction skipped before
+	if txnWorker, exist := batcher.txnHashed[hashed]; exist && txnWorker != which {
+		batchGroup = batcher.barrier(batchGroup, txnWorker)
+		for worker, skipped := range batcher.txnHashed {
+			if skipped == txnWorker {
+				delete(batcher.txnHashed, worker)
+			}
+		}
+	}
+
+	if which != hashed {
+		if len(batchGroup[hashed]) != 0 || !batcher.workerGroup[hashed].drained() {
+			batchGroup = batcher.barrier(batchGroup, hashed)
+		}
+		batcher.txnHashed[hashed] = which
+	}
+	return batchGroup, which
+}
+
+// barrier dispatches the batches and waits until all the oplogs dispatched
+// to the workers given are acked. all the workers if none is given. returns
+// the new batches
+func (batcher *Batcher) barrier(batchGroup [][]*oplog.GenericOplog, workers ...uint32) [][]*oplog.GenericOplog {
+	batcher.dispatchBatches(batchGroup)
+	if len(workers) == 0 {
+		for _, worker := range batcher.workerGroup {
+			worker.waitAllAcked()
+		}
+	} else {
+		for _, worker := range workers {
+			batcher.workerGroup[worker].waitAllAcked()
+		}
+	}
+	return make([][]*oplog.GenericOplog, len(batcher.workerGroup))
+}
+
 func (batcher *Batcher) moveToNextQueue() {
 	batcher.nextQueue++
 	batcher.nextQueue = batcher.nextQueue % uint64(len(batcher.syncer.logsQueue))
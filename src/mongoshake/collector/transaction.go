@@ -0,0 +1,223 @@
+package collector
+
+import (
+	"fmt"
+	"sync"
+
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+	"mongoshake/dbpool"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	TxnApplyOps = "applyOps"
+	TxnCommit   = "commitTransaction"
+	TxnAbort    = "abortTransaction"
+)
+
+// txnEntry is the transaction related fields of a command oplog. the
+// entries of transactions have the session and transaction number
+type txnEntry struct {
+	Lsid      bson.M `bson:"lsid"`
+	TxnNumber *int64 `bson:"txnNumber"`
+	Object    struct {
+		ApplyOps   []bson.D `bson:"applyOps"`
+		PartialTxn bool     `bson:"partialTxn"`
+		Prepare    bool     `bson:"prepare"`
+	} `bson:"o"`
+	PrevOpTime struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	} `bson:"prevOpTime"`
+}
+
+// TxnAssembler expands transaction oplogs into individual oplogs. MongoDB
+// 4.0 writes a transaction as a single applyOps entry on admin.$cmd and 4.2
+// splits large ones into partialTxn entries chained by prevOpTime. Prepared
+// transactions are committed by a following commitTransaction entry. All
+// the operations are expanded with the timestamp of the committing entry.
+//
+// Chained entries may be fetched in different batches that deserialized
+// concurrently. so batches are assembled in fetching order by sequence
+type TxnAssembler struct {
+	// source mongo address url. used to load the chain that started before
+	// the checkpoint
+	src  string
+	conn *dbpool.MongoConn
+
+	// chains not committed yet. keyed by the timestamp of the last entry
+	chains map[bson.MongoTimestamp][]bson.D
+
+	// sequence of the next batch to be assembled
+	turn     uint64
+	turnCond *sync.Cond
+}
+
+func NewTxnAssembler(src string) *TxnAssembler {
+	return &TxnAssembler{
+		src:      src,
+		chains:   make(map[bson.MongoTimestamp][]bson.D),
+		turnCond: sync.NewCond(new(sync.Mutex)),
+	}
+}
+
+// Assemble expands all the transactions in batch. batches should be given
+// with continuous sequence from 0 and it blocks until all the batches
+// before are assembled
+func (assembler *TxnAssembler) Assemble(sequence uint64, batch []*oplog.GenericOplog) []*oplog.GenericOplog {
+	assembler.turnCond.L.Lock()
+	for assembler.turn != sequence {
+		assembler.turnCond.Wait()
+	}
+	assembler.turnCond.L.Unlock()
+
+	// most of the batches have no transaction. keep them unchanged
+	var assembled []*oplog.GenericOplog
+	changed := false
+	for i, log := range batch {
+		logs := assembler.assemble(log)
+		if !changed && len(logs) == 1 && logs[0] == log {
+			continue
+		}
+		if !changed {
+			assembled = append(make([]*oplog.GenericOplog, 0, len(batch)), batch[:i]...)
+			changed = true
+		}
+		assembled = append(assembled, logs...)
+	}
+	if !changed {
+		assembled = batch
+	}
+
+	assembler.turnCond.L.Lock()
+	assembler.turn++
+	assembler.turnCond.L.Unlock()
+	assembler.turnCond.Broadcast()
+	return assembled
+}
+
+func (assembler *TxnAssembler) assemble(log *oplog.GenericOplog) []*oplog.GenericOplog {
+	// change stream reports the operations of transactions one by one. and
+	// the chain can't be loaded since local.oplog.rs isn't read
+	if log.Parsed.Operation != "c" || conf.Options.SyncerReaderMethod == ReaderMethodChangeStream {
+		return []*oplog.GenericOplog{log}
+	}
+	_, applyOps := log.Parsed.Object[TxnApplyOps]
+	_, commit := log.Parsed.Object[TxnCommit]
+	_, abort := log.Parsed.Object[TxnAbort]
+	if !applyOps && !commit && !abort {
+		return []*oplog.GenericOplog{log}
+	}
+
+	entry := new(txnEntry)
+	if err := bson.Unmarshal(log.Raw, entry); err != nil {
+		LOG.Critical("Transaction oplog %v decode failed. %v", log.Parsed, err)
+		return []*oplog.GenericOplog{log}
+	}
+	if entry.Lsid == nil && entry.TxnNumber == nil {
+		// applyOps run by users. it's replayed as a command
+		return []*oplog.GenericOplog{log}
+	}
+
+	prev := entry.PrevOpTime.Timestamp
+	ops, exist := assembler.chains[prev]
+	delete(assembler.chains, prev)
+	if prev != 0 && !exist && !abort {
+		// the chain started before current reading position
+		ops = assembler.loadChain(prev)
+	}
+
+	switch {
+	case abort:
+		LOG.Info("Transaction aborted. drop %d operations", len(ops))
+		return nil
+	case commit:
+		return assembler.expand(log.Parsed, ops)
+	case entry.Object.PartialTxn || entry.Object.Prepare:
+		// wait for the following entries
+		assembler.chains[log.Parsed.Timestamp] = append(ops, entry.Object.ApplyOps...)
+		return nil
+	default:
+		return assembler.expand(log.Parsed, append(ops, entry.Object.ApplyOps...))
+	}
+}
+
+// loadChain reads the entries of chain from source oplog backward. it keeps
+// retrying since the transaction can't be skipped
+func (assembler *TxnAssembler) loadChain(last bson.MongoTimestamp) []bson.D {
+	for {
+		ops, err := assembler.readChain(last)
+		if err == nil {
+			return ops
+		}
+		LOG.Critical("Load transaction chain ends with ts[%d] failed, users should fix it manually. %v",
+			utils.ExtractMongoTimestamp(last), err)
+		if assembler.conn != nil {
+			assembler.conn.Close()
+			assembler.conn = nil
+		}
+		utils.YieldInMs(DurationTime)
+	}
+}
+
+func (assembler *TxnAssembler) readChain(last bson.MongoTimestamp) ([]bson.D, error) {
+	if assembler.conn == nil {
+		conn, err := dbpool.NewMongoConn(assembler.src, false)
+		if err != nil {
+			return nil, err
+		}
+		assembler.conn = conn
+	}
+
+	var ops []bson.D
+	for ts := last; ts != 0; {
+		entry := new(txnEntry)
+		if err := assembler.conn.Session.DB(localDB).C(dbpool.OplogNS).
+			Find(bson.M{QueryTs: ts}).One(entry); err != nil {
+			return nil, fmt.Errorf("find oplog ts[%d] failed. %v", utils.ExtractMongoTimestamp(ts), err)
+		}
+		ops = append(entry.Object.ApplyOps, ops...)
+		ts = entry.PrevOpTime.Timestamp
+	}
+	return ops, nil
+}
+
+// expand converts operations into oplogs with the timestamp, gid, hash and
+// term of committing entry. they are marked as in transaction by Txn that
+// isn't written into the oplogs
+func (assembler *TxnAssembler) expand(commit *oplog.PartialLog, ops []bson.D) []*oplog.GenericOplog {
+	logs := make([]*oplog.GenericOplog, 0, len(ops))
+	for _, op := range ops {
+		doc := bson.D{{"ts", commit.Timestamp}}
+		if len(commit.Gid) != 0 {
+			doc = append(doc, bson.DocElem{Name: "g", Value: commit.Gid})
+		}
+		if commit.Hash != 0 {
+			doc = append(doc, bson.DocElem{Name: "h", Value: commit.Hash})
+		}
+		if commit.Term != 0 {
+			doc = append(doc, bson.DocElem{Name: "t", Value: commit.Term})
+		}
+		for _, field := range op {
+			switch field.Name {
+			case "ts", "g", "h", "t":
+			default:
+				doc = append(doc, field)
+			}
+		}
+
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			LOG.Critical("Transaction operation %v encode failed. %v", op, err)
+			continue
+		}
+		log := &oplog.GenericOplog{Raw: raw, Parsed: new(oplog.PartialLog)}
+		bson.Unmarshal(raw, log.Parsed)
+		log.Parsed.Txn = true
+		logs = append(logs, log)
+	}
+	return logs
+}
@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"testing"
+
+	"mongoshake/collector/configure"
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func TestTxnAssemblerChangeStream(t *testing.T) {
+	method := conf.Options.SyncerReaderMethod
+	defer func() { conf.Options.SyncerReaderMethod = method }()
+	conf.Options.SyncerReaderMethod = ReaderMethodChangeStream
+
+	// the chain isn't loaded from source
+	assembler := NewTxnAssembler("")
+	batch := []*oplog.GenericOplog{newRawOplog(t, bson.D{{"ts", bson.MongoTimestamp(2)}, {"op", "c"},
+		{"ns", "admin.$cmd"}, {"o", bson.D{{"commitTransaction", 1}}}, {"prevOpTime", bson.D{{"ts", bson.MongoTimestamp(1)}}}})}
+	if assembled := assembler.Assemble(0, batch); len(assembled) != 1 || assembled[0] != batch[0] {
+		t.Errorf("change stream oplogs are assembled to %v", assembled)
+	}
+}
+
+func newTxnOplog(t *testing.T, ts int64, object bson.D, prev int64, transactional bool) *oplog.GenericOplog {
+	document := bson.D{{"ts", bson.MongoTimestamp(ts << 32)}, {"t", int64(1)}, {"h", int64(ts)}, {"op", "c"},
+		{"ns", "admin.$cmd"}, {"o", object}}
+	if transactional {
+		document = append(document, bson.DocElem{Name: "lsid", Value: bson.M{"id": "session"}},
+			bson.DocElem{Name: "txnNumber", Value: int64(0)})
+	}
+	document = append(document, bson.DocElem{Name: "prevOpTime",
+		Value: bson.D{{"ts", bson.MongoTimestamp(prev << 32)}, {"t", int64(1)}}})
+	return newRawOplog(t, document)
+}
+
+func txnOps(ids ...int) []bson.D {
+	var ops []bson.D
+	for _, id := range ids {
+		ops = append(ops, bson.D{{"op", "i"}, {"ns", "db.c"}, {"ui", "uuid"}, {"o", bson.D{{"_id", id}}}})
+	}
+	return ops
+}
+
+// checkExpanded checks that logs are the operations of ids committed at ts
+func checkExpanded(t *testing.T, name string, logs []*oplog.GenericOplog, ts int64, ids ...int) {
+	if len(logs) != len(ids) {
+		t.Errorf("%s: %d oplogs are expanded, should be %d", name, len(logs), len(ids))
+		return
+	}
+	for i, log := range logs {
+		var document bson.M
+		if err := bson.Unmarshal(log.Raw, &document); err != nil {
+			t.Fatalf("%s: decode oplog expanded failed. %v", name, err)
+		}
+		if _, exist := document["txn"]; exist {
+			t.Errorf("%s: marker is written into oplog %v", name, document)
+		}
+		if !log.Parsed.Txn || log.Parsed.Timestamp != bson.MongoTimestamp(ts<<32) ||
+			log.Parsed.Hash != ts || log.Parsed.Term != 1 || log.Parsed.Operation != "i" ||
+			log.Parsed.Object["_id"] != ids[i] {
+			t.Errorf("%s: oplog %d is expanded to %v txn %v", name, i, log.Parsed, log.Parsed.Txn)
+		}
+	}
+}
+
+func TestTxnAssembler(t *testing.T) {
+	method := conf.Options.SyncerReaderMethod
+	defer func() { conf.Options.SyncerReaderMethod = method }()
+	conf.Options.SyncerReaderMethod = ReaderMethodOplog
+
+	// the chain isn't loaded from source
+	assembler := NewTxnAssembler("")
+	var sequence uint64
+	assemble := func(logs ...*oplog.GenericOplog) []*oplog.GenericOplog {
+		sequence++
+		return assembler.Assemble(sequence-1, logs)
+	}
+
+	// 4.0 transaction along with the oplogs not in transaction
+	insert := newRawOplog(t, bson.D{{"ts", bson.MongoTimestamp(1 << 32)}, {"op", "i"}, {"ns", "db.c"},
+		{"o", bson.D{{"_id", 0}}}})
+	logs := assemble(insert, newTxnOplog(t, 2, bson.D{{"applyOps", txnOps(1, 2)}}, 0, true))
+	if len(logs) != 3 || logs[0] != insert || logs[0].Parsed.Txn {
+		t.Fatalf("batch is assembled to %v", logs)
+	}
+	checkExpanded(t, "4.0", logs[1:], 2, 1, 2)
+
+	// applyOps run by users isn't expanded
+	applyOps := newTxnOplog(t, 3, bson.D{{"applyOps", txnOps(3)}}, 0, false)
+	if logs = assemble(applyOps); len(logs) != 1 || logs[0] != applyOps || logs[0].Parsed.Txn {
+		t.Errorf("applyOps not in transaction is assembled to %v", logs)
+	}
+
+	// 4.2 transaction split into entries in different batches
+	if logs = assemble(newTxnOplog(t, 4, bson.D{{"applyOps", txnOps(4)}, {"partialTxn", true}}, 0, true)); len(logs) != 0 {
+		t.Errorf("partial transaction is assembled to %v", logs)
+	}
+	checkExpanded(t, "4.2", assemble(newTxnOplog(t, 5, bson.D{{"applyOps", txnOps(5, 6)}}, 4, true)), 5, 4, 5, 6)
+
+	// prepared transaction committed
+	if logs = assemble(newTxnOplog(t, 6, bson.D{{"applyOps", txnOps(7)}, {"prepare", true}}, 0, true)); len(logs) != 0 {
+		t.Errorf("prepared transaction is assembled to %v", logs)
+	}
+	checkExpanded(t, "commit", assemble(newTxnOplog(t, 7, bson.D{{"commitTransaction", 1}}, 6, true)), 7, 7)
+
+	// prepared transaction aborted
+	assemble(newTxnOplog(t, 8, bson.D{{"applyOps", txnOps(8)}, {"prepare", true}}, 0, true))
+	if logs = assemble(newTxnOplog(t, 9, bson.D{{"abortTransaction", 1}}, 8, true)); len(logs) != 0 {
+		t.Errorf("aborted transaction is assembled to %v", logs)
+	}
+	if len(assembler.chains) != 0 {
+		t.Errorf("chains are left %v", assembler.chains)
+	}
+}
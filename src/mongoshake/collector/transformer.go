@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"fmt"
+	"sync"
+
+	"mongoshake/collector/configure"
+	"mongoshake/oplog"
+)
+
+// OplogTransformer rewrites an oplog passed the filters into zero, one or
+// many oplogs. The oplogs returned are dispatched in order and hashed to
+// workers one by one, so they should have the timestamp of the input and
+// the fields the hasher uses, such as _id. The input shouldn't be changed
+// in place since it may be referenced elsewhere. Transform is invoked by
+// one goroutine per syncer, and by several ones in document sync. The
+// collector exits if an oplog fails, and the copy of the range is retried
+// if a document fails.
+type OplogTransformer interface {
+	Transform(log *oplog.GenericOplog) ([]*oplog.GenericOplog, error)
+}
+
+// TransformerCreator creates the transformer of a syncer
+type TransformerCreator func() (OplogTransformer, error)
+
+var (
+	transformerRegistry     = make(map[string]TransformerCreator)
+	transformerRegistryLock sync.Mutex
+)
+
+// RegisterTransformer makes the transformer available by name in
+// transform.plugins. It's supposed to be invoked in init() of the package
+// implementing the transformer
+func RegisterTransformer(name string, creator TransformerCreator) {
+	transformerRegistryLock.Lock()
+	defer transformerRegistryLock.Unlock()
+
+	if _, exist := transformerRegistry[name]; exist {
+		panic(fmt.Sprintf("transformer %s is registered twice", name))
+	}
+	transformerRegistry[name] = creator
+}
+
+type OplogTransformerChain []OplogTransformer
+
+// NewTransformerChain creates the transformers configured. the field
+// transformer of transform.rules goes first and the plugins follow in order
+func NewTransformerChain() (OplogTransformerChain, error) {
+	var chain OplogTransformerChain
+	fieldTransformer, err := NewFieldTransformer(conf.Options.TransformRules, conf.Options.TransformHashSalt)
+	if err != nil {
+		return nil, err
+	}
+	if fieldTransformer != nil {
+		chain = append(chain, fieldTransformer)
+	}
+
+	transformerRegistryLock.Lock()
+	defer transformerRegistryLock.Unlock()
+	for _, name := range conf.Options.TransformPlugins {
+		creator, exist := transformerRegistry[name]
+		if !exist {
+			return nil, fmt.Errorf("transformer %s isn't registered", name)
+		}
+		transformer, err := creator()
+		if err != nil {
+			return nil, fmt.Errorf("create transformer %s failed. %v", name, err)
+		}
+		chain = append(chain, transformer)
+	}
+	return chain, nil
+}
+
+// Transform passes the oplog through all the transformers. the oplogs
+// emitted by one are transformed by the next in order
+func (chain OplogTransformerChain) Transform(log *oplog.GenericOplog) ([]*oplog.GenericOplog, error) {
+	logs := []*oplog.GenericOplog{log}
+	for _, transformer := range chain {
+		var transformed []*oplog.GenericOplog
+		for _, log := range logs {
+			emitted, err := transformer.Transform(log)
+			if err != nil {
+				return nil, err
+			}
+			transformed = append(transformed, emitted...)
+		}
+		if logs = transformed; len(logs) == 0 {
+			break
+		}
+	}
+	return logs, nil
+}
@@ -1,8 +1,8 @@
 package collector
 
 import (
-	"sort"
 	"sync/atomic"
+	"time"
 
 	"mongoshake/collector/configure"
 	"mongoshake/common"
@@ -35,6 +35,18 @@ type Worker struct {
 	// ack offset (used for checkpoint)
 	ack, unack int64
 	count      uint64
+	// sequence of the batches offered and confirmed. the batches share
+	// the same timestamp sometimes, so waiting depends on these instead
+	// of ack offset. batches are confirmed in the order offered
+	offered, confirmed uint64
+	// sequence of the batches transferred. and the ones in listUnACK that
+	// aren't acked by receiver of AckRequired() tunnel yet
+	transferred uint64
+	inflight    []inflightBatch
+	// the receiver acks by seqBase + sequence. it's the time worker created
+	// so that the sequences after restart are bigger than the ones acked
+	// before
+	seqBase uint64
 	// if all oplogs are acked for righ now
 	allAcked bool
 	// retransmit on tunnel controller tunnel required
@@ -44,6 +56,14 @@ type Worker struct {
 	eventListener *TransferEventListener
 }
 
+// inflightBatch is confirmed once its sequence is acked
+type inflightBatch struct {
+	seq uint64
+	// timestamp of the last oplog and number of oplogs
+	ts    int64
+	count int
+}
+
 type TransferEventListener struct {
 	whenTransferBatchSuccess func(worker *Worker, buffer []*oplog.GenericOplog)
 	whenTransferRetry        func(worker *Worker, buffer []*oplog.GenericOplog)
@@ -55,6 +75,7 @@ func NewWorker(coordinator *ReplicationCoordinator, syncer *OplogSyncer, id uint
 		syncer:      syncer,
 		id:          id,
 		queue:       make(chan []*oplog.GenericOplog, conf.Options.WorkerBatchQueueSize),
+		seqBase:     uint64(time.Now().UnixNano()),
 	}
 }
 
@@ -75,18 +96,34 @@ func (worker *Worker) AllAcked(allAcked bool) {
 func (worker *Worker) Offer(batch []*oplog.GenericOplog) {
 	if batch != nil {
 		atomic.StoreInt64(&worker.unack, utils.TimestampToInt64(batch[len(batch)-1].Parsed.Timestamp))
+		atomic.AddUint64(&worker.offered, 1)
 	}
 	worker.queue <- batch
 }
 
+// waitAllAcked blocks until the batches offered before are acked. the ones
+// offered by others meanwhile aren't waited for
+func (worker *Worker) waitAllAcked() {
+	target := atomic.LoadUint64(&worker.offered)
+	for atomic.LoadUint64(&worker.confirmed) < target {
+		if len(worker.queue) == 0 {
+			// probe the ack value from tunnel
+			worker.Offer(nil)
+		}
+		utils.DelayFor(100)
+	}
+}
+
+// drained returns true if all the batches offered are acked
+func (worker *Worker) drained() bool {
+	confirmed := atomic.LoadUint64(&worker.confirmed)
+	return confirmed >= atomic.LoadUint64(&worker.offered)
+}
+
 func (worker *Worker) shouldDelay() bool {
 	// unack buffer is too big. There should be a mass of accumulated oplogs
 	// have already sent but not be ack yet. No more oplogs pushed !
-	if len(worker.listUnACK) > MaxUnAckListLength {
-		// try to transfer remained oplogs to free some space
-		return true
-	}
-	return false
+	return len(worker.listUnACK) > MaxUnAckListLength
 }
 
 func (worker *Worker) shouldStall() bool {
@@ -117,7 +154,6 @@ func (worker *Worker) startWorker() {
 			// we guess there were lots of oplogs have been pended in jobs queue.
 			// we need wait for a few moment
 			worker.probe()
-			worker.purgeACK()
 			fallthrough
 		case worker.shouldStall():
 			utils.DelayFor(10)
@@ -167,7 +203,12 @@ func (worker *Worker) transfer(batch []*oplog.GenericOplog) {
 			logs = batch
 			tag = tunnel.MsgNormal
 		}
-		replyAndAcked := worker.writeController.Send(logs, tag)
+		// the retransmission is acked by the last batch retained
+		seq := worker.transferred
+		if !worker.retransmit {
+			seq++
+		}
+		replyAndAcked := worker.writeController.Send(logs, tag, worker.seqBase+seq)
 
 		LOG.Info("Collector-worker-%d transfer retransmit:%t send [%d] logs. reply_acked [%d], list_unack [%d] ",
 			worker.id, worker.retransmit, len(logs), replyAndAcked, len(worker.listUnACK))
@@ -176,15 +217,12 @@ func (worker *Worker) transfer(batch []*oplog.GenericOplog) {
 		case replyAndAcked >= 0:
 			if !worker.retransmit {
 				worker.count += uint64(len(logs))
-				worker.syncer.replMetric.SetLSNACK(replyAndAcked)
 				worker.syncer.replMetric.AddApply(uint64(len(logs)))
 				worker.retain(batch)
-				// update ack
-				atomic.StoreInt64(&worker.ack, replyAndAcked)
 				done = true
 			}
-			// remove all unack values which are smaller than worker.ack
-			worker.purgeACK()
+			// remove the batches acked from listUnACK
+			worker.acknowledge(replyAndAcked)
 			// reset
 			worker.retransmit = false
 			// notify success listener
@@ -208,28 +246,57 @@ func (worker *Worker) transfer(batch []*oplog.GenericOplog) {
 }
 
 func (worker *Worker) probe() {
-	if replyAcked := worker.writeController.Send([]*oplog.GenericOplog{}, tunnel.MsgProbe); replyAcked > 0 {
+	if replyAcked := worker.writeController.Send([]*oplog.GenericOplog{}, tunnel.MsgProbe,
+		worker.seqBase+worker.transferred); replyAcked > 0 {
 		// only change ack offset on reply is OK
-		worker.syncer.replMetric.SetLSNACK(replyAcked)
-		atomic.StoreInt64(&worker.ack, replyAcked)
+		worker.acknowledge(replyAcked)
 	}
 }
 
 func (worker *Worker) retain(batch []*oplog.GenericOplog) {
 	worker.listUnACK = append(worker.listUnACK, batch...)
+	worker.transferred++
+	worker.inflight = append(worker.inflight, inflightBatch{seq: worker.transferred,
+		ts: utils.TimestampToInt64(batch[len(batch)-1].Parsed.Timestamp), count: len(batch)})
 	LOG.Debug("Collector-worker-%d copy batch oplogs [%d] to listUnACK count. UnACK remained [%d]", worker.id, len(batch), len(worker.listUnACK))
 }
 
-func (worker *Worker) purgeACK() {
-	bigger := sort.Search(len(worker.listUnACK), func(i int) bool {
-		return utils.TimestampToInt64(worker.listUnACK[i].Parsed.Timestamp) > worker.ack
-	})
+// acknowledge confirms the batches acked by reply and removes their oplogs
+// from listUnACK. the receiver of AckRequired() tunnel acks by the sequence
+// of batch, the ack offset is the timestamp of the last batch acked. the
+// batches are written already once Send returns otherwise, and the reply is
+// the ack offset
+func (worker *Worker) acknowledge(reply int64) {
+	ackRequired := worker.writeController.tunnel.AckRequired()
+	if ackRequired && uint64(reply) > worker.seqBase+worker.transferred {
+		LOG.Critical("Collector-worker-%d receiver acks sequence %d that isn't sent. it should ack by "+
+			"the Seq of messages", worker.id, reply)
+		return
+	}
+
+	acked, purged := 0, 0
+	for ; acked < len(worker.inflight); acked++ {
+		batch := worker.inflight[acked]
+		if ackRequired && worker.seqBase+batch.seq > uint64(reply) {
+			break
+		}
+		purged += batch.count
+		if ackRequired {
+			atomic.StoreInt64(&worker.ack, batch.ts)
+		}
+		atomic.StoreUint64(&worker.confirmed, batch.seq)
+	}
+	if !ackRequired {
+		atomic.StoreInt64(&worker.ack, reply)
+	}
+	worker.inflight = worker.inflight[acked:]
+	worker.syncer.replMetric.SetLSNACK(atomic.LoadInt64(&worker.ack))
 
-	if bigger != 0 {
+	if purged != 0 {
 		LOG.Debug("Collector-worker-%d purge unacked [lsn_ack:%d]. keep slice position from %d util %d",
-			worker.id, worker.ack, bigger, len(worker.listUnACK))
-		worker.listUnACK = worker.listUnACK[bigger:]
-		worker.syncer.replMetric.AddSuccess(uint64(bigger))
+			worker.id, worker.ack, purged, len(worker.listUnACK))
+		worker.listUnACK = worker.listUnACK[purged:]
+		worker.syncer.replMetric.AddSuccess(uint64(purged))
 	}
 }
 
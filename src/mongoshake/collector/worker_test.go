@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mongoshake/common"
+	"mongoshake/oplog"
+	"mongoshake/tunnel"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+// testTunnel records the messages sent. the receiver of AckRequired() acks
+// the sequence set by the test
+type testTunnel struct {
+	ackRequired bool
+	// sequence replayed by receiver
+	acked uint64
+
+	lock     sync.Mutex
+	messages []tunnel.TMessage
+}
+
+func (writer *testTunnel) AckRequired() bool        { return writer.ackRequired }
+func (writer *testTunnel) Prepare() bool            { return true }
+func (writer *testTunnel) ParsedLogsRequired() bool { return false }
+
+func (writer *testTunnel) Send(message *tunnel.WMessage) int64 {
+	writer.lock.Lock()
+	writer.messages = append(writer.messages, *message.TMessage)
+	writer.lock.Unlock()
+	return int64(atomic.LoadUint64(&writer.acked))
+}
+
+func (writer *testTunnel) sent() []tunnel.TMessage {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return append([]tunnel.TMessage{}, writer.messages...)
+}
+
+func newTestWorker(ackRequired bool) (*Worker, *testTunnel) {
+	writer := &testTunnel{ackRequired: ackRequired}
+	worker := &Worker{
+		syncer:  &OplogSyncer{replMetric: &utils.ReplicationMetric{}},
+		queue:   make(chan []*oplog.GenericOplog, 16),
+		seqBase: 1000,
+	}
+	worker.writeController = &WriteController{worker: worker, tunnel: writer}
+	return worker, writer
+}
+
+// newTestBatch returns count oplogs of the same timestamp like the documents
+// copied
+func newTestBatch(t *testing.T, ts int64, count int) []*oplog.GenericOplog {
+	batch := make([]*oplog.GenericOplog, 0, count)
+	for i := 0; i < count; i++ {
+		batch = append(batch, newRawOplog(t, bson.D{{"ts", bson.MongoTimestamp(ts)}, {"op", "i"},
+			{"ns", "db.c"}, {"o", bson.D{{"_id", i}}}}))
+	}
+	return batch
+}
+
+func TestWorkerAckRequired(t *testing.T) {
+	worker, writer := newTestWorker(true)
+	const ts = int64(5) << 32
+	for i := 0; i < 3; i++ {
+		worker.Offer(newTestBatch(t, ts, 2))
+		worker.transfer(<-worker.queue)
+	}
+
+	messages := writer.sent()
+	if len(messages) != 3 {
+		t.Fatalf("%d messages are sent", len(messages))
+	}
+	for i, message := range messages {
+		if message.Tag&tunnel.MsgSequenced == 0 || message.Seq != worker.seqBase+uint64(i)+1 {
+			t.Errorf("message %d has tag %x seq %d", i, message.Tag, message.Seq)
+		}
+	}
+	if worker.drained() || len(worker.listUnACK) != 6 {
+		t.Fatalf("nothing is acked. drained %v, unacked %d", worker.drained(), len(worker.listUnACK))
+	}
+
+	// the timestamp shared by the batches doesn't confirm them
+	atomic.StoreUint64(&writer.acked, uint64(ts))
+	worker.probe()
+	if atomic.LoadUint64(&worker.confirmed) != 0 || len(worker.listUnACK) != 6 {
+		t.Errorf("the batches are confirmed by timestamp. confirmed %d, unacked %d", worker.confirmed,
+			len(worker.listUnACK))
+	}
+
+	atomic.StoreUint64(&writer.acked, worker.seqBase+1)
+	worker.probe()
+	if confirmed := atomic.LoadUint64(&worker.confirmed); confirmed != 1 || worker.drained() {
+		t.Errorf("the first batch only should be confirmed. confirmed %d", confirmed)
+	}
+	if len(worker.listUnACK) != 4 || atomic.LoadInt64(&worker.ack) != ts {
+		t.Errorf("unacked %d, ack %d", len(worker.listUnACK), worker.ack)
+	}
+	if probe := writer.sent()[3]; probe.Tag&tunnel.MsgProbe == 0 || probe.Seq != worker.seqBase+3 {
+		t.Errorf("probe has tag %x seq %d", probe.Tag, probe.Seq)
+	}
+
+	atomic.StoreUint64(&writer.acked, worker.seqBase+3)
+	worker.probe()
+	if !worker.drained() || len(worker.listUnACK) != 0 {
+		t.Errorf("all should be acked. drained %v, unacked %d", worker.drained(), len(worker.listUnACK))
+	}
+}
+
+func TestWorkerAckNotRequired(t *testing.T) {
+	worker, writer := newTestWorker(false)
+	const ts = int64(5) << 32
+	for i := 0; i < 3; i++ {
+		worker.Offer(newTestBatch(t, ts, 2))
+		worker.transfer(<-worker.queue)
+		if !worker.drained() || len(worker.listUnACK) != 0 {
+			t.Errorf("batch %d should be confirmed once sent. unacked %d", i, len(worker.listUnACK))
+		}
+	}
+	for i, message := range writer.sent() {
+		if message.Tag&tunnel.MsgSequenced != 0 {
+			t.Errorf("message %d is sequenced", i)
+		}
+	}
+	if ack := atomic.LoadInt64(&worker.ack); ack != ts {
+		t.Errorf("ack is %d, should be %d", ack, ts)
+	}
+}
+
+func TestWorkerShouldDelay(t *testing.T) {
+	worker, writer := newTestWorker(true)
+	const ts = int64(5) << 32
+	worker.Offer(newTestBatch(t, ts, MaxUnAckListLength+1))
+	worker.transfer(<-worker.queue)
+	if !worker.shouldDelay() {
+		t.Errorf("the oplogs unacked of the same timestamp should delay")
+	}
+
+	atomic.StoreUint64(&writer.acked, worker.seqBase+1)
+	worker.probe()
+	if worker.shouldDelay() {
+		t.Errorf("nothing is unacked. %d", len(worker.listUnACK))
+	}
+}
+
+func TestWorkerWaitAllAcked(t *testing.T) {
+	worker, writer := newTestWorker(true)
+	go worker.startWorker()
+	const ts = int64(5) << 32
+	worker.Offer(newTestBatch(t, ts, 2))
+	worker.Offer(newTestBatch(t, ts, 2))
+
+	done := make(chan struct{})
+	go func() {
+		worker.waitAllAcked()
+		close(done)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	atomic.StoreUint64(&writer.acked, worker.seqBase+1)
+	select {
+	case <-done:
+		t.Fatal("wait returns before all the batches are acked")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	atomic.StoreUint64(&writer.acked, worker.seqBase+2)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait doesn't return after all the batches are acked")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"mongoshake/modules"
 	"mongoshake/oplog"
 	"mongoshake/tunnel"
+
+	LOG "github.com/vinllen/log4go"
 )
 
 type WriteController struct {
@@ -15,6 +17,9 @@ type WriteController struct {
 	// modules
 	moduleList []Module
 
+	// rename namespaces to target. nil means not renamed
+	mapper *NamespaceMapper
+
 	// backend tunnel
 	tunnel tunnel.Writer
 	// current max lsn_ack value
@@ -22,6 +27,9 @@ type WriteController struct {
 }
 
 type Module interface {
+	// name shared with the decoder on receiver
+	Name() string
+
 	IsRegistered() bool
 
 	/**
@@ -42,9 +50,10 @@ type Module interface {
 }
 
 // the order of controller modules declared strictly
-// doesn't change the order
+// doesn't change the order. it's module.ModuleOrder
 var orderedModuleList = []Module{
 	&module.Compressor{},
+	&module.Encryptor{},
 	&module.ChecksumCalculator{},
 }
 
@@ -53,6 +62,8 @@ func NewWriteController(worker *Worker) *WriteController {
 	if !writeController.installModules() {
 		return nil
 	}
+	// it's validated already
+	writeController.mapper, _ = NewNamespaceMapper(conf.Options.NamespaceMapping)
 
 	// create t by options
 	factory := tunnel.WriterFactory{Name: conf.Options.Tunnel}
@@ -68,6 +79,7 @@ func (controller *WriteController) installModules() bool {
 	for _, m := range orderedModuleList {
 		if m.IsRegistered() {
 			if !m.Install() {
+				LOG.Critical("Write controller install module %s failed", m.Name())
 				return false
 			}
 			controller.moduleList = append(controller.moduleList, m)
@@ -76,7 +88,9 @@ func (controller *WriteController) installModules() bool {
 	return true
 }
 
-func (controller *WriteController) Send(logs []*oplog.GenericOplog, tag uint32) int64 {
+// Send ships the logs. seq is the sequence of the last batch in logs, the
+// receiver of AckRequired() tunnel acks by it
+func (controller *WriteController) Send(logs []*oplog.GenericOplog, tag uint32, seq uint64) int64 {
 	// all tunnel message which contain empty logs will be considered as
 	// probe message. Include real probe to get ack from remote server
 	// or a normal message doesn't have logs (which submit by retransmission)
@@ -87,6 +101,16 @@ func (controller *WriteController) Send(logs []*oplog.GenericOplog, tag uint32)
 		return controller.LatestLsnAck
 	}
 
+	// the logs given may be retransmitted later. they are kept in source
+	// namespaces and the renamed are new ones
+	if controller.mapper != nil && len(logs) != 0 {
+		var err error
+		if logs, err = controller.mapper.MapAll(logs); err != nil {
+			LOG.Critical("Write controller rename namespaces failed. %v", err)
+			return tunnel.ReplyError
+		}
+	}
+
 	message := &tunnel.WMessage{
 		TMessage: &tunnel.TMessage {
 			Tag:        tag,
@@ -95,6 +119,14 @@ func (controller *WriteController) Send(logs []*oplog.GenericOplog, tag uint32)
 		},
 		ParsedLogs: oplog.LogParsed(logs),
 	}
+	if controller.tunnel.AckRequired() {
+		message.Tag |= tunnel.MsgSequenced
+		message.Seq = seq
+	}
+	if txns := tunnel.TxnIndexes(message.ParsedLogs); len(txns) != 0 {
+		message.Tag |= tunnel.MsgTransaction
+		message.Txns = txns
+	}
 	for _, m := range controller.moduleList {
 		if internalCode := m.Handle(message); internalCode < 0 {
 			return internalCode
@@ -50,7 +50,7 @@ func (j *Journal) WriteRecord(oplog *oplog.PartialLog) {
 	switch SentinelOptions.OplogDump {
 	case JournalNothingOnDefault: // default. do nothing
 	case JournalSampling:
-		// object id will be sampled and all DDL oplog
+		// _id of any type will be sampled and all DDL oplog
 		if j.hasher.DistributeOplogByMod(oplog, SampleFrequency) != 0 {
 			break
 		}
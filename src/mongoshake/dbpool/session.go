@@ -1,6 +1,8 @@
 package dbpool
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	LOG "github.com/vinllen/log4go"
@@ -10,6 +12,12 @@ import (
 
 const OplogNS = "oplog.rs"
 
+// error codes of server
+const (
+	ErrNamespaceNotFound         = 26
+	ErrCommandNotSupportedOnView = 166
+)
+
 type MongoConn struct {
 	Session *mgo.Session
 	URL     string
@@ -76,23 +84,30 @@ func (conn *MongoConn) HasOplogNs() bool {
 	return false
 }
 
-func (conn *MongoConn) HasUniqueIndex() bool {
-	type NS struct {
-		Database   string
-		Collection string
-	}
+type NS struct {
+	Database   string
+	Collection string
+}
 
+func (ns NS) Str() string {
+	return ns.Database + "." + ns.Collection
+}
+
+// GetAllNamespaces returns all user collections in the server. admin, local
+// databases and system.profile collections are excluded
+func (conn *MongoConn) GetAllNamespaces() ([]NS, error) {
 	checkNs := make([]NS, 0, 128)
-	var databases []string
-	var err error
-	if databases, err = conn.Session.DatabaseNames(); err != nil {
-		LOG.Critical("Couldn't get databases from remote server %v", err)
-		return false
+	databases, err := conn.Session.DatabaseNames()
+	if err != nil {
+		return nil, err
 	}
 
 	for _, db := range databases {
 		if db != "admin" && db != "local" {
-			coll, _ := conn.Session.DB(db).CollectionNames()
+			coll, err := conn.Session.DB(db).CollectionNames()
+			if err != nil {
+				return nil, err
+			}
 			for _, c := range coll {
 				if c != "system.profile" {
 					// push all collections
@@ -101,17 +116,164 @@ func (conn *MongoConn) HasUniqueIndex() bool {
 			}
 		}
 	}
+	return checkNs, nil
+}
+
+// UniqueIndexNamespaces returns the namespaces having unique indexes
+func (conn *MongoConn) UniqueIndexNamespaces() (map[string]bool, error) {
+	checkNs, err := conn.GetAllNamespaces()
+	if err != nil {
+		return nil, err
+	}
 
+	namespaces := make(map[string]bool)
 	for _, ns := range checkNs {
-		indexes, _ := conn.Session.DB(ns.Database).C(ns.Collection).Indexes()
-		for _, idx := range indexes {
-			// has unique index
-			if idx.Unique {
-				LOG.Info("Found unique index %s on %s.%s in auto shard mode", idx.Name, ns.Database, ns.Collection)
-				return true
-			}
+		unique, err := conn.HasUniqueIndex(ns)
+		if err != nil {
+			return nil, err
+		}
+		if unique {
+			namespaces[ns.Str()] = true
 		}
 	}
+	return namespaces, nil
+}
 
-	return false
+// HasUniqueIndex returns whether the collection has unique index. it's false
+// if the collection doesn't exist
+func (conn *MongoConn) HasUniqueIndex(ns NS) (bool, error) {
+	indexes, err := conn.Session.DB(ns.Database).C(ns.Collection).Indexes()
+	if err != nil {
+		// views have no index
+		if e, ok := err.(*mgo.QueryError); ok &&
+			(e.Code == ErrNamespaceNotFound || e.Code == ErrCommandNotSupportedOnView) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, idx := range indexes {
+		// has unique index
+		if idx.Unique {
+			LOG.Info("Found unique index %s on %s in auto shard mode", idx.Name, ns.Str())
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetNewestOplogTimestamp returns the ts of the latest entry in local.oplog.rs
+func (conn *MongoConn) GetNewestOplogTimestamp() (bson.MongoTimestamp, error) {
+	var retMap map[string]interface{}
+	if err := conn.Session.DB("local").C(OplogNS).Find(bson.M{}).Sort("-$natural").Limit(1).One(&retMap); err != nil {
+		return 0, err
+	}
+	if ts, ok := retMap["ts"].(bson.MongoTimestamp); ok {
+		return ts, nil
+	}
+	return 0, fmt.Errorf("newest oplog ts type assertion error[%v]", retMap["ts"])
+}
+
+// GetOperationTime returns the operation time of source, which is the
+// newest oplog applied. no privilege on local database is needed. it's
+// returned since MongoDB 3.6
+func (conn *MongoConn) GetOperationTime() (bson.MongoTimestamp, error) {
+	var result struct {
+		OperationTime bson.MongoTimestamp `bson:"operationTime"`
+	}
+	if err := conn.Session.DB("admin").Run(bson.M{"ping": 1}, &result); err != nil {
+		return 0, err
+	}
+	if result.OperationTime == 0 {
+		return 0, fmt.Errorf("operation time isn't returned")
+	}
+	return result.OperationTime, nil
+}
+
+// CollectionSpec describes a collection or a view returned by listCollections
+type CollectionSpec struct {
+	NS      NS
+	Type    string
+	Options bson.D
+}
+
+func (spec *CollectionSpec) IsView() bool {
+	return spec.Type == "view"
+}
+
+type commandCursor struct {
+	FirstBatch []bson.Raw `bson:"firstBatch"`
+	NS         string     `bson:"ns"`
+	Id         int64      `bson:"id"`
+}
+
+// iterCursor returns the iterator of cursor returned by command. the session
+// should be in non eventual mode so that getMore goes to the same server
+func iterCursor(session *mgo.Session, database string, cursor *commandCursor) *mgo.Iter {
+	ns := strings.SplitN(cursor.NS, ".", 2)
+	if len(ns) < 2 {
+		ns = []string{database, ""}
+	}
+	return session.DB(ns[0]).C(ns[1]).NewIter(nil, cursor.FirstBatch, cursor.Id, nil)
+}
+
+// GetCollectionSpecs returns specs of all the collections and views in the
+// database. options are kept in the original order
+func (conn *MongoConn) GetCollectionSpecs(database string) ([]*CollectionSpec, error) {
+	session := conn.Session.Copy()
+	defer session.Close()
+	session.SetMode(mgo.Monotonic, true)
+
+	var result struct {
+		Cursor commandCursor `bson:"cursor"`
+	}
+	if err := session.DB(database).Run(bson.D{{"listCollections", 1}}, &result); err != nil {
+		return nil, err
+	}
+
+	var specs []*CollectionSpec
+	var spec struct {
+		Name    string `bson:"name"`
+		Type    string `bson:"type"`
+		Options bson.D `bson:"options"`
+	}
+	iter := iterCursor(session, database, &result.Cursor)
+	for iter.Next(&spec) {
+		specs = append(specs, &CollectionSpec{
+			NS:      NS{Database: database, Collection: spec.Name},
+			Type:    spec.Type,
+			Options: spec.Options,
+		})
+		spec.Type, spec.Options = "", nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// GetIndexSpecs returns all the index definitions of the collection. fields
+// like "key" are kept in the original order
+func (conn *MongoConn) GetIndexSpecs(ns NS) ([]bson.D, error) {
+	session := conn.Session.Copy()
+	defer session.Close()
+	session.SetMode(mgo.Monotonic, true)
+
+	var result struct {
+		Cursor commandCursor `bson:"cursor"`
+	}
+	if err := session.DB(ns.Database).Run(bson.D{{"listIndexes", ns.Collection}}, &result); err != nil {
+		return nil, err
+	}
+
+	var specs []bson.D
+	var spec bson.D
+	iter := iterCursor(session, ns.Database, &result.Cursor)
+	for iter.Next(&spec) {
+		specs = append(specs, spec)
+		spec = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return specs, nil
 }
@@ -1,15 +1,12 @@
 package executor
 
 import (
-	"bytes"
-	"fmt"
-	"reflect"
 	"strings"
+	"sync"
 
 	"mongoshake/oplog"
 
 	LOG "github.com/vinllen/log4go"
-	"github.com/gugemichael/nimo4go"
 	"github.com/vinllen/mgo/bson"
 )
 
@@ -19,9 +16,27 @@ type OplogRecord struct {
 	original *PartialLogWithCallbak
 
 	// wait() procedure will stop to wait for the dependent OplogRecord
-	// that operate the equivalent index values ahead of the this one
-	// we would insert sync mutex here !
+	// that operate the equivalent index values ahead of the this one.
+	// it's invoked before this one executed
 	wait func()
+
+	// the records ahead of this one operating the same _id or unique index
+	// values. generated by BarrierMatrix
+	dependencies []*OplogRecord
+	// executor selected
+	selected uint32
+	// closed after executed if any record in other executors waits for it
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// finish wakes up the records waiting for this one
+func (record *OplogRecord) finish() {
+	if record.done != nil {
+		record.doneOnce.Do(func() {
+			close(record.done)
+		})
+	}
 }
 
 type CollisionMatrix interface {
@@ -46,21 +61,6 @@ func (noop *NoopMatrix) convert(segment []*PartialLogWithCallbak) []*OplogRecord
 	return records
 }
 
-type OplogUniqueIdentifier struct {
-	signatureTable []string
-
-	// sequence id. order by oplogs timing
-	order int
-
-	// key is unique index column name. value is index values
-	operations map[string]interface{}
-}
-
-func (oplogUniqueIdentifier *OplogUniqueIdentifier) addSignature(signature string) {
-	// for every field. sum name and value signature value
-	oplogUniqueIdentifier.signatureTable = append(oplogUniqueIdentifier.signatureTable, signature)
-}
-
 func fillupOperationValues(log *PartialLogWithCallbak) {
 	if log.partialLog.Operation != "i" && log.partialLog.Operation != "u" {
 		return
@@ -136,248 +136,169 @@ func fillupOperationValues(log *PartialLogWithCallbak) {
 	}
 }
 
-func newUniqueIdentifier(order int, log *PartialLogWithCallbak) *OplogUniqueIdentifier {
-	nimo.AssertTrue(len(log.partialLog.UniqueIndexes) != 0, "make identifier of empty indexes wrong")
-
-	// first of all, we need to fill up the oplog.uk colum field
-	// if the operation is equal to "i","u"
-	fillupOperationValues(log)
-
-	// construct identifier
-	identifier := &OplogUniqueIdentifier{}
-	identifier.order = order
-	for columnName, columnValue := range log.partialLog.UniqueIndexes {
-		// if column value is an array of sub values. the size of array should be exactly equals
-		// for MongoDB same index. so we don't counting the size of array into "signature"
-		identifier.addSignature(fmt.Sprintf("%f", calculateSignature(columnName)+calculateSignature(columnValue)))
-	}
+// BarrierMatrix builds the dependency graph of oplogs. An oplog depends on
+// the previous ones operating the same _id or unique index values, and a
+// command depends on all the previous oplogs and is depended by all the
+// following ones. The values removed by delete and update are unknown, so
+// they depend on all the previous writers of the unique indexes affected and
+// are depended by the following ones. The oplogs wait for the ones they
+// depend on only, so the unrelated ones are executed concurrently
+type BarrierMatrix struct {
+	NoopMatrix
 
-	// for update only
-	if log.partialLog.Operation == "u" {
-		for columnName, columnValue := range log.partialLog.UniqueIndexesUpdates {
-			identifier.addSignature(fmt.Sprintf("%f", calculateSignature(columnName)+calculateSignature(columnValue)))
-		}
-	}
+	//	original []*PartialLogWithCallbak
 
-	identifier.operations = log.partialLog.UniqueIndexes
-	return identifier
+	// target mongo url. the unique indexes of oplogs without "uk" are
+	// loaded from it
+	url string
 }
 
-func calculateSignature(object interface{}) (sign float64) {
-	if object == nil {
-		// prime number. different from boolean
-		return 3
-	}
-
-	switch o := object.(type) {
-	case bson.M: // recursive
-		for k, v := range o {
-			sign += calculateSignature(k)
-			sign += calculateSignature(v)
-		}
-	case []interface{}: // recursive
-		for _, v := range o {
-			sign += calculateSignature(v)
-		}
-	case bson.Binary: // byte array
-		for _, c := range o.Data {
-			// consult from Java String.hashcode()
-			sign = 31.0*sign + float64(c)
-		}
-	case string:
-		for _, c := range o {
-			// consult from Java String.hashcode()
-			sign = 31.0*sign + float64(c)
-		}
-	case []byte:
-		for _, c := range o {
-			// consult from Java String.hashcode()
-			sign = 31.0*sign + float64(c)
-		}
-	case bson.MongoTimestamp: // numbers
-		sign = float64(o)
-	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64:
-		if v, ok := object.(float64); ok {
-			sign = float64(v)
-		}
+func NewBarrierMatrix(url string) *BarrierMatrix {
+	return &BarrierMatrix{NoopMatrix: NoopMatrix{}, url: url}
+}
 
-	case bool: // boolean
-		sign++
-		if o {
-			sign++
-		}
-	default:
-		nimo.Assert(fmt.Sprintf("bson value signature type is not recognized [%d, %s]", reflect.TypeOf(object).Kind(),
-			reflect.TypeOf(object).Name()))
-		LOG.Critical("Bson value signature type is not recognized [%d, %s]", reflect.TypeOf(object).Kind(),
-			reflect.TypeOf(object).Name())
-
-		// default value represents may be conflict. the signature is unsafe. just speed up !
-		// so simply sum zero value here
-		return 0
+// split keeps the whole batch in one segment. the order is kept by the
+// dependencies built in convert
+func (barrier *BarrierMatrix) split(logs []*PartialLogWithCallbak) [][]*PartialLogWithCallbak {
+	for _, log := range logs {
+		uniqueIndexCache.observe(barrier.url, log.partialLog)
+		uniqueIndexCache.fillup(barrier.url, log)
 	}
-
-	return sign
+	return [][]*PartialLogWithCallbak{logs}
 }
 
-func ExactlyMatch(first, second interface{}) bool {
-	if (first != nil && second == nil) || (first == nil && second != nil) ||
-		reflect.TypeOf(first).Kind() != reflect.TypeOf(second).Kind() {
-		return false
-	}
+// dependencyKey identifies the _id or unique index values operated. the
+// values are hashed and the collision only adds a needless dependency
+type dependencyKey struct {
+	namespace string
+	index     string
+	value     uint32
+}
 
-	// both of them are null is accept
-	if first == nil && second == nil {
-		return true
-	}
+// uniqueIndex identifies the unique index whose values are operated
+type uniqueIndex struct {
+	namespace string
+	index     string
+}
 
-	switch o := first.(type) {
-	case bson.M: // recursive
-		for key := range o {
-			if v, ok := second.(map[string]interface{}); ok && !ExactlyMatch(o[key], v[key]) {
-				return false
-			}
-		}
-	case []interface{}: // recursive
-		if v, ok := second.([]interface{}); ok {
-			if len(o) != len(v) {
-				return false
-			}
+func (barrier *BarrierMatrix) convert(segment []*PartialLogWithCallbak) []*OplogRecord {
+	records := barrier.NoopMatrix.convert(segment)
+
+	// the last record operating the key
+	lastWriters := make(map[dependencyKey]*OplogRecord)
+	// the values of unique index removed by delete or update are unknown.
+	// such a record depends on all the writers of the index since the last
+	// such one and the following writers depend on it
+	indexWriters := make(map[uniqueIndex][]*OplogRecord)
+	indexBarriers := make(map[uniqueIndex]*OplogRecord)
+	var lastCommand *OplogRecord
+	var sinceCommand []*OplogRecord
+	dependencies := 0
+	for _, record := range records {
+		log := record.original.partialLog
+		if log.Operation == "n" {
+			continue
 		}
-		for i := range o {
-			if v, ok := second.([]interface{}); ok && !ExactlyMatch(o[i], v[i]) {
-				return false
+		if log.Operation == "c" || strings.HasSuffix(log.Namespace, ".system.indexes") {
+			// the previous records depend on the last command already
+			record.dependencies = sinceCommand
+			if len(sinceCommand) == 0 && lastCommand != nil {
+				record.dependencies = []*OplogRecord{lastCommand}
 			}
+			dependencies += len(record.dependencies)
+			lastCommand, sinceCommand = record, nil
+			lastWriters = make(map[dependencyKey]*OplogRecord)
+			indexWriters = make(map[uniqueIndex][]*OplogRecord)
+			indexBarriers = make(map[uniqueIndex]*OplogRecord)
+			continue
 		}
-	case []byte: // byte array
-		if v, ok := second.([]byte); ok {
-			return bytes.Compare(o, v) == 0
-		}
-	case bson.Binary:
-		if v, ok := second.(bson.Binary); ok {
-			return bytes.Compare(o.Data, v.Data) == 0
-		}
-	case string:
-		if v, ok := second.(string); ok {
-			return o == v
-		}
-	case bson.MongoTimestamp: // numbers
-		if v, ok := second.(bson.MongoTimestamp); ok {
-			return uint64(o) == uint64(v)
+
+		if lastCommand != nil {
+			record.dependencies = append(record.dependencies, lastCommand)
 		}
-	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64:
-		if v1, ok := first.(float64); ok {
-			if v2, ok := second.(float64); ok {
-				return v1 == v2
+		keys, unknown := barrier.dependencyKeys(record.original)
+		for _, index := range unknown {
+			writers := indexWriters[index]
+			if len(writers) == 0 {
+				// the writers before depend on it already
+				writers = []*OplogRecord{indexBarriers[index]}
 			}
+			for _, writer := range writers {
+				addDependency(record, writer)
+			}
+			indexBarriers[index], indexWriters[index] = record, nil
 		}
-	case bool: // boolean
-		if v, ok := second.(bool); ok {
-			return o == v
+		for _, key := range keys {
+			addDependency(record, lastWriters[key])
+			lastWriters[key] = record
+			if key.index != "_id" {
+				index := uniqueIndex{namespace: key.namespace, index: key.index}
+				addDependency(record, indexBarriers[index])
+				indexWriters[index] = append(indexWriters[index], record)
+			}
 		}
-	default:
-		nimo.Assert(fmt.Sprintf("bson value check similar. not recognized [%s]", reflect.TypeOf(first).Name()))
-		LOG.Critical("bson value check similar. not recognized [%s]", reflect.TypeOf(first).Name())
+		dependencies += len(record.dependencies)
+		sinceCommand = append(sinceCommand, record)
 	}
 
-	// TODO: execute path may be walked from DEFAULT we meet something that the type
-	// we don't know now. for safety, we treat these oplogs' unique indexes as equal exactly !!
-	// This may cause more segments splitted but more safe.
-	return true
+	LOG.Info("Barrier matrix build %d dependencies among %d oplogs", dependencies, len(records))
+	return records
 }
 
-func intersectionInOrder(one bson.M, other bson.M) bool {
-	// TODO: BSON's object or array is already sorted ?! we can get the intersection more easier
-	// BUT for now. we don't make such assumption. so make it simple, we iterate every field
-	// in Map. and compare to another
-	for k1, v1 := range one {
-		if v2, exist := other[k1]; exist {
-			return ExactlyMatch(v1, v2)
-		}
+// addDependency makes record depend on other if it doesn't yet
+func addDependency(record, other *OplogRecord) {
+	if other != nil && other != record && !dependsOn(record, other) {
+		record.dependencies = append(record.dependencies, other)
 	}
-	return false
 }
 
-func intersection(this bson.M, other bson.M) bool {
-	if len(this) == 0 || len(other) == 0 {
-		return false
+func dependsOn(record, other *OplogRecord) bool {
+	for _, dependency := range record.dependencies {
+		if dependency == other {
+			return true
+		}
 	}
-
-	// compare each other
-	return intersectionInOrder(this, other) || intersectionInOrder(other, this)
+	return false
 }
 
-func haveMutualIndex(first, second *oplog.PartialLog) bool {
-	if first == second {
-		return false
+// dependencyKeys returns the keys of _id and unique index values operated,
+// and the unique indexes whose values operated are unknown. they are the
+// values removed by delete and update if "uk" isn't given
+func (barrier *BarrierMatrix) dependencyKeys(log *PartialLogWithCallbak) ([]dependencyKey, []uniqueIndex) {
+	partialLog := log.partialLog
+	var keys []dependencyKey
+	var unknown []uniqueIndex
+	if id := oplog.GetIdOrNSFromOplog(partialLog); id != nil {
+		keys = append(keys, dependencyKey{namespace: partialLog.Namespace, index: "_id", value: oplog.Hash(id)})
 	}
 
-	var firstId, secondId bson.ObjectId
-	var got bool
-	firstId, got = oplog.GetIdOrNSFromOplog(first).(bson.ObjectId)
-	secondId, got = oplog.GetIdOrNSFromOplog(second).(bson.ObjectId)
-
-	if got && firstId.Hex() == secondId.Hex() {
-		// oplogs operate the single MongoDB record. they should be serialized by executor
-		return false
+	if partialLog.Operation == "d" && len(partialLog.UniqueIndexes) == 0 &&
+		!strings.Contains(partialLog.Namespace, ".system.") {
+		// the document deleted may have any value of every unique index
+		for _, index := range uniqueIndexCache.get(barrier.url, partialLog.Namespace) {
+			unknown = append(unknown, uniqueIndex{namespace: partialLog.Namespace, index: index})
+		}
+		return keys, unknown
 	}
-
-	// unified approach for insert, update, delete
-	return intersection(first.UniqueIndexes, second.UniqueIndexes) ||
-		intersection(first.UniqueIndexes, second.UniqueIndexesUpdates) ||
-		intersection(first.UniqueIndexesUpdates, second.UniqueIndexes) ||
-		intersection(first.UniqueIndexesUpdates, second.UniqueIndexesUpdates)
-}
-
-// BarrierMatrix only split oplogs into segments. without convert stage stage.
-type BarrierMatrix struct {
-	NoopMatrix
-
-	//	original []*PartialLogWithCallbak
-}
-
-func NewBarrierMatrix() *BarrierMatrix {
-	return &BarrierMatrix{NoopMatrix{}}
-}
-
-func (*BarrierMatrix) split(logs []*PartialLogWithCallbak) [][]*PartialLogWithCallbak {
-	var segmentList [][]*PartialLogWithCallbak
-	var seg []*PartialLogWithCallbak
-	var identifier *OplogUniqueIdentifier
-	signatureSet := make(map[string][]*PartialLogWithCallbak)
-	for i, log := range logs {
-		// put the log into segment straightly if no unique index operations found
-		if len(log.partialLog.UniqueIndexes) != 0 {
-			identifier = newUniqueIdentifier(i, log)
-			for _, current := range identifier.signatureTable {
-				if potentialCandidates, exist := signatureSet[current]; exist {
-					// found possible conflict keys
-					for _, candidate := range potentialCandidates {
-						// candidate and the "log" may be the same one !
-						if haveMutualIndex(candidate.partialLog, log.partialLog) {
-							// add this signature to duplication list
-							segmentList = append(segmentList, seg)
-							seg = nil
-							break
-						}
-					}
-					LOG.Warn("Logs have same identifier signature. but don't exactly match. signature : %s", current)
-				}
-				signatureSet[current] = append(signatureSet[current], log)
-			}
+	if len(partialLog.UniqueIndexes) == 0 {
+		return keys, nil
+	}
+	// fill up the oplog.uk column field if the operation is "i" or "u"
+	fillupOperationValues(log)
+	for index, value := range partialLog.UniqueIndexes {
+		// the value before update is unknown if "uk" is computed
+		if value == nil {
+			unknown = append(unknown, uniqueIndex{namespace: partialLog.Namespace, index: index})
+		} else {
+			keys = append(keys, dependencyKey{namespace: partialLog.Namespace, index: index,
+				value: oplog.Hash(value)})
 		}
-
-		seg = append(seg, log)
 	}
-
-	if len(seg) != 0 {
-		segmentList = append(segmentList, seg)
+	for index, value := range partialLog.UniqueIndexesUpdates {
+		if value != nil {
+			keys = append(keys, dependencyKey{namespace: partialLog.Namespace, index: index,
+				value: oplog.Hash(value)})
+		}
 	}
-
-	LOG.Info("Barrier matrix split vector to length %d", len(segmentList))
-	return segmentList
-}
-
-func (barrier *BarrierMatrix) convert(segment []*PartialLogWithCallbak) []*OplogRecord {
-	return barrier.NoopMatrix.convert(segment)
+	return keys, unknown
 }
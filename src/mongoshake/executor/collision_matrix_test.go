@@ -0,0 +1,169 @@
+package executor
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func TestBarrierMatrixConvert(t *testing.T) {
+	cached := uniqueIndexCache.indexes
+	uniqueIndexCache.indexes = map[string][]string{
+		"db.c": {"a", "b|c"},
+		"db.n": {},
+	}
+	defer func() { uniqueIndexCache.indexes = cached }()
+
+	insert := func(ns string, object bson.M) *oplog.PartialLog {
+		return &oplog.PartialLog{Operation: "i", Namespace: ns, Object: object}
+	}
+	update := func(ns string, query, object bson.M) *oplog.PartialLog {
+		return &oplog.PartialLog{Operation: "u", Namespace: ns, Query: query, Object: object}
+	}
+	remove := func(ns string, object bson.M) *oplog.PartialLog {
+		return &oplog.PartialLog{Operation: "d", Namespace: ns, Object: object}
+	}
+
+	tests := []struct {
+		name string
+		logs []*oplog.PartialLog
+		// the indexes of records each record depends on
+		dependencies [][]int
+	}{
+		{
+			name: "different values",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1, "a": 1}),
+				insert("db.c", bson.M{"_id": 2, "a": 2}),
+			},
+			dependencies: [][]int{nil, nil},
+		},
+		{
+			name: "same _id",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1}),
+				update("db.c", bson.M{"_id": 1}, bson.M{"$set": bson.M{"x": 1}}),
+				remove("db.n", bson.M{"_id": 1}),
+			},
+			dependencies: [][]int{nil, {0}, nil},
+		},
+		{
+			name: "same unique value",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1, "a": 1}),
+				insert("db.c", bson.M{"_id": 2, "a": 1}),
+				insert("db.c", bson.M{"_id": 3, "b": 1, "c": 1}),
+				insert("db.c", bson.M{"_id": 4, "b": 1, "c": 1}),
+			},
+			dependencies: [][]int{nil, {0}, nil, {2}},
+		},
+		{
+			name: "delete",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1, "a": 1}),
+				insert("db.c", bson.M{"_id": 2, "b": 2, "c": 2}),
+				insert("db.c", bson.M{"_id": 3}),
+				remove("db.c", bson.M{"_id": 4}),
+				insert("db.c", bson.M{"_id": 5, "a": 1}),
+				insert("db.c", bson.M{"_id": 6, "b": 3}),
+				insert("db.c", bson.M{"_id": 7}),
+			},
+			dependencies: [][]int{nil, nil, nil, {0, 1}, {0, 3}, {3}, nil},
+		},
+		{
+			name: "deletes",
+			logs: []*oplog.PartialLog{
+				remove("db.c", bson.M{"_id": 1}),
+				remove("db.c", bson.M{"_id": 2}),
+				insert("db.c", bson.M{"_id": 3, "a": 1}),
+				insert("db.c", bson.M{"_id": 4, "a": 2}),
+				remove("db.c", bson.M{"_id": 5}),
+			},
+			dependencies: [][]int{nil, {0}, {1}, {1}, {1, 2, 3}},
+		},
+		{
+			name: "update of unique column",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1, "a": 1}),
+				insert("db.c", bson.M{"_id": 2, "b": 1, "c": 1}),
+				update("db.c", bson.M{"_id": 3}, bson.M{"$set": bson.M{"a": 5}}),
+				insert("db.c", bson.M{"_id": 4, "a": 1}),
+				insert("db.c", bson.M{"_id": 5, "a": 5}),
+				insert("db.c", bson.M{"_id": 6, "b": 2, "c": 2}),
+			},
+			dependencies: [][]int{nil, nil, {0}, {0, 2}, {2}, nil},
+		},
+		{
+			name: "update of other columns",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1, "a": 1}),
+				update("db.c", bson.M{"_id": 2}, bson.M{"$set": bson.M{"x": 1}}),
+				insert("db.c", bson.M{"_id": 3, "a": 2}),
+			},
+			dependencies: [][]int{nil, nil, nil},
+		},
+		{
+			name: "replacement",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1, "a": 1}),
+				insert("db.c", bson.M{"_id": 2, "b": 1, "c": 1}),
+				update("db.c", bson.M{"_id": 3}, bson.M{"_id": 3, "x": 1}),
+				insert("db.c", bson.M{"_id": 4, "b": 2}),
+			},
+			dependencies: [][]int{nil, nil, {0, 1}, {2}},
+		},
+		{
+			name: "no unique index",
+			logs: []*oplog.PartialLog{
+				insert("db.n", bson.M{"_id": 1, "a": 1}),
+				remove("db.n", bson.M{"_id": 2}),
+				insert("db.n", bson.M{"_id": 3, "a": 1}),
+				remove("db.c", bson.M{"_id": 2}),
+			},
+			dependencies: [][]int{nil, nil, nil, nil},
+		},
+		{
+			name: "command",
+			logs: []*oplog.PartialLog{
+				insert("db.c", bson.M{"_id": 1, "a": 1}),
+				remove("db.c", bson.M{"_id": 2}),
+				{Operation: "c", Namespace: "db.$cmd", Object: bson.M{"create": "d"}},
+				insert("db.c", bson.M{"_id": 3, "a": 1}),
+				remove("db.c", bson.M{"_id": 4}),
+			},
+			dependencies: [][]int{nil, {0}, {0, 1}, {2}, {2, 3}},
+		},
+	}
+
+	barrier := NewBarrierMatrix("")
+	for _, test := range tests {
+		logs := make([]*PartialLogWithCallbak, len(test.logs))
+		for i, log := range test.logs {
+			logs[i] = &PartialLogWithCallbak{partialLog: log}
+		}
+		segments := barrier.split(logs)
+		if len(segments) != 1 {
+			t.Fatalf("%s: split into %d segments", test.name, len(segments))
+		}
+		records := barrier.convert(segments[0])
+
+		position := make(map[*OplogRecord]int, len(records))
+		for i, record := range records {
+			position[record] = i
+		}
+		for i, record := range records {
+			var dependencies []int
+			for _, dependency := range record.dependencies {
+				dependencies = append(dependencies, position[dependency])
+			}
+			sort.Ints(dependencies)
+			if !reflect.DeepEqual(dependencies, test.dependencies[i]) {
+				t.Errorf("%s: record %d depends on %v, should be %v", test.name, i, dependencies, test.dependencies[i])
+			}
+		}
+	}
+}
@@ -184,7 +184,7 @@ func (cw *CommandWriter) doCommand(database string, metadata bson.M, oplogs []*O
 	var err error
 	for _, log := range oplogs {
 		operation, found := extraCommandName(log.original.partialLog.Object)
-		if !conf.Options.ReplayerDMLOnly || (found && isSyncDataCommand(operation)) {
+		if replayCommand(log.original.partialLog, operation, found) {
 			// execute one by one with sequence order
 			if err = cw.applyOps(database, metadata, []*oplog.PartialLog{log.original.
 				partialLog}); err == nil {
@@ -342,10 +342,12 @@ func (bw *BulkWriter) doCommand(database string, metadata bson.M, oplogs []*Oplo
 	var err error
 	for _, log := range oplogs {
 		operation, found := extraCommandName(log.original.partialLog.Object)
-		if !conf.Options.ReplayerDMLOnly || (found && isSyncDataCommand(operation)) {
+		if replayCommand(log.original.partialLog, operation, found) {
 			// execute one by one with sequence order
 			if err = bw.applyOps(database, operation, log.original.partialLog); err == nil {
 				LOG.Info("Execute command (op==c) oplog dml_only mode [%t], operation [%s]", conf.Options.ReplayerDMLOnly, operation)
+			} else if metaErrorIgnore(log.original.partialLog, err) {
+				LOG.Info("Discard known error of meta command [%s]. %v", operation, err)
 			} else {
 				return err
 			}
@@ -382,13 +384,10 @@ func (bw *BulkWriter) applyOps(database, operation string, log *oplog.PartialLog
 	case "convertToCapped":
 		fallthrough
 	case "emptycapped":
-		// convert bson.M to bson.D
-		var store bson.D
-		for key, value := range log.Object {
-			store = append(store, bson.DocElem{Name: key, Value: value})
-		}
 		// call Run()
-		err = dbHandle.Run(store, nil)
+		err = dbHandle.Run(commandDocument(operation, commandObject(log)), nil)
+	case "createIndexes":
+		err = dbHandle.Run(createIndexesDocument(commandObject(log)), nil)
 	default:
 		LOG.Info("applyOps meets type[%s] which is not implemented", operation)
 	}
@@ -555,10 +554,12 @@ func (sw *SingleWriter) doCommand(database string, metadata bson.M, oplogs []*Op
 	var err error
 	for _, log := range oplogs {
 		operation, found := extraCommandName(log.original.partialLog.Object)
-		if !conf.Options.ReplayerDMLOnly || (found && isSyncDataCommand(operation)) {
+		if replayCommand(log.original.partialLog, operation, found) {
 			// execute one by one with sequence order
 			if err = sw.applyOps(database, operation, log.original.partialLog); err == nil {
 				LOG.Info("Execute command (op==c) oplog dml_only mode [%t], operation [%s]", conf.Options.ReplayerDMLOnly, operation)
+			} else if metaErrorIgnore(log.original.partialLog, err) {
+				LOG.Info("Discard known error of meta command [%s]. %v", operation, err)
 			} else {
 				return err
 			}
@@ -595,13 +596,10 @@ func (sw *SingleWriter) applyOps(database, operation string, log *oplog.PartialL
 	case "convertToCapped":
 		fallthrough
 	case "emptycapped":
-		// convert bson.M to bson.D
-		var store bson.D
-		for key, value := range log.Object {
-			store = append(store, bson.DocElem{Name: key, Value: value})
-		}
 		// call Run()
-		err = dbHandle.Run(store, nil)
+		err = dbHandle.Run(commandDocument(operation, commandObject(log)), nil)
+	case "createIndexes":
+		err = dbHandle.Run(createIndexesDocument(commandObject(log)), nil)
 	default:
 		LOG.Info("applyOps meets type[%s] which is not implemented", operation)
 	}
@@ -609,6 +607,56 @@ func (sw *SingleWriter) applyOps(database, operation string, log *oplog.PartialL
 	return err
 }
 
+// commandObject returns the object of command oplog in the order of source.
+// the order matters to the command name and the keys of index
+func commandObject(log *oplog.PartialLog) bson.D {
+	if log.Raw != nil {
+		var entry struct {
+			Object bson.D `bson:"o"`
+		}
+		err := bson.Unmarshal(log.Raw, &entry)
+		if err == nil {
+			return entry.Object
+		}
+		LOG.Warn("Parse command object in order failed. %v", err)
+	}
+
+	object := make(bson.D, 0, len(log.Object))
+	for key, value := range log.Object {
+		object = append(object, bson.DocElem{Name: key, Value: value})
+	}
+	return object
+}
+
+// commandDocument moves the command name to the first field. otherwise
+// options like "capped" will be taken as command
+func commandDocument(operation string, object bson.D) bson.D {
+	store := bson.D{{operation, nil}}
+	for _, field := range object {
+		if field.Name == operation {
+			store[0].Value = field.Value
+		} else {
+			store = append(store, field)
+		}
+	}
+	return store
+}
+
+// createIndexesDocument converts the createIndexes oplog of one index into
+// the command. the fields except the collection are the index spec
+func createIndexesDocument(object bson.D) bson.D {
+	var collection interface{}
+	index := bson.D{}
+	for _, field := range object {
+		if field.Name == "createIndexes" {
+			collection = field.Value
+		} else {
+			index = append(index, field)
+		}
+	}
+	return bson.D{{"createIndexes", collection}, {"indexes", []bson.D{index}}}
+}
+
 func HandleDuplicated(collection *mgo.Collection, records []*OplogRecord, op int8) {
 	for _, record := range records {
 		log := record.original.partialLog
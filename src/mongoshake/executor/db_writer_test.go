@@ -0,0 +1,100 @@
+package executor
+
+import (
+	"reflect"
+	"testing"
+
+	"mongoshake/collector/configure"
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func newCommandLog(t *testing.T, object bson.D) *oplog.PartialLog {
+	raw, err := bson.Marshal(bson.D{{"ts", bson.MongoTimestamp(1)}, {"op", "c"}, {"ns", "db.$cmd"}, {"o", object}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := new(oplog.PartialLog)
+	if err := bson.Unmarshal(raw, log); err != nil {
+		t.Fatal(err)
+	}
+	log.Raw = raw
+	return log
+}
+
+func TestCommandDocument(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		object    bson.D
+		expected  bson.D
+	}{
+		{
+			name:      "create",
+			operation: "create",
+			object:    bson.D{{"create", "c"}, {"capped", true}, {"size", 1024}, {"max", 10}},
+			expected:  bson.D{{"create", "c"}, {"capped", true}, {"size", 1024}, {"max", 10}},
+		},
+		{
+			name:      "command name not first",
+			operation: "collMod",
+			object: bson.D{{"validator", bson.D{{"b", bson.D{{"$gt", 1}}}, {"a", 1}}},
+				{"collMod", "c"}, {"validationLevel", "strict"}},
+			expected: bson.D{{"collMod", "c"}, {"validator", bson.D{{"b", bson.D{{"$gt", 1}}}, {"a", 1}}},
+				{"validationLevel", "strict"}},
+		},
+	}
+	for _, test := range tests {
+		document := commandDocument(test.operation, commandObject(newCommandLog(t, test.object)))
+		if !reflect.DeepEqual(document, test.expected) {
+			t.Errorf("%s: command is %v, should be %v", test.name, document, test.expected)
+		}
+	}
+}
+
+func TestCreateIndexesDocument(t *testing.T) {
+	log := newCommandLog(t, bson.D{{"createIndexes", "c"}, {"v", 2}, {"key", bson.D{{"b", 1}, {"a", -1}}},
+		{"name", "b_1_a_-1"}, {"unique", true}})
+	expected := bson.D{{"createIndexes", "c"}, {"indexes", []bson.D{{{"v", 2}, {"key", bson.D{{"b", 1}, {"a", -1}}},
+		{"name", "b_1_a_-1"}, {"unique", true}}}}}
+	if document := createIndexesDocument(commandObject(log)); !reflect.DeepEqual(document, expected) {
+		t.Errorf("command is %v, should be %v", document, expected)
+	}
+
+	// the order of fields is unknown without raw. the command name is first
+	log.Raw = nil
+	document := createIndexesDocument(commandObject(log))
+	if len(document) != 2 || document[0].Name != "createIndexes" || document[0].Value != "c" {
+		t.Errorf("command is %v", document)
+	}
+	if indexes, ok := document[1].Value.([]bson.D); !ok || len(indexes) != 1 || len(indexes[0]) != 4 {
+		t.Errorf("indexes are %v", document[1].Value)
+	}
+}
+
+func TestReplayCommandDMLOnly(t *testing.T) {
+	dmlOnly := conf.Options.ReplayerDMLOnly
+	defer func() { conf.Options.ReplayerDMLOnly = dmlOnly }()
+
+	tests := []struct {
+		name    string
+		log     *oplog.PartialLog
+		dmlOnly bool
+		replay  bool
+	}{
+		{"create", &oplog.PartialLog{Object: bson.M{"create": "c"}}, true, false},
+		{"createIndexes", &oplog.PartialLog{Object: bson.M{"createIndexes": "c"}}, true, false},
+		{"drop", &oplog.PartialLog{Object: bson.M{"drop": "c"}}, false, true},
+		{"applyOps", &oplog.PartialLog{Object: bson.M{"applyOps": []interface{}{}}}, true, true},
+		{"meta create", &oplog.PartialLog{Object: bson.M{"create": "c"}, Meta: true}, true, true},
+		{"meta createIndexes", &oplog.PartialLog{Object: bson.M{"createIndexes": "c"}, Meta: true}, true, true},
+	}
+	for _, test := range tests {
+		conf.Options.ReplayerDMLOnly = test.dmlOnly
+		operation, found := extraCommandName(test.log.Object)
+		if replay := replayCommand(test.log, operation, found); replay != test.replay {
+			t.Errorf("%s: replay is %v in dml_only %v", test.name, replay, test.dmlOnly)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	LOG "github.com/vinllen/log4go"
 	"github.com/gugemichael/nimo4go"
 	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
 )
 
 const (
@@ -45,6 +46,8 @@ type BatchGroupExecutor struct {
 	ReplayerId uint32
 	// mongo url
 	MongoUrl string
+	// distribute oplogs to executors
+	hasher oplog.Hasher
 }
 
 func (batchExecutor *BatchGroupExecutor) Start() {
@@ -54,6 +57,18 @@ func (batchExecutor *BatchGroupExecutor) Start() {
 	// is bigger we will use single executer in respective batchExecutor
 	parallel := conf.Options.ReplayerExecutor
 	executors := make([]*Executor, parallel)
+	// distributed by _id. or by the field like collector so that the
+	// documents having the same value are still executed in order
+	batchExecutor.hasher = &oplog.PrimaryKeyHasher{}
+	if conf.Options.ShardKey == oplog.ShardByField {
+		// it's validated already
+		hasher, err := oplog.NewFieldHasher(conf.Options.ShardKeyFields)
+		if err != nil {
+			LOG.Critical("Executor create field hasher failed. %v", err)
+		} else {
+			batchExecutor.hasher = hasher
+		}
+	}
 	for i := 0; i != len(executors); i++ {
 		executors[i] = NewExecutor(GenerateExecutorId(), batchExecutor, batchExecutor.MongoUrl)
 		go executors[i].start()
@@ -96,21 +111,47 @@ func (batchExecutor *BatchGroupExecutor) replay(logs []*PartialLogWithCallbak) {
 	// unique index without collision detection
 	var matrix CollisionMatrix = &NoopMatrix{}
 	if conf.Options.ReplayerCollisionEnable {
-		matrix = NewBarrierMatrix()
+		matrix = NewBarrierMatrix(batchExecutor.MongoUrl)
 	}
 
-	// firstly. we split the oplogRecords into segments which are the unit
-	// of safety execution. it means there is no any operations
-	// on the safe unique index in the single segment.
-	var segments = matrix.split(logs)
-	// secondly. in each segment, we analyze the dependence between
-	// each oplogRecords. And
-	for _, segment := range segments {
-		toBeExecuted := matrix.convert(segment)
-		batchExecutor.executeInParallel(toBeExecuted)
+	for _, unit := range splitTransactions(logs) {
+		if unit[0].partialLog.Txn && conf.Options.TransactionAtomic {
+			// transaction is executed by single executor. the oplogs before
+			// and after it are executed separately
+			batchExecutor.executeInParallel(new(NoopMatrix).convert(unit))
+			continue
+		}
+
+		// firstly. we split the oplogRecords into segments which are the unit
+		// of safety execution. it means there is no any operations
+		// on the safe unique index in the single segment.
+		var segments = matrix.split(unit)
+		// secondly. in each segment, we analyze the dependence between
+		// each oplogRecords. And
+		for _, segment := range segments {
+			toBeExecuted := matrix.convert(segment)
+			batchExecutor.executeInParallel(toBeExecuted)
+		}
 	}
 }
 
+// splitTransactions splits logs by transactions if they should be replayed
+// atomically
+func splitTransactions(logs []*PartialLogWithCallbak) [][]*PartialLogWithCallbak {
+	if !conf.Options.TransactionAtomic {
+		return [][]*PartialLogWithCallbak{logs}
+	}
+
+	var units [][]*PartialLogWithCallbak
+	for i, log := range logs {
+		if i == 0 || !oplog.SameTxnGroup(logs[i-1].partialLog, log.partialLog) {
+			units = append(units, nil)
+		}
+		units[len(units)-1] = append(units[len(units)-1], log)
+	}
+	return units
+}
+
 // TODO
 func (batchExecutor *BatchGroupExecutor) replicateShouldStall(n int64) {
 }
@@ -121,16 +162,40 @@ func (batchExecutor *BatchGroupExecutor) executeInParallel(logs []*OplogRecord)
 	latch.Add(len(logs))
 	// shard oplogRecords by _id primary key and make up callback chain
 	var buffer = make([][]*OplogRecord, len(batchExecutor.executors))
-	shardKey := oplog.PrimaryKeyHasher{}
 	var completionList []func()
 	for _, log := range logs {
-		selected := shardKey.DistributeOplogByMod(log.original.partialLog, len(batchExecutor.executors))
+		var selected uint32
+		if !log.original.partialLog.Txn || !conf.Options.TransactionAtomic {
+			// the whole transaction is executed in the first executor
+			selected = batchExecutor.hasher.DistributeOplogByMod(log.original.partialLog, len(batchExecutor.executors))
+		}
+		log.selected = selected
 		buffer[selected] = append(buffer[selected], log)
 		if log.original.callback != nil {
 			// should be ordered by the incoming sequence
 			completionList = append(completionList, log.original.callback)
 		}
 	}
+	// oplogRecords wait for the ones they depend on in other executors. the
+	// ones in the same executor are executed in order already
+	for _, log := range logs {
+		var waitFor []*OplogRecord
+		for _, dependency := range log.dependencies {
+			if dependency.selected != log.selected {
+				if dependency.done == nil {
+					dependency.done = make(chan struct{})
+				}
+				waitFor = append(waitFor, dependency)
+			}
+		}
+		if len(waitFor) != 0 {
+			log.wait = func() {
+				for _, dependency := range waitFor {
+					<-dependency.done
+				}
+			}
+		}
+	}
 	for index, buf := range buffer {
 		if len(buf) != 0 {
 			nimo.AssertTrue(len(batchExecutor.executors[index].batchBlock) == 0, "executors buffer is not empty!")
@@ -171,6 +236,12 @@ type Executor struct {
 
 	// bulk insert or single insert
 	bulkInsert bool
+
+	// target supports multi-document transaction. use applyOps otherwise
+	transaction bool
+	// logical session and the last transaction number used in it
+	lsid      bson.Binary
+	txnNumber int64
 }
 
 func GenerateExecutorId() int {
@@ -204,6 +275,9 @@ func (exec *Executor) start() {
 
 func (exec *Executor) doSync(logs []*OplogRecord) error {
 	count := len(logs)
+	if logs[0].original.partialLog.Txn && conf.Options.TransactionAtomic {
+		return exec.executeTransaction(logs)
+	}
 
 	// split batched oplogRecords into (ns, op) groups. individual group
 	// can be accomplished in single MongoDB request. groups
@@ -250,7 +324,8 @@ func (combiner LogsGroupCombiner) mergeToGroups(logs []*OplogRecord) (groups []*
 		// the equivalent oplog.op and oplog.ns can be merged together
 		last := len(groups) - 1
 
-		if !forceSplit && // force split by log's wait function
+		if !forceSplit && // force split by log's done channel
+			log.wait == nil && // the log waiting for others starts a new group
 			len(groups) > 0 && // have one group existing at least
 			len(groups[last].oplogRecords) < combiner.maxGroupNr && // no more than max group number
 			sizeInGroup <= combiner.maxGroupSize && // no more than one group size
@@ -265,7 +340,7 @@ func (combiner LogsGroupCombiner) mergeToGroups(logs []*OplogRecord) (groups []*
 
 		// can't be merge more oplogRecords further. this log should be the end in this group
 		sizeInGroup = log.original.partialLog.RawSize
-		forceSplit = log.wait != nil
+		forceSplit = log.done != nil
 	}
 	return
 }
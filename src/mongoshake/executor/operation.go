@@ -19,6 +19,16 @@ var ErrorsShouldSkip = map[int]string{
 	61: "ShardKeyNotFound",
 }
 
+// MetaErrorsShouldSkip are the errors of the meta commands generated by
+// document sync that can be skipped. collections and indexes may exist on
+// target already and the ones dropped before re-sync may be missing
+var MetaErrorsShouldSkip = map[int]string{
+	26: "NamespaceNotFound",
+	48: "NamespaceExists",
+	85: "IndexOptionsConflict",
+	86: "IndexKeySpecsConflict",
+}
+
 type CommandOperation struct {
 	concernSyncData bool
 }
@@ -36,6 +46,7 @@ var opsMap = map[string]*CommandOperation{
 	"convertToCapped":  {concernSyncData: false},
 	"emptycapped":      {concernSyncData: false},
 	"applyOps":         {concernSyncData: true},
+	"createIndexes":    {concernSyncData: false},
 }
 
 func (exec *Executor) ensureConnection() bool {
@@ -47,6 +58,7 @@ func (exec *Executor) ensureConnection() bool {
 		} else {
 			exec.session = conn.Session
 			exec.bulkInsert = utils.GetAndCompareVersion(exec.session, ThresholdVersion)
+			exec.transaction = utils.GetAndCompareVersion(exec.session, TransactionVersion)
 		}
 	}
 
@@ -60,7 +72,11 @@ func (exec *Executor) dropConnection() {
 
 func (exec *Executor) execute(group *OplogsGroup) error {
 	count := uint64(len(group.oplogRecords))
-	lastOne := group.oplogRecords[count-1]
+	// wait for the dependent oplogRecords in other executors. only the first
+	// one in group may wait
+	if first := group.oplogRecords[0]; first.wait != nil {
+		first.wait()
+	}
 
 	if conf.Options.ReplayerDurable {
 		if !exec.ensureConnection() {
@@ -116,9 +132,9 @@ func (exec *Executor) execute(group *OplogsGroup) error {
 		}
 	}
 	// exec.batchExecutor.ReplMetric.ReplStatus.Clear(utils.ReplicaExecBad)
-	// wait for conflict break point if need
-	if lastOne.wait != nil {
-		lastOne.wait()
+	// wake up the oplogRecords waiting for this group
+	for _, record := range group.oplogRecords {
+		record.finish()
 	}
 
 	// group logs have the equivalent namespace
@@ -136,6 +152,16 @@ func (exec *Executor) errorIgnore(err error) bool {
 	return false
 }
 
+// metaErrorIgnore tells whether the error of command log can be skipped.
+// only the meta commands are allowed
+func metaErrorIgnore(log *oplog.PartialLog, err error) bool {
+	if e, ok := err.(*mgo.QueryError); ok && log.Meta {
+		_, skip := MetaErrorsShouldSkip[e.Code]
+		return skip
+	}
+	return false
+}
+
 func buildMetadata(oplog *oplog.PartialLog) bson.M {
 	// with gid carried
 	if len(oplog.Gid) != 0 {
@@ -154,6 +180,42 @@ func extraCommandName(o bson.M) (string, bool) {
 	return "", false
 }
 
+// IsCommand tells whether name is a command known by executor
+func IsCommand(name string) bool {
+	_, exist := opsMap[name]
+	return exist
+}
+
+// CommandName returns the name of command in o of oplog
+func CommandName(o bson.M) (string, bool) {
+	return extraCommandName(o)
+}
+
+// indexBuildCommands are written by the two phase index builds since 4.4.
+// they aren't replayed but change the indexes of collection
+var indexBuildCommands = []string{"startIndexBuild", "commitIndexBuild", "abortIndexBuild"}
+
+// IndexCommandName returns the name of command in o of oplog, including the
+// index build commands
+func IndexCommandName(o bson.M) (string, bool) {
+	if name, ok := extraCommandName(o); ok {
+		return name, true
+	}
+	for _, name := range indexBuildCommands {
+		if _, exist := o[name]; exist {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// replayCommand tells whether the command oplog is replayed. only the ones
+// syncing data are replayed in dml_only mode, except the meta commands
+// generated by collector which create the collections and indexes copied
+func replayCommand(log *oplog.PartialLog, operation string, found bool) bool {
+	return !conf.Options.ReplayerDMLOnly || log.Meta || (found && isSyncDataCommand(operation))
+}
+
 func isSyncDataCommand(operation string) bool {
 	if op, ok := opsMap[strings.TrimSpace(operation)]; ok {
 		return op.concernSyncData
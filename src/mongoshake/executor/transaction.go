@@ -0,0 +1,161 @@
+package executor
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+
+	"mongoshake/collector/configure"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// multi-document transaction is supported since 4.0
+	TransactionVersion = "4.0.0"
+
+	// transaction numbers are only allowed on replica set member or mongos
+	ErrorIllegalOperation = 20
+)
+
+// executeTransaction applies oplogs of one source transaction atomically. a
+// target transaction is preferred and single applyOps command is used if
+// target doesn't support it or there are commands in the transaction
+func (exec *Executor) executeTransaction(logs []*OplogRecord) error {
+	if !conf.Options.ReplayerDurable {
+		return nil
+	}
+	if !exec.ensureConnection() {
+		return errors.New("network connection lost . we would retry for next connecting")
+	}
+
+	var partialLogs []*oplog.PartialLog
+	hasCommand := false
+	for _, log := range logs {
+		switch log.original.partialLog.Operation {
+		case "n":
+			// nothing to do
+		case "c":
+			hasCommand = true
+			fallthrough
+		default:
+			partialLogs = append(partialLogs, log.original.partialLog)
+		}
+	}
+	if len(partialLogs) == 0 {
+		return nil
+	}
+
+	var err error
+	if exec.transaction && !hasCommand {
+		if err = exec.applyInTransaction(partialLogs); isIllegalOperation(err) {
+			LOG.Warn("Replayer-%d, executor-%d, target doesn't support transaction, use applyOps instead. %v",
+				exec.batchExecutor.ReplayerId, exec.id, err)
+			exec.transaction = false
+			err = exec.applyInApplyOps(partialLogs)
+		}
+	} else {
+		err = exec.applyInApplyOps(partialLogs)
+	}
+
+	if err != nil {
+		LOG.Critical("Replayer-%d, executor-%d, transaction ts[%d] with %d oplogs failed. %v",
+			exec.batchExecutor.ReplayerId, exec.id, partialLogs[0].Timestamp, len(partialLogs), err)
+		exec.dropConnection()
+		return err
+	}
+	LOG.Debug("Replayer-%d, executor-%d, transaction ts[%d] with %d oplogs committed",
+		exec.batchExecutor.ReplayerId, exec.id, partialLogs[0].Timestamp, len(partialLogs))
+	return nil
+}
+
+// applyInTransaction executes oplogs in a target transaction. all writes are
+// idempotent since the transaction may be retried
+func (exec *Executor) applyInTransaction(logs []*oplog.PartialLog) error {
+	if len(exec.lsid.Data) == 0 {
+		uuid := make([]byte, 16)
+		if _, err := rand.Read(uuid); err != nil {
+			return fmt.Errorf("generate logical session id failed. %v", err)
+		}
+		// version 4 uuid
+		uuid[6] = (uuid[6] & 0x0f) | 0x40
+		uuid[8] = (uuid[8] & 0x3f) | 0x80
+		exec.lsid = bson.Binary{Kind: 0x04, Data: uuid}
+	}
+	exec.txnNumber++
+	session := bson.D{{"lsid", bson.M{"id": exec.lsid}}, {"txnNumber", exec.txnNumber}, {"autocommit", false}}
+
+	for i, log := range logs {
+		// "0" -> database, "1" -> collection
+		dc := strings.SplitN(log.Namespace, ".", 2)
+		command := transactionCommand(dc[1], log)
+		command = append(command, session...)
+		if i == 0 {
+			command = append(command, bson.DocElem{Name: "startTransaction", Value: true})
+		}
+
+		var result struct {
+			WriteErrors []struct {
+				Code   int    `bson:"code"`
+				ErrMsg string `bson:"errmsg"`
+			} `bson:"writeErrors"`
+		}
+		err := exec.session.DB(dc[0]).Run(command, &result)
+		if err == nil && len(result.WriteErrors) != 0 {
+			err = fmt.Errorf("write error code[%d] %s", result.WriteErrors[0].Code, result.WriteErrors[0].ErrMsg)
+		}
+		if err != nil {
+			exec.session.DB("admin").Run(append(bson.D{{"abortTransaction", 1}}, session...), nil)
+			return err
+		}
+	}
+
+	return exec.session.DB("admin").Run(append(bson.D{{"commitTransaction", 1}}, session...), nil)
+}
+
+// transactionCommand converts CRUD oplog into write command. insert is
+// converted to upsert so that it's idempotent
+func transactionCommand(collection string, log *oplog.PartialLog) bson.D {
+	switch log.Operation {
+	case "i":
+		return bson.D{{"update", collection}, {"updates", []bson.M{{
+			"q": bson.M{"_id": log.Object["_id"]}, "u": log.Object, "upsert": true}}}}
+	case "u":
+		update := bson.M{}
+		for key, value := range log.Object {
+			if key != verisonMark {
+				update[key] = value
+			}
+		}
+		return bson.D{{"update", collection}, {"updates", []bson.M{{
+			"q": log.Query, "u": update, "upsert": conf.Options.ReplayerExecutorUpsert}}}}
+	default:
+		// "d"
+		return bson.D{{"delete", collection}, {"deletes", []bson.M{{"q": log.Object, "limit": 1}}}}
+	}
+}
+
+// applyInApplyOps executes oplogs in single applyOps command which is atomic
+// on replica set
+func (exec *Executor) applyInApplyOps(logs []*oplog.PartialLog) error {
+	ops := make([]bson.M, 0, len(logs))
+	for _, log := range logs {
+		op := bson.M{"op": log.Operation, "ns": log.Namespace, "o": log.Object}
+		if log.Query != nil {
+			op["o2"] = log.Query
+		}
+		ops = append(ops, op)
+	}
+	return exec.session.DB("admin").Run(bson.D{{"applyOps", ops}}, nil)
+}
+
+func isIllegalOperation(err error) bool {
+	if e, ok := err.(*mgo.QueryError); ok {
+		return e.Code == ErrorIllegalOperation
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package executor
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"mongoshake/dbpool"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+// UniqueIndexCache caches the unique indexes of the namespaces on target.
+// They are used to compute the unique index values of the oplogs without
+// "uk", which is only generated by some patched MongoDB. It's shared by all
+// the executors since the index commands are replayed by one of them
+type UniqueIndexCache struct {
+	lock sync.Mutex
+	// namespace -> columns of unique indexes. the columns of one index are
+	// sorted and joined by MultiColumnIndexSplitter
+	indexes map[string][]string
+	// increased by invalidate. the indexes loaded meanwhile aren't cached
+	generation uint64
+
+	// the indexes are loaded from target without lock held
+	session     *mgo.Session
+	sessionLock sync.Mutex
+}
+
+var uniqueIndexCache = &UniqueIndexCache{indexes: make(map[string][]string)}
+
+// get returns the unique indexes of namespace. they are loaded from target
+// at the first time
+func (cache *UniqueIndexCache) get(url, namespace string) []string {
+	cache.lock.Lock()
+	indexes, exist := cache.indexes[namespace]
+	generation := cache.generation
+	cache.lock.Unlock()
+	if exist {
+		return indexes
+	}
+
+	indexes, err := cache.load(url, namespace)
+	if err != nil {
+		LOG.Warn("Load unique indexes of %s from target failed, collision isn't detected on it. %v",
+			namespace, err)
+		return nil
+	}
+	cache.lock.Lock()
+	if cache.generation == generation {
+		cache.indexes[namespace] = indexes
+	}
+	cache.lock.Unlock()
+	return indexes
+}
+
+func (cache *UniqueIndexCache) load(url, namespace string) ([]string, error) {
+	cache.sessionLock.Lock()
+	defer cache.sessionLock.Unlock()
+
+	if cache.session == nil {
+		conn, err := dbpool.NewMongoConn(url, false)
+		if err != nil {
+			return nil, err
+		}
+		cache.session = conn.Session
+	}
+
+	dc := strings.SplitN(namespace, ".", 2)
+	if len(dc) != 2 {
+		return nil, nil
+	}
+	indexes, err := cache.session.DB(dc[0]).C(dc[1]).Indexes()
+	if err != nil {
+		if e, ok := err.(*mgo.QueryError); ok &&
+			(e.Code == dbpool.ErrNamespaceNotFound || e.Code == dbpool.ErrCommandNotSupportedOnView) {
+			return []string{}, nil
+		}
+		cache.session.Close()
+		cache.session = nil
+		return nil, err
+	}
+
+	columns := []string{}
+	for _, index := range indexes {
+		if !index.Unique {
+			continue
+		}
+		fields := make([]string, 0, len(index.Key))
+		for _, key := range index.Key {
+			// the fields of special indexes("$text:", "$2d:" and so on)
+			// aren't compared by value
+			if strings.HasPrefix(key, "$") {
+				fields = nil
+				break
+			}
+			fields = append(fields, strings.TrimPrefix(strings.TrimPrefix(key, "-"), "+"))
+		}
+		if len(fields) != 0 {
+			columns = addIndexColumns(columns, fields)
+		}
+	}
+	return columns, nil
+}
+
+// observe updates the cache by the index commands before they are replayed.
+// the index created is added directly, the namespaces whose indexes may be
+// dropped are loaded again later
+func (cache *UniqueIndexCache) observe(url string, log *oplog.PartialLog) {
+	switch log.Operation {
+	case "i":
+		// index built by inserting into system.indexes in old versions
+		if strings.HasSuffix(log.Namespace, ".system.indexes") {
+			namespace, _ := log.Object["ns"].(string)
+			cache.addIndex(url, namespace, log.Object)
+		}
+	case "c":
+		name, ok := IndexCommandName(log.Object)
+		if !ok {
+			return
+		}
+		database := strings.SplitN(log.Namespace, ".", 2)[0]
+		switch name {
+		case "createIndexes":
+			if collection, ok := log.Object[name].(string); ok {
+				cache.addIndex(url, database+"."+collection, log.Object)
+			}
+		case "dropIndex", "dropIndexes", "deleteIndex", "deleteIndexes", "drop",
+			"startIndexBuild", "commitIndexBuild", "abortIndexBuild":
+			// the indexes built in two phases are loaded again also
+			if collection, ok := log.Object[name].(string); ok {
+				cache.invalidate(database + "." + collection)
+			}
+		case "renameCollection":
+			from, _ := log.Object[name].(string)
+			to, _ := log.Object["to"].(string)
+			cache.invalidate(from)
+			cache.invalidate(to)
+		case "dropDatabase":
+			cache.invalidate(database)
+		case "applyOps":
+			// the namespaces of the operations applied are loaded again and
+			// the index commands in them are observed as well
+			ops, _ := log.Object[name].([]interface{})
+			for _, op := range ops {
+				fields, ok := op.(bson.M)
+				if !ok {
+					continue
+				}
+				applied := new(oplog.PartialLog)
+				applied.Operation, _ = fields["op"].(string)
+				applied.Namespace, _ = fields["ns"].(string)
+				applied.Object, _ = fields["o"].(bson.M)
+				cache.observe(url, applied)
+				if applied.Operation != "c" && applied.Namespace != "" {
+					cache.invalidate(applied.Namespace)
+				}
+			}
+		}
+	}
+}
+
+// addIndex adds the index of spec("key" and "unique") if it's unique
+func (cache *UniqueIndexCache) addIndex(url, namespace string, spec bson.M) {
+	key, ok := spec["key"].(bson.M)
+	if namespace == "" || spec["unique"] != true || !ok || len(key) == 0 {
+		return
+	}
+	fields := make([]string, 0, len(key))
+	for field, kind := range key {
+		if _, ok := kind.(string); ok {
+			// special index
+			return
+		}
+		fields = append(fields, field)
+	}
+
+	// it's loaded again later if failed
+	if cache.get(url, namespace) == nil {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	// invalidated meanwhile
+	if indexes, exist := cache.indexes[namespace]; exist {
+		cache.indexes[namespace] = addIndexColumns(append([]string{}, indexes...), fields)
+	}
+}
+
+// invalidate removes the namespace, or all the namespaces of database
+func (cache *UniqueIndexCache) invalidate(namespace string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	if strings.Contains(namespace, ".") {
+		delete(cache.indexes, namespace)
+		return
+	}
+	for ns := range cache.indexes {
+		if strings.HasPrefix(ns, namespace+".") {
+			delete(cache.indexes, ns)
+		}
+	}
+}
+
+// fillup sets the unique indexes of insert and update without "uk". all the
+// unique indexes are set to insert, and the ones whose fields are modified
+// are set to update. the values are filled by fillupOperationValues
+func (cache *UniqueIndexCache) fillup(url string, log *PartialLogWithCallbak) {
+	partialLog := log.partialLog
+	if len(partialLog.UniqueIndexes) != 0 || (partialLog.Operation != "i" && partialLog.Operation != "u") ||
+		strings.Contains(partialLog.Namespace, ".system.") {
+		return
+	}
+	indexes := cache.get(url, partialLog.Namespace)
+	if len(indexes) == 0 {
+		return
+	}
+
+	// insert and replacement modify all the fields
+	all := partialLog.Operation == "i"
+	var modified []string
+	if partialLog.Operation == "u" {
+		for key, value := range partialLog.Object {
+			if !strings.HasPrefix(key, "$") {
+				all = true
+				break
+			}
+			if fields, ok := value.(bson.M); ok {
+				for field := range fields {
+					modified = append(modified, field)
+				}
+			}
+		}
+	}
+
+	uniqueIndexes := bson.M{}
+	for _, index := range indexes {
+		// the document without any field of index isn't in sparse or
+		// partial index. it never collides since it's unique in source
+		if partialLog.Operation == "i" && !indexPresent(index, partialLog.Object) {
+			continue
+		}
+		if all || indexModified(index, modified) {
+			uniqueIndexes[index] = nil
+		}
+	}
+	if len(uniqueIndexes) != 0 {
+		partialLog.UniqueIndexes = uniqueIndexes
+	}
+}
+
+func indexPresent(index string, document bson.M) bool {
+	for _, column := range strings.Split(index, MultiColumnIndexSplitter) {
+		parent := document
+		cascades := strings.Split(column, ".")
+		for i, name := range cascades {
+			value, exist := parent[name]
+			if !exist {
+				break
+			}
+			if i == len(cascades)-1 {
+				return true
+			}
+			if parent, exist = value.(bson.M); !exist {
+				break
+			}
+		}
+	}
+	return false
+}
+
+func indexModified(index string, modified []string) bool {
+	for _, column := range strings.Split(index, MultiColumnIndexSplitter) {
+		for _, field := range modified {
+			if field == column || strings.HasPrefix(column, field+".") || strings.HasPrefix(field, column+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addIndexColumns appends the index if it's absent. the fields are sorted so
+// that the same index always has the same columns
+func addIndexColumns(indexes []string, fields []string) []string {
+	sort.Strings(fields)
+	columns := strings.Join(fields, MultiColumnIndexSplitter)
+	for _, index := range indexes {
+		if index == columns {
+			return indexes
+		}
+	}
+	return append(indexes, columns)
+}
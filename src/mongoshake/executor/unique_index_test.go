@@ -0,0 +1,47 @@
+package executor
+
+import (
+	"testing"
+
+	"mongoshake/oplog"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func TestUniqueIndexCacheObserveApplyOps(t *testing.T) {
+	cache := &UniqueIndexCache{indexes: map[string][]string{
+		"db.a":    {"x"},
+		"db.b":    {"y"},
+		"db.c":    {"z"},
+		"admin.d": {"w"},
+		"other.e": {"v"},
+	}}
+
+	raw, err := bson.Marshal(bson.D{{"ts", bson.MongoTimestamp(1)}, {"op", "c"}, {"ns", "admin.$cmd"},
+		{"o", bson.D{{"applyOps", []bson.D{
+			{{"op", "i"}, {"ns", "db.a"}, {"o", bson.D{{"_id", 1}}}},
+			{{"op", "u"}, {"ns", "db.b"}, {"o2", bson.D{{"_id", 1}}}, {"o", bson.D{{"$set", bson.D{{"f", 1}}}}}},
+			{{"op", "c"}, {"ns", "other.$cmd"}, {"o", bson.D{{"drop", "e"}}}},
+		}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := new(oplog.PartialLog)
+	if err = bson.Unmarshal(raw, log); err != nil {
+		t.Fatal(err)
+	}
+	cache.observe("", log)
+
+	for _, namespace := range []string{"db.a", "db.b", "other.e"} {
+		if _, exist := cache.indexes[namespace]; exist {
+			t.Errorf("%s applied isn't invalidated", namespace)
+		}
+	}
+	// the namespaces not applied, including the ones of admin that the
+	// command runs on, are kept
+	for _, namespace := range []string{"db.c", "admin.d"} {
+		if _, exist := cache.indexes[namespace]; !exist {
+			t.Errorf("%s not applied is invalidated", namespace)
+		}
+	}
+}
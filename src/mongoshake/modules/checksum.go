@@ -12,6 +12,10 @@ import (
  */
 type ChecksumCalculator struct{}
 
+func (coder *ChecksumCalculator) Name() string {
+	return ModuleChecksum
+}
+
 func (coder *ChecksumCalculator) IsRegistered() bool {
 	return true
 }
@@ -6,11 +6,16 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"sync"
 
 	"mongoshake/collector/configure"
 	"mongoshake/tunnel"
 
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
 	LOG "github.com/vinllen/log4go"
 )
 
@@ -20,23 +25,64 @@ const (
 	CompressionZlib    = "zlib"
 	CompressionDeflate = "deflate"
 	CompressionSnappy  = "snappy"
+	CompressionLZ4     = "lz4"
+	CompressionZstd    = "zstd"
 )
 
 const (
-	NoCompress          uint32 = 0
-	CompressWithGzip    uint32 = 1
-	CompressWithSnappy  uint32 = 2
-	CompressWithZlib    uint32 = 3
-	CompressWithDeflate uint32 = 4
+	// every log is compressed individually
+	CompressModeLog = "log"
+	// all the logs of message are compressed as one block
+	CompressModeMessage = "message"
+)
+
+const (
+	NoCompress       uint32 = 0
+	CompressWithGzip uint32 = 1
+	// the old snappy passing data through without compression. it's kept
+	// for the messages persisted in kafka or file before
+	CompressWithPassthrough uint32 = 2
+	CompressWithZlib        uint32 = 3
+	CompressWithDeflate     uint32 = 4
+	CompressWithSnappy      uint32 = 5
+	CompressWithLZ4         uint32 = 6
+	CompressWithZstd        uint32 = 7
 )
 
 const (
 	BestSpeed         = flate.BestSpeed
 	BestCompression   = flate.BestCompression
 	NormalCompression = flate.DefaultCompression
+	// 0 means the default level of compressor
+	DefaultCompressLevel = 0
 )
 
-var CompressLevel = BestCompression
+// CompressLevel is the level of gzip, zlib, deflate, lz4 and zstd. gzip,
+// zlib and deflate use BestCompression by default, lz4 uses the fast mode
+// and zstd uses its default level. snappy has no level
+var CompressLevel = DefaultCompressLevel
+
+// CheckCompressLevel tells whether the level is supported by the compressor
+func CheckCompressLevel(name string, level int) error {
+	max := 0
+	switch name {
+	case CompressionGzip, CompressionZlib, CompressionDeflate, CompressionLZ4:
+		max = BestCompression
+	case CompressionZstd:
+		max = 22
+	}
+	if level < 0 || level > max {
+		return fmt.Errorf("compress level of %s should be in [0, %d]", name, max)
+	}
+	return nil
+}
+
+func flateLevel() int {
+	if CompressLevel == DefaultCompressLevel {
+		return BestCompression
+	}
+	return CompressLevel
+}
 
 type Compress interface {
 	Name() string
@@ -55,6 +101,10 @@ func GetCompressorByName(name string) (Compress, error) {
 		return compressorZlib, nil
 	case CompressionDeflate:
 		return compressorDeflate, nil
+	case CompressionLZ4:
+		return compressorLZ4, nil
+	case CompressionZstd:
+		return compressorZstd, nil
 	case CompressionNone:
 		fallthrough
 	default:
@@ -72,6 +122,12 @@ func GetCompressorById(id uint32) (Compress, error) {
 		return compressorZlib, nil
 	case CompressWithDeflate:
 		return compressorDeflate, nil
+	case CompressWithLZ4:
+		return compressorLZ4, nil
+	case CompressWithZstd:
+		return compressorZstd, nil
+	case CompressWithPassthrough:
+		return compressorPassthrough, nil
 	case NoCompress:
 		fallthrough
 	default:
@@ -86,6 +142,12 @@ func GetCompressorById(id uint32) (Compress, error) {
 type Compressor struct {
 	// compressor nil if compress is not enable
 	zipper Compress
+	// compress the whole message as one block
+	block bool
+}
+
+func (compressor *Compressor) Name() string {
+	return ModuleCompressor
 }
 
 func (compressor *Compressor) IsRegistered() bool {
@@ -99,40 +161,64 @@ func (compressor *Compressor) Install() bool {
 		return false
 	}
 
-	// use high compress ratio by default
-	CompressLevel = BestCompression
+	CompressLevel = conf.Options.WorkerOplogCompressLevel
+	compressor.block = conf.Options.WorkerOplogCompressMode == CompressModeMessage
 
 	return true
 }
 
 func (compressor *Compressor) Handle(message *tunnel.WMessage) int64 {
+	if len(message.RawLogs) == 0 {
+		message.Compress = NoCompress
+		return tunnel.ReplyOK
+	}
+	if compressor.block {
+		return compressor.handleBlock(message)
+	}
+
 	var originSize, compressedSize = 0, 0
 	// compress log entry data
-	if len(message.RawLogs) != 0 {
-		compressed := [][]byte{}
-		// every log entry compress
-		for _, log := range message.RawLogs {
-			originSize += len(log)
-			zipped, err := compressor.zipper.Compress(log)
-			if err == nil {
-				compressedSize += len(zipped)
-				compressed = append(compressed, zipped)
-			}
+	compressed := [][]byte{}
+	// every log entry compress
+	for _, log := range message.RawLogs {
+		originSize += len(log)
+		zipped, err := compressor.zipper.Compress(log)
+		if err == nil {
+			compressedSize += len(zipped)
+			compressed = append(compressed, zipped)
 		}
+	}
 
-		if compressedSize == 0 || len(compressed) != len(message.RawLogs) {
-			LOG.Critical("Compressor result isn't equivalent. len(compressed) %d, len(Logs) %d", len(compressed), len(message.RawLogs))
-			return tunnel.ReplyServerFault
-		}
+	if compressedSize == 0 || len(compressed) != len(message.RawLogs) {
+		LOG.Critical("Compressor result isn't equivalent. len(compressed) %d, len(Logs) %d", len(compressed), len(message.RawLogs))
+		return tunnel.ReplyServerFault
+	}
 
-		LOG.Debug("Compressor-%s condense raw_size(%d), compress_size(%d), compress_ratio %d%%", compressor.zipper.Name(),
-			originSize, compressedSize, compressedSize*100/originSize)
-		message.Compress = compressor.zipper.Id()
-		message.RawLogs = compressed
-	} else {
-		message.Compress = NoCompress
+	LOG.Debug("Compressor-%s condense raw_size(%d), compress_size(%d), compress_ratio %d%%", compressor.zipper.Name(),
+		originSize, compressedSize, compressedSize*100/originSize)
+	message.Compress = compressor.zipper.Id()
+	message.RawLogs = compressed
+
+	return tunnel.ReplyOK
+}
+
+// handleBlock packs all the logs into one block and compresses it once. the
+// block replaces RawLogs and is flagged by MsgCompressedBlock
+func (compressor *Compressor) handleBlock(message *tunnel.WMessage) int64 {
+	block := tunnel.PackRawLogs(message.RawLogs)
+	zipped, err := compressor.zipper.Compress(block)
+	if err != nil || len(zipped) == 0 {
+		LOG.Critical("Compressor-%s compress block of %d logs failed. %v", compressor.zipper.Name(),
+			len(message.RawLogs), err)
+		return tunnel.ReplyServerFault
 	}
 
+	LOG.Debug("Compressor-%s condense block of %d logs raw_size(%d), compress_size(%d), compress_ratio %d%%",
+		compressor.zipper.Name(), len(message.RawLogs), len(block), len(zipped), len(zipped)*100/len(block))
+	message.Compress = compressor.zipper.Id()
+	message.Tag |= tunnel.MsgCompressedBlock
+	message.RawLogs = [][]byte{zipped}
+
 	return tunnel.ReplyOK
 }
 
@@ -159,7 +245,7 @@ func (Gzip *GZip) Id() uint32 {
 
 func (Gzip *GZip) Compress(chunk []byte) ([]byte, error) {
 	buffer := new(bytes.Buffer)
-	w, _ := gzip.NewWriterLevel(buffer, CompressLevel)
+	w, _ := gzip.NewWriterLevel(buffer, flateLevel())
 	w.Write(chunk)
 	w.Close()
 	if compressed, err := ioutil.ReadAll(buffer); err == nil {
@@ -194,12 +280,16 @@ func (snappy *Snappy) Id() uint32 {
 	return CompressWithSnappy
 }
 
-func (snappy *Snappy) Compress(chunk []byte) ([]byte, error) {
-	return chunk, nil
+func (s *Snappy) Compress(chunk []byte) ([]byte, error) {
+	return snappy.Encode(nil, chunk), nil
 }
 
-func (snappy *Snappy) Decompress(compressed []byte) ([]byte, error) {
-	return compressed, nil
+func (s *Snappy) Decompress(compressed []byte) ([]byte, error) {
+	uncompress, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, errors.New("snappy uncompress failed")
+	}
+	return uncompress, nil
 }
 
 type Zlib struct {
@@ -221,7 +311,7 @@ func (zlib *Zlib) Id() uint32 {
 
 func (ZLIB *Zlib) Compress(chunk []byte) ([]byte, error) {
 	buffer := new(bytes.Buffer)
-	w, _ := zlib.NewWriterLevel(buffer, CompressLevel)
+	w, _ := zlib.NewWriterLevel(buffer, flateLevel())
 	w.Write(chunk)
 	w.Close()
 	if compressed, err := ioutil.ReadAll(buffer); err == nil {
@@ -259,7 +349,7 @@ func (deflate *Deflate) Id() uint32 {
 
 func (deflate *Deflate) Compress(chunk []byte) ([]byte, error) {
 	buffer := new(bytes.Buffer)
-	w, _ := flate.NewWriter(buffer, CompressLevel)
+	w, _ := flate.NewWriter(buffer, flateLevel())
 	w.Write(chunk)
 	w.Close()
 	if compressed, err := ioutil.ReadAll(buffer); err == nil {
@@ -277,3 +367,122 @@ func (deflate *Deflate) Decompress(compressed []byte) ([]byte, error) {
 
 	return nil, errors.New("deflate uncompressed failed")
 }
+
+type LZ4 struct {
+	Writable
+}
+
+func NewLZ4Compressor() *LZ4 {
+	return &LZ4{}
+}
+
+func (l *LZ4) Name() string {
+	return CompressionLZ4
+}
+
+func (l *LZ4) Id() uint32 {
+	return CompressWithLZ4
+}
+
+func (l *LZ4) Compress(chunk []byte) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	w := lz4.NewWriter(buffer)
+	// high compression mode if level given
+	w.Header.CompressionLevel = CompressLevel
+	if _, err := w.Write(chunk); err != nil {
+		return nil, errors.New("lz4 compress failed")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.New("lz4 compress failed")
+	}
+	return buffer.Bytes(), nil
+}
+
+func (l *LZ4) Decompress(compressed []byte) ([]byte, error) {
+	r := lz4.NewReader(bytes.NewBuffer(compressed))
+	if uncompress, err := ioutil.ReadAll(r); err == nil {
+		return uncompress, nil
+	}
+
+	return nil, errors.New("lz4 uncompress failed")
+}
+
+// Zstd shares the encoder and decoder which are safe for concurrent use.
+// they are created at the first time since CompressLevel is set after init
+type Zstd struct {
+	encoderOnce sync.Once
+	encoder     *zstd.Encoder
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+}
+
+func NewZstdCompressor() *Zstd {
+	return &Zstd{}
+}
+
+func (z *Zstd) Name() string {
+	return CompressionZstd
+}
+
+func (z *Zstd) Id() uint32 {
+	return CompressWithZstd
+}
+
+func (z *Zstd) Compress(chunk []byte) ([]byte, error) {
+	z.encoderOnce.Do(func() {
+		level := zstd.SpeedDefault
+		if CompressLevel != DefaultCompressLevel {
+			level = zstd.EncoderLevelFromZstd(CompressLevel)
+		}
+		var err error
+		if z.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level)); err != nil {
+			LOG.Critical("Create zstd encoder failed. %v", err)
+		}
+	})
+	if z.encoder == nil {
+		return nil, errors.New("zstd compress failed")
+	}
+	return z.encoder.EncodeAll(chunk, nil), nil
+}
+
+func (z *Zstd) Decompress(compressed []byte) ([]byte, error) {
+	z.decoderOnce.Do(func() {
+		var err error
+		if z.decoder, err = zstd.NewReader(nil); err != nil {
+			LOG.Critical("Create zstd decoder failed. %v", err)
+		}
+	})
+	if z.decoder == nil {
+		return nil, errors.New("zstd uncompress failed")
+	}
+	if uncompress, err := z.decoder.DecodeAll(compressed, nil); err == nil {
+		return uncompress, nil
+	}
+
+	return nil, errors.New("zstd uncompress failed")
+}
+
+// Passthrough only decompresses the messages compressed by id 2. it's not
+// available by name
+type Passthrough struct {
+}
+
+func NewPassthroughCompressor() *Passthrough {
+	return &Passthrough{}
+}
+
+func (passthrough *Passthrough) Name() string {
+	return "passthrough"
+}
+
+func (passthrough *Passthrough) Id() uint32 {
+	return CompressWithPassthrough
+}
+
+func (passthrough *Passthrough) Compress(chunk []byte) ([]byte, error) {
+	return chunk, nil
+}
+
+func (passthrough *Passthrough) Decompress(compressed []byte) ([]byte, error) {
+	return compressed, nil
+}
@@ -0,0 +1,50 @@
+package module
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	defer func() { CompressLevel = DefaultCompressLevel }()
+
+	chunk := bytes.Repeat([]byte("mongoshake oplog compress round trip. "), 64)
+	for _, name := range []string{CompressionGzip, CompressionZlib, CompressionDeflate, CompressionSnappy,
+		CompressionLZ4, CompressionZstd} {
+		for _, level := range []int{DefaultCompressLevel, 1} {
+			CompressLevel = level
+			compressor, err := GetCompressorByName(name)
+			if err != nil {
+				t.Fatalf("%s: get compressor failed. %v", name, err)
+			}
+			if byId, err := GetCompressorById(compressor.Id()); err != nil || byId != compressor {
+				t.Errorf("%s: compressor of id %d is %v, %v", name, compressor.Id(), byId, err)
+			}
+
+			compressed, err := compressor.Compress(chunk)
+			if err != nil {
+				t.Fatalf("%s level %d: compress failed. %v", name, level, err)
+			}
+			uncompressed, err := compressor.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s level %d: decompress failed. %v", name, level, err)
+			}
+			if !bytes.Equal(uncompressed, chunk) {
+				t.Errorf("%s level %d: round trip gets %d bytes, should be %d", name, level,
+					len(uncompressed), len(chunk))
+			}
+		}
+	}
+
+	if _, err := GetCompressorByName(CompressionNone); err == nil {
+		t.Error("compressor of none is returned")
+	}
+	// the messages of id 2 are still decodable
+	compressor, err := GetCompressorById(CompressWithPassthrough)
+	if err != nil {
+		t.Fatalf("get compressor of id %d failed. %v", CompressWithPassthrough, err)
+	}
+	if uncompressed, err := compressor.Decompress(chunk); err != nil || !bytes.Equal(uncompressed, chunk) {
+		t.Errorf("passthrough decompress gets %d bytes, %v", len(uncompressed), err)
+	}
+}
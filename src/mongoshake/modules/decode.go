@@ -0,0 +1,240 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+
+	"mongoshake/oplog"
+	"mongoshake/tunnel"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+// names of the modules. the receiver configures its decoders by them
+const (
+	ModuleCompressor = "compressor"
+	ModuleEncryptor  = "encryptor"
+	ModuleChecksum   = "checksum"
+)
+
+// ModuleOrder is the order of modules handling message in collector. the
+// decoders are in reverse order on receiver
+var ModuleOrder = []string{ModuleCompressor, ModuleEncryptor, ModuleChecksum}
+
+// Decoder reverses the module of the same name on receiver
+type Decoder interface {
+	Name() string
+
+	/**
+	 * Decode the message in place. return tunnel.ReplyOK or the tunnel's
+	 * error code (<0) which is replied to collector
+	 */
+	Decode(message *tunnel.TMessage) int64
+}
+
+// DecodeChain verifies, decrypts, decompresses and parses the messages
+// received. It's shared by the re-players and could be embedded in any
+// tunnel.Replayer so that Sync() needn't do the same by itself
+type DecodeChain struct {
+	decoders []Decoder
+}
+
+// NewDecodeChain creates the decoders of names in the reverse order of
+// ModuleOrder. the encrypted messages are rejected if keyRing is nil
+func NewDecodeChain(names []string, keyRing *KeyRing) (*DecodeChain, error) {
+	given := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch name {
+		case ModuleCompressor, ModuleEncryptor, ModuleChecksum:
+		case "":
+			// e.g. the trailing separator in configuration
+			return nil, errors.New("module name is empty")
+		default:
+			return nil, fmt.Errorf("module %s is unknown", name)
+		}
+		if given[name] {
+			return nil, fmt.Errorf("module %s is duplicated", name)
+		}
+		given[name] = true
+	}
+
+	chain := &DecodeChain{}
+	for i := len(ModuleOrder) - 1; i >= 0; i-- {
+		if !given[ModuleOrder[i]] {
+			continue
+		}
+		switch ModuleOrder[i] {
+		case ModuleChecksum:
+			chain.decoders = append(chain.decoders, &ChecksumVerifier{})
+		case ModuleEncryptor:
+			chain.decoders = append(chain.decoders, &Decryptor{ring: keyRing})
+		case ModuleCompressor:
+			chain.decoders = append(chain.decoders, &Decompressor{})
+		}
+	}
+	return chain, nil
+}
+
+// Decode runs the decoders in order and parses the logs. the message
+// encoded by any module not given is rejected
+func (chain *DecodeChain) Decode(message *tunnel.TMessage) (*tunnel.WMessage, int64) {
+	for _, decoder := range chain.decoders {
+		if code := decoder.Decode(message); code != tunnel.ReplyOK {
+			return nil, code
+		}
+	}
+
+	// left encoded since the module isn't given
+	if message.Tag&tunnel.MsgEncrypted != 0 {
+		LOG.Critical("Tunnel message is encrypted but module %s isn't given", ModuleEncryptor)
+		return nil, tunnel.ReplyDecryptInvalid
+	}
+	if message.Compress != NoCompress || message.Tag&tunnel.MsgCompressedBlock != 0 {
+		LOG.Critical("Tunnel message is compressed but module %s isn't given", ModuleCompressor)
+		return nil, tunnel.ReplyCompressorNotSupported
+	}
+
+	parsed := make([]*oplog.PartialLog, len(message.RawLogs), len(message.RawLogs))
+	for i, raw := range message.RawLogs {
+		parsed[i] = &oplog.PartialLog{}
+		if err := bson.Unmarshal(raw, parsed[i]); err != nil {
+			LOG.Critical("Tunnel message parse oplog failed. %v", err)
+			return nil, tunnel.ReplyError
+		}
+		parsed[i].RawSize = len(raw)
+		parsed[i].Raw = raw
+	}
+	if message.Tag&tunnel.MsgTransaction != 0 {
+		for _, index := range message.Txns {
+			if index >= uint32(len(parsed)) {
+				LOG.Critical("Tunnel message transaction index %d exceeds %d logs", index, len(parsed))
+				return nil, tunnel.ReplyError
+			}
+			parsed[index].Txn = true
+		}
+	}
+	return &tunnel.WMessage{TMessage: message, ParsedLogs: parsed}, tunnel.ReplyOK
+}
+
+/*
+ * ====== ChecksumVerifier =======
+ *
+ */
+type ChecksumVerifier struct{}
+
+func (verifier *ChecksumVerifier) Name() string {
+	return ModuleChecksum
+}
+
+func (verifier *ChecksumVerifier) Decode(message *tunnel.TMessage) int64 {
+	if message.Checksum != 0 {
+		if recalculated := message.Crc32(); recalculated != message.Checksum {
+			LOG.Critical("Tunnel message checksum bad. recalculated is 0x%x. origin is 0x%x", recalculated, message.Checksum)
+			return tunnel.ReplyChecksumInvalid
+		}
+	}
+	return tunnel.ReplyOK
+}
+
+/*
+ * ====== Decryptor =======
+ *
+ */
+type Decryptor struct {
+	ring *KeyRing
+}
+
+func (decryptor *Decryptor) Name() string {
+	return ModuleEncryptor
+}
+
+func (decryptor *Decryptor) Decode(message *tunnel.TMessage) int64 {
+	if message.Tag&tunnel.MsgEncrypted == 0 {
+		// the probes carry nothing. any oplogs in plain text aren't
+		// accepted once the key is given
+		if decryptor.ring != nil && len(message.RawLogs) != 0 {
+			LOG.Critical("Tunnel message isn't encrypted but key file is given")
+			return tunnel.ReplyDecryptInvalid
+		}
+		return tunnel.ReplyOK
+	}
+
+	if decryptor.ring == nil {
+		LOG.Critical("Tunnel message is encrypted but no key file is given")
+		return tunnel.ReplyDecryptInvalid
+	}
+
+	// the whole message is encrypted as one block
+	if len(message.RawLogs) != 1 {
+		LOG.Critical("Encrypted message has %d blocks", len(message.RawLogs))
+		return tunnel.ReplyDecryptInvalid
+	}
+	block, err := decryptor.ring.Decrypt(message.RawLogs[0], additionalData(message))
+	if err != nil {
+		LOG.Critical("Tunnel message decrypt failed. %v", err)
+		return tunnel.ReplyDecryptInvalid
+	}
+	decrypted, err := tunnel.UnpackRawLogs(block)
+	if err != nil {
+		LOG.Critical("Unpack decrypted block failed. %v", err)
+		return tunnel.ReplyDecryptInvalid
+	}
+	message.RawLogs = decrypted
+	message.Tag &^= tunnel.MsgEncrypted
+	return tunnel.ReplyOK
+}
+
+/*
+ * ====== Decompressor =======
+ *
+ */
+type Decompressor struct{}
+
+func (decompressor *Decompressor) Name() string {
+	return ModuleCompressor
+}
+
+func (decompressor *Decompressor) Decode(message *tunnel.TMessage) int64 {
+	if message.Compress == NoCompress {
+		return tunnel.ReplyOK
+	}
+	// not decrypted since encryptor isn't given
+	if message.Tag&tunnel.MsgEncrypted != 0 {
+		LOG.Critical("Tunnel message is encrypted but module %s isn't given", ModuleEncryptor)
+		return tunnel.ReplyDecryptInvalid
+	}
+
+	compressor, err := GetCompressorById(message.Compress)
+	if err != nil {
+		LOG.Critical("Tunnel message compressor not support. is %d", message.Compress)
+		return tunnel.ReplyCompressorNotSupported
+	}
+	var decompress [][]byte
+	for _, toDecompress := range message.RawLogs {
+		bits, err := compressor.Decompress(toDecompress)
+		if err == nil {
+			decompress = append(decompress, bits)
+		}
+	}
+	if len(decompress) != len(message.RawLogs) {
+		LOG.Critical("Decompress result isn't equivalent. len(decompress) %d, len(Logs) %d", len(decompress), len(message.RawLogs))
+		return tunnel.ReplyDecompressInvalid
+	}
+
+	// the whole message is compressed as one block
+	if message.Tag&tunnel.MsgCompressedBlock != 0 {
+		if len(decompress) != 1 {
+			LOG.Critical("Compressed block message has %d blocks", len(decompress))
+			return tunnel.ReplyDecompressInvalid
+		}
+		if decompress, err = tunnel.UnpackRawLogs(decompress[0]); err != nil {
+			LOG.Critical("Unpack compressed block failed. %v", err)
+			return tunnel.ReplyDecompressInvalid
+		}
+		message.Tag &^= tunnel.MsgCompressedBlock
+	}
+	message.RawLogs = decompress
+	message.Compress = NoCompress
+	return tunnel.ReplyOK
+}
@@ -0,0 +1,93 @@
+package module
+
+import (
+	"bytes"
+	"testing"
+
+	"mongoshake/tunnel"
+)
+
+func TestNewDecodeChain(t *testing.T) {
+	tests := []struct {
+		names    []string
+		decoders int
+		valid    bool
+	}{
+		{nil, 0, true},
+		{ModuleOrder, 3, true},
+		{[]string{ModuleChecksum}, 1, true},
+		{[]string{""}, 0, false},
+		{[]string{ModuleChecksum, ""}, 0, false},
+		{[]string{"unknown"}, 0, false},
+		{[]string{ModuleChecksum, ModuleChecksum}, 0, false},
+	}
+	for _, test := range tests {
+		chain, err := NewDecodeChain(test.names, nil)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("modules %q should be rejected", test.names)
+			}
+			continue
+		}
+		if err != nil || len(chain.decoders) != test.decoders {
+			t.Errorf("modules %q create %v, should have %d decoders. %v", test.names, chain, test.decoders, err)
+		}
+	}
+}
+
+func TestDecodeChain(t *testing.T) {
+	ring := newKeyRing(t, "1 000102030405060708090a0b0c0d0e0f\n")
+	compressor, err := GetCompressorByName(CompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encoded by the modules in ModuleOrder as collector does
+	encode := func() (*tunnel.WMessage, [][]byte) {
+		message, logs := newMessage(t, 3)
+		for _, handler := range []interface {
+			Handle(message *tunnel.WMessage) int64
+		}{&Compressor{zipper: compressor, block: true}, &Encryptor{ring: ring, keyId: 1}, &ChecksumCalculator{}} {
+			if code := handler.Handle(message); code != tunnel.ReplyOK {
+				t.Fatalf("encode by %T failed. %d", handler, code)
+			}
+		}
+		return message, logs
+	}
+
+	chain, err := NewDecodeChain([]string{ModuleChecksum, ModuleEncryptor, ModuleCompressor}, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, logs := encode()
+	decoded, code := chain.Decode(message.TMessage)
+	if code != tunnel.ReplyOK {
+		t.Fatalf("decode failed. %d", code)
+	}
+	if len(decoded.RawLogs) != len(logs) || len(decoded.ParsedLogs) != len(logs) {
+		t.Fatalf("decoded %d logs, should be %d", len(decoded.RawLogs), len(logs))
+	}
+	for i := range logs {
+		if !bytes.Equal(decoded.RawLogs[i], logs[i]) || decoded.ParsedLogs[i].Namespace != "db.c" {
+			t.Errorf("log %d is decoded to %v", i, decoded.ParsedLogs[i])
+		}
+	}
+
+	// checksum mismatched
+	message, _ = encode()
+	message.Checksum ^= 1
+	if _, code := chain.Decode(message.TMessage); code != tunnel.ReplyChecksumInvalid {
+		t.Errorf("message of bad checksum is decoded. %d", code)
+	}
+
+	// the modules encoding message aren't all given
+	for _, names := range [][]string{{ModuleChecksum, ModuleCompressor}, {ModuleChecksum, ModuleEncryptor}} {
+		partial, err := NewDecodeChain(names, ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, _ = encode()
+		if _, code := partial.Decode(message.TMessage); code == tunnel.ReplyOK {
+			t.Errorf("message is decoded by modules %q", names)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package module
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"mongoshake/collector/configure"
+	"mongoshake/tunnel"
+
+	LOG "github.com/vinllen/log4go"
+)
+
+const (
+	EncryptionNone   = "none"
+	EncryptionAESGCM = "aes-gcm"
+)
+
+// length of the key id prefixed to every encrypted message
+const KeyIdLen = 4
+
+// the tags describing the encoding of RawLogs. the others are set by the
+// tunnels and aren't authenticated
+const authenticatedTags = tunnel.MsgCompressedBlock | tunnel.MsgEncrypted | tunnel.MsgTransaction
+
+// KeyRing holds all the keys of key file by id. The key file has one key
+// per line as "<id> <key in hex>", the key is 16, 24 or 32 bytes for
+// AES-128, AES-192 or AES-256. Empty lines and lines started with "#" are
+// ignored. Keys are rotated by adding a new one and encrypting with it,
+// the old ones are kept so that the messages encrypted by them (e.g. in
+// kafka or file) remain decryptable
+type KeyRing struct {
+	keys map[uint32]cipher.AEAD
+}
+
+func LoadKeyRing(path string) (*KeyRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ring := &KeyRing{keys: make(map[uint32]cipher.AEAD)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("key file line %d should be \"<id> <key in hex>\"", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d has invalid id. %v", line, err)
+		}
+		if _, exist := ring.keys[uint32(id)]; exist {
+			return nil, fmt.Errorf("key file line %d has duplicated id %d", line, id)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d has invalid key. %v", line, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d has invalid key. %v", line, err)
+		}
+		if ring.keys[uint32(id)], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ring.keys) == 0 {
+		return nil, errors.New("key file has no key")
+	}
+	return ring, nil
+}
+
+func (ring *KeyRing) Has(id uint32) bool {
+	_, exist := ring.keys[id]
+	return exist
+}
+
+// Encrypt seals plain by key of id. the result is key id, nonce and the
+// sealed one in order. key id and additional are authenticated as
+// additional data
+func (ring *KeyRing) Encrypt(id uint32, plain, additional []byte) ([]byte, error) {
+	aead, exist := ring.keys[id]
+	if !exist {
+		return nil, fmt.Errorf("key %d not found", id)
+	}
+	header := make([]byte, KeyIdLen+aead.NonceSize(), KeyIdLen+aead.NonceSize()+len(plain)+aead.Overhead())
+	binary.BigEndian.PutUint32(header, id)
+	if _, err := rand.Read(header[KeyIdLen:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, header[KeyIdLen:], plain, append(header[:KeyIdLen:KeyIdLen], additional...)), nil
+}
+
+// Decrypt opens the result of Encrypt by the key id in it. additional
+// should be the same as encrypted
+func (ring *KeyRing) Decrypt(sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < KeyIdLen {
+		return nil, errors.New("encrypted message is truncated")
+	}
+	id := binary.BigEndian.Uint32(sealed)
+	aead, exist := ring.keys[id]
+	if !exist {
+		return nil, fmt.Errorf("key %d not found", id)
+	}
+	if len(sealed) < KeyIdLen+aead.NonceSize() {
+		return nil, errors.New("encrypted message is truncated")
+	}
+	nonce := sealed[KeyIdLen : KeyIdLen+aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[KeyIdLen+aead.NonceSize():],
+		append(sealed[:KeyIdLen:KeyIdLen], additional...))
+}
+
+// additionalData returns the fields of message authenticated along with
+// RawLogs. so the message can't be replayed to another shard or decoded in
+// another way. the logs in transactions are authenticated also
+func additionalData(message *tunnel.TMessage) []byte {
+	data := make([]byte, 12, 12+4*len(message.Txns))
+	binary.BigEndian.PutUint32(data, message.Tag&authenticatedTags)
+	binary.BigEndian.PutUint32(data[4:], message.Shard)
+	binary.BigEndian.PutUint32(data[8:], message.Compress)
+	if message.Tag&tunnel.MsgTransaction != 0 {
+		for _, index := range message.Txns {
+			data = append(data, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(data[len(data)-4:], index)
+		}
+	}
+	return data
+}
+
+/*
+ * ====== Encryptor =======
+ *
+ * all the logs of message are packed and encrypted once. the random nonce
+ * limits a key to 2^32 messages
+ */
+type Encryptor struct {
+	ring  *KeyRing
+	keyId uint32
+}
+
+func (encryptor *Encryptor) Name() string {
+	return ModuleEncryptor
+}
+
+func (encryptor *Encryptor) IsRegistered() bool {
+	return conf.Options.WorkerOplogEncryptor != EncryptionNone
+}
+
+func (encryptor *Encryptor) Install() bool {
+	var err error
+	if encryptor.ring, err = LoadKeyRing(conf.Options.WorkerOplogEncryptorKeyFile); err != nil {
+		LOG.Critical("Worker load key file %s failed. %v", conf.Options.WorkerOplogEncryptorKeyFile, err)
+		return false
+	}
+	encryptor.keyId = uint32(conf.Options.WorkerOplogEncryptorKeyId)
+	if !encryptor.ring.Has(encryptor.keyId) {
+		LOG.Critical("Worker encryption key %d isn't in key file %s", encryptor.keyId,
+			conf.Options.WorkerOplogEncryptorKeyFile)
+		return false
+	}
+	return true
+}
+
+func (encryptor *Encryptor) Handle(message *tunnel.WMessage) int64 {
+	if len(message.RawLogs) == 0 {
+		return tunnel.ReplyOK
+	}
+
+	message.Tag |= tunnel.MsgEncrypted
+	sealed, err := encryptor.ring.Encrypt(encryptor.keyId, tunnel.PackRawLogs(message.RawLogs),
+		additionalData(message.TMessage))
+	if err != nil {
+		LOG.Critical("Encryptor encrypt message failed. %v", err)
+		message.Tag &^= tunnel.MsgEncrypted
+		return tunnel.ReplyServerFault
+	}
+	message.RawLogs = [][]byte{sealed}
+
+	return tunnel.ReplyOK
+}
@@ -0,0 +1,148 @@
+package module
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"mongoshake/tunnel"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func newKeyRing(t *testing.T, content string) *KeyRing {
+	file, err := ioutil.TempFile("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	ring, err := LoadKeyRing(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func newMessage(t *testing.T, count int) (*tunnel.WMessage, [][]byte) {
+	var logs [][]byte
+	for i := 0; i < count; i++ {
+		raw, err := bson.Marshal(bson.D{{"ts", bson.MongoTimestamp(i + 1)}, {"op", "i"}, {"ns", "db.c"},
+			{"o", bson.D{{"_id", i}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, raw)
+	}
+	message := &tunnel.WMessage{TMessage: &tunnel.TMessage{Shard: 3, RawLogs: append([][]byte{}, logs...)}}
+	return message, logs
+}
+
+func TestEncryptorRoundTrip(t *testing.T) {
+	ring := newKeyRing(t, "# old key\n1 000102030405060708090a0b0c0d0e0f\n\n"+
+		"2 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n")
+	compressor, err := GetCompressorByName(CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		keyId    uint32
+		compress *Compressor
+	}{
+		{"aes-128", 1, nil},
+		{"aes-256", 2, nil},
+		{"compressed", 2, &Compressor{zipper: compressor}},
+		{"compressed block", 2, &Compressor{zipper: compressor, block: true}},
+	}
+	chain, err := NewDecodeChain([]string{ModuleChecksum, ModuleEncryptor, ModuleCompressor}, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		message, logs := newMessage(t, 3)
+		message.Tag |= tunnel.MsgTransaction
+		message.Txns = []uint32{1, 2}
+		if test.compress != nil {
+			if code := test.compress.Handle(message); code != tunnel.ReplyOK {
+				t.Fatalf("%s: compress failed. %d", test.name, code)
+			}
+		}
+		if code := (&Encryptor{ring: ring, keyId: test.keyId}).Handle(message); code != tunnel.ReplyOK {
+			t.Fatalf("%s: encrypt failed. %d", test.name, code)
+		}
+		if len(message.RawLogs) != 1 || message.Tag&tunnel.MsgEncrypted == 0 {
+			t.Fatalf("%s: message should be encrypted as one block. %v", test.name, message.TMessage)
+		}
+
+		// set by tunnels after encrypted
+		message.Tag |= tunnel.MsgResident | tunnel.MsgRetransmission
+		decoded, code := chain.Decode(message.TMessage)
+		if code != tunnel.ReplyOK {
+			t.Errorf("%s: decode failed. %d", test.name, code)
+			continue
+		}
+		if len(decoded.RawLogs) != len(logs) || len(decoded.ParsedLogs) != len(logs) {
+			t.Errorf("%s: decoded %d logs, should be %d", test.name, len(decoded.RawLogs), len(logs))
+			continue
+		}
+		for i := range logs {
+			if !bytes.Equal(decoded.RawLogs[i], logs[i]) || decoded.ParsedLogs[i].Txn != (i != 0) {
+				t.Errorf("%s: log %d is decoded differently", test.name, i)
+			}
+		}
+	}
+}
+
+func TestDecryptorTampered(t *testing.T) {
+	ring := newKeyRing(t, "1 000102030405060708090a0b0c0d0e0f\n")
+	tests := []struct {
+		name   string
+		tamper func(message *tunnel.TMessage)
+	}{
+		{"shard", func(message *tunnel.TMessage) { message.Shard++ }},
+		{"compressor", func(message *tunnel.TMessage) { message.Compress = CompressWithPassthrough }},
+		{"block", func(message *tunnel.TMessage) { message.Tag |= tunnel.MsgCompressedBlock }},
+		{"transaction", func(message *tunnel.TMessage) {
+			message.Tag |= tunnel.MsgTransaction
+			message.Txns = []uint32{0}
+		}},
+		{"logs", func(message *tunnel.TMessage) { message.RawLogs[0][len(message.RawLogs[0])-1] ^= 1 }},
+		{"key id", func(message *tunnel.TMessage) { message.RawLogs[0][KeyIdLen-1] = 2 }},
+		{"truncated", func(message *tunnel.TMessage) { message.RawLogs[0] = message.RawLogs[0][:KeyIdLen+4] }},
+		{"split", func(message *tunnel.TMessage) { message.RawLogs = append(message.RawLogs, message.RawLogs[0]) }},
+		{"plain", func(message *tunnel.TMessage) {
+			message.Tag &^= tunnel.MsgEncrypted
+			message.RawLogs = [][]byte{[]byte("plain")}
+		}},
+	}
+	for _, test := range tests {
+		message, _ := newMessage(t, 2)
+		if code := (&Encryptor{ring: ring, keyId: 1}).Handle(message); code != tunnel.ReplyOK {
+			t.Fatalf("%s: encrypt failed. %d", test.name, code)
+		}
+		test.tamper(message.TMessage)
+		if code := (&Decryptor{ring: ring}).Decode(message.TMessage); code != tunnel.ReplyDecryptInvalid {
+			t.Errorf("%s: tampered message is decrypted. %d", test.name, code)
+		}
+	}
+
+	message, _ := newMessage(t, 1)
+	if code := (&Encryptor{ring: ring, keyId: 1}).Handle(message); code != tunnel.ReplyOK {
+		t.Fatalf("encrypt failed. %d", code)
+	}
+	if code := (&Decryptor{}).Decode(message.TMessage); code != tunnel.ReplyDecryptInvalid {
+		t.Errorf("message is decrypted without key. %d", code)
+	}
+
+	probe := &tunnel.TMessage{Tag: tunnel.MsgProbe}
+	if code := (&Decryptor{ring: ring}).Decode(probe); code != tunnel.ReplyOK {
+		t.Errorf("probe is rejected. %d", code)
+	}
+}
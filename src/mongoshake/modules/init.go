@@ -5,4 +5,8 @@ var (
 	compressorSnappy  = NewSnappyCompressor()
 	compressorZlib    = NewZlibCompressor()
 	compressorDeflate = NewDeflateCompressor()
+	compressorLZ4     = NewLZ4Compressor()
+	compressorZstd    = NewZstdCompressor()
+
+	compressorPassthrough = NewPassthroughCompressor()
 )
@@ -1,6 +1,12 @@
 package oplog
 
 import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
 	LOG "github.com/vinllen/log4go"
 	"github.com/vinllen/mgo/bson"
 )
@@ -9,6 +15,7 @@ const (
 	ShardByID        = "id"
 	ShardByNamespace = "collection"
 	ShardAutomatic   = "auto"
+	ShardByField     = "field"
 )
 
 const (
@@ -70,22 +77,117 @@ func stringHashValue(s string) uint32 {
 	return hashValue
 }
 
+// Hash returns the hash of any BSON value, such as _id. It's computed by
+// FNV-1a over the canonical BSON encoding of the value so that every type is
+// distributed and the same value always has the same hash. The numbers equal
+// in MongoDB(1, NumberLong(1) and 1.0) are hashed as the same, and the keys
+// of embedded documents are sorted since bson.M loses their order
 func Hash(hashObject interface{}) uint32 {
+	hashValue := uint32(fnvOffset32)
 	switch object := hashObject.(type) {
+	case nil:
+		LOG.Warn("Hash object is NIL. use default value %d", DefaultHashValue)
+		return DefaultHashValue
 	case bson.ObjectId:
-		return stringHashValue(object.Hex())
+		// fast path of the common types. the bytes are the same as marshaled
+		hashValue = fnvHash(hashValue, []byte{0x07, 0x00})
+		return fnvHash(hashValue, []byte(object))
 	case string:
-		return stringHashValue(object)
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(object)+1))
+		hashValue = fnvHash(hashValue, []byte{0x02, 0x00})
+		hashValue = fnvHash(hashValue, length[:])
+		hashValue = fnvHash(hashValue, []byte(object))
+		return fnvHash(hashValue, []byte{0x00})
+	}
+
+	if number, ok := integralNumber(hashObject); ok {
+		var value [8]byte
+		binary.LittleEndian.PutUint64(value[:], uint64(number))
+		hashValue = fnvHash(hashValue, []byte{0x12, 0x00})
+		return fnvHash(hashValue, value[:])
+	}
+
+	data, err := bson.Marshal(bson.D{{"", canonicalValue(hashObject)}})
+	if err != nil {
+		LOG.Warn("Hash object is UNKNOWN type[%T], value is [%v]. use default value %d. %v",
+			hashObject, hashObject, DefaultHashValue, err)
+		return DefaultHashValue
+	}
+	// skip the length of document and the terminal byte
+	return fnvHash(hashValue, data[4:len(data)-1])
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+func fnvHash(hashValue uint32, data []byte) uint32 {
+	for _, c := range data {
+		hashValue ^= uint32(c)
+		hashValue *= fnvPrime32
+	}
+	return hashValue
+}
+
+// integralNumber returns the number as int64 if it's an integer
+func integralNumber(value interface{}) (int64, bool) {
+	switch number := value.(type) {
 	case int:
-		return uint32(object)
-	case nil:
-		LOG.Warn("Hash object is NIL. use default value %d", DefaultHashValue)
-	default:
-		LOG.Warn("Hash object is UNKNOWN type[%T], value is [%v]. use default value %d",
-			hashObject, hashObject, DefaultHashValue)
+		return int64(number), true
+	case int32:
+		return int64(number), true
+	case int64:
+		return number, true
+	case float64:
+		if number == math.Trunc(number) && number >= math.MinInt64 && number < math.MaxInt64 {
+			return int64(number), true
+		}
+	}
+	return 0, false
+}
+
+// canonicalValue converts the value into the form marshaled identically for
+// the values equal in MongoDB
+func canonicalValue(value interface{}) interface{} {
+	if number, ok := integralNumber(value); ok {
+		return number
 	}
 
-	return DefaultHashValue
+	switch object := value.(type) {
+	case bson.M:
+		return canonicalDocument(object)
+	case map[string]interface{}:
+		return canonicalDocument(object)
+	case bson.D:
+		document := make(bson.M, len(object))
+		for _, element := range object {
+			document[element.Name] = element.Value
+		}
+		return canonicalDocument(document)
+	case []interface{}:
+		array := make([]interface{}, len(object))
+		for i, element := range object {
+			array[i] = canonicalValue(element)
+		}
+		return array
+	}
+	return value
+}
+
+func canonicalDocument(document map[string]interface{}) bson.D {
+	keys := make([]string, 0, len(document))
+	for key := range document {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	canonical := make(bson.D, 0, len(keys))
+	for _, key := range keys {
+		canonical = append(canonical, bson.DocElem{Name: key, Value: canonicalValue(document[key])})
+	}
+	return canonical
 }
 
 // we need to ensure that oplog entry will be sent to the same job[$hash]
@@ -112,3 +214,112 @@ func (objectIdHasher *PrimaryKeyHasher) DistributeOplogByMod(log *PartialLog, mo
 
 	return Hash(hashObject) % uint32(mod)
 }
+
+// FieldHasher distributes the oplogs by the value of a field configured per
+// namespace, such as user_id. so the documents having the same value are
+// consumed sequentially while different values are consumed concurrently.
+// the oplogs are distributed by namespace if the field is absent or no field
+// is configured on the namespace
+type FieldHasher struct {
+	Hasher
+	// namespace("db" or "db.collection") -> dotted field path
+	fields map[string]string
+}
+
+// NewFieldHasher parses the rules "namespace:field"
+func NewFieldHasher(rules []string) (*FieldHasher, error) {
+	hasher := &FieldHasher{fields: make(map[string]string)}
+	for _, rule := range rules {
+		index := strings.LastIndex(rule, ":")
+		if index <= 0 || index == len(rule)-1 {
+			return nil, fmt.Errorf("shard key field rule[%s] should be namespace:field", rule)
+		}
+		namespace, field := rule[:index], rule[index+1:]
+		if strings.HasPrefix(field, "$") || strings.HasPrefix(field, ".") ||
+			strings.HasSuffix(field, ".") || strings.Contains(field, "..") {
+			return nil, fmt.Errorf("shard key field rule[%s] has invalid field", rule)
+		}
+		if _, exist := hasher.fields[namespace]; exist {
+			return nil, fmt.Errorf("shard key field of namespace[%s] is given twice", namespace)
+		}
+		hasher.fields[namespace] = field
+	}
+	return hasher, nil
+}
+
+// field returns the field configured on the namespace. the collection
+// takes precedence over the database
+func (fieldHasher *FieldHasher) field(namespace string) (string, bool) {
+	if field, ok := fieldHasher.fields[namespace]; ok {
+		return field, true
+	}
+	if index := strings.Index(namespace, "."); index != -1 {
+		field, ok := fieldHasher.fields[namespace[:index]]
+		return field, ok
+	}
+	return "", false
+}
+
+func (fieldHasher *FieldHasher) DistributeOplogByMod(log *PartialLog, mod int) uint32 {
+	if mod == 1 {
+		return 0
+	}
+	if log.Operation == "n" {
+		return DefaultHashValue
+	}
+
+	if field, ok := fieldHasher.field(log.Namespace); ok {
+		if value, ok := GetFieldFromOplog(log, field); ok {
+			return Hash(value) % uint32(mod)
+		}
+	}
+	if len(log.Namespace) == 0 {
+		return DefaultHashValue
+	}
+	return Hash(log.Namespace) % uint32(mod)
+}
+
+// GetFieldFromOplog returns the value of the dotted field in the document
+// of insert and delete. update is looked up in o2 first, and then $set or the
+// replacement document
+func GetFieldFromOplog(log *PartialLog, field string) (interface{}, bool) {
+	switch log.Operation {
+	case "i", "d":
+		return lookupField(log.Object, field)
+	case "u":
+		if value, ok := lookupField(log.Query, field); ok {
+			return value, true
+		}
+		if set, ok := log.Object["$set"].(bson.M); ok {
+			if value, ok := set[field]; ok {
+				return value, true
+			}
+			return lookupField(set, field)
+		}
+		for key := range log.Object {
+			if strings.HasPrefix(key, "$") {
+				// modifiers without the field
+				return nil, false
+			}
+		}
+		return lookupField(log.Object, field)
+	}
+	return nil, false
+}
+
+func lookupField(document bson.M, field string) (interface{}, bool) {
+	path := strings.Split(field, ".")
+	for i, name := range path {
+		value, ok := document[name]
+		if !ok {
+			return nil, false
+		}
+		if i == len(path)-1 {
+			return value, true
+		}
+		if document, ok = value.(bson.M); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,94 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+func TestHashEqual(t *testing.T) {
+	id := bson.ObjectIdHex("5d1b0e7c8f0d3c2a1b4e6f70")
+	tests := []struct {
+		name   string
+		values []interface{}
+	}{
+		{"integer", []interface{}{1, int32(1), int64(1), float64(1)}},
+		{"negative", []interface{}{-7, int32(-7), int64(-7), float64(-7)}},
+		{"large", []interface{}{int64(1) << 40, float64(int64(1) << 40)}},
+		{"string", []interface{}{"abc", "abc"}},
+		{"object id", []interface{}{id, bson.ObjectIdHex(id.Hex())}},
+		{"document", []interface{}{
+			bson.M{"a": 1, "b": "x"},
+			map[string]interface{}{"b": "x", "a": int64(1)},
+			bson.D{{"b", "x"}, {"a", 1.0}},
+			bson.D{{"a", int32(1)}, {"b", "x"}},
+		}},
+		{"embedded", []interface{}{
+			bson.M{"a": bson.M{"y": 2, "x": 1}, "b": []interface{}{1, bson.D{{"d", 1}, {"c", 2}}}},
+			bson.D{{"b", []interface{}{int64(1), bson.M{"c": 2.0, "d": int32(1)}}}, {"a", bson.D{{"x", 1}, {"y", 2}}}},
+		}},
+	}
+	for _, test := range tests {
+		expected := Hash(test.values[0])
+		for _, value := range test.values[1:] {
+			if hash := Hash(value); hash != expected {
+				t.Errorf("%s: %#v is hashed to %d, %#v is hashed to %d", test.name, test.values[0], expected, value, hash)
+			}
+		}
+	}
+}
+
+func TestHashDiffer(t *testing.T) {
+	values := []interface{}{
+		1,
+		"1",
+		1.5,
+		2,
+		int64(1) << 40,
+		"",
+		"abc",
+		bson.ObjectIdHex("5d1b0e7c8f0d3c2a1b4e6f70"),
+		bson.ObjectIdHex("5d1b0e7c8f0d3c2a1b4e6f71"),
+		bson.M{"a": 1},
+		bson.M{"a": 2},
+		bson.M{"b": 1},
+		bson.M{"a": bson.M{"b": 1}},
+		[]interface{}{1, 2},
+		[]interface{}{2, 1},
+		true,
+	}
+	seen := make(map[uint32]interface{}, len(values))
+	for _, value := range values {
+		hash := Hash(value)
+		if other, exist := seen[hash]; exist {
+			t.Errorf("%#v and %#v are hashed to the same %d", other, value, hash)
+		}
+		seen[hash] = value
+	}
+}
+
+// the fast paths should hash the same as the canonical encoding
+func TestHashFastPath(t *testing.T) {
+	for _, value := range []interface{}{
+		"",
+		"abc",
+		bson.ObjectIdHex("5d1b0e7c8f0d3c2a1b4e6f70"),
+		int64(0),
+		int64(-12345),
+	} {
+		data, err := bson.Marshal(bson.D{{"", value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fnvHash(fnvOffset32, data[4:len(data)-1])
+		if hash := Hash(value); hash != expected {
+			t.Errorf("%#v is hashed to %d, should be %d", value, hash, expected)
+		}
+	}
+}
+
+func TestHashNil(t *testing.T) {
+	if hash := Hash(nil); hash != DefaultHashValue {
+		t.Errorf("nil is hashed to %d", hash)
+	}
+}
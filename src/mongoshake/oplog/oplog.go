@@ -17,6 +17,13 @@ type PartialLog struct {
 	Object        bson.M              `bson:"o"`
 	Query         bson.M              `bson:"o2"`
 	UniqueIndexes bson.M              `bson:"uk"`
+	// hash and election term. they locate the entry with ts exactly in
+	// source and absent in old versions
+	Hash int64 `bson:"h,omitempty"`
+	Term int64 `bson:"t,omitempty"`
+	// command generated by collector to create or drop the namespaces in
+	// document sync. they may exist or be missing on target already
+	Meta bool `bson:"meta,omitempty"`
 
 	/*
 	 * Every field subsequent declared is NEVER persistent or
@@ -26,6 +33,13 @@ type PartialLog struct {
 	UniqueIndexesUpdates bson.M // generate by CollisionMatrix
 	RawSize              int    // generate by Decorator
 	SourceId             int    // generate by Validator
+	// the oplog bson which keeps the order of fields that Object loses.
+	// generate by LogParsed and DecodeChain
+	Raw []byte `bson:"-"`
+	// expanded from a transaction by collector. oplogs of one transaction
+	// are adjacent and have the same timestamp. it's carried by the tunnel
+	// message instead of the oplog, see tunnel.MsgTransaction
+	Txn bool `bson:"-"`
 }
 
 func LogEntryEncode(logs []*GenericOplog) [][]byte {
@@ -40,7 +54,27 @@ func LogEntryEncode(logs []*GenericOplog) [][]byte {
 func LogParsed(logs []*GenericOplog) []*PartialLog {
 	parsedLogs := make([]*PartialLog, len(logs), len(logs))
 	for i, log := range logs {
+		log.Parsed.Raw = log.Raw
 		parsedLogs[i] = log.Parsed
 	}
 	return parsedLogs
 }
+
+// SameTxnGroup tells whether the adjacent oplogs are in the same group.
+// oplogs of one transaction make up a group alone and the continuous ones
+// not in any transaction make up one group
+func SameTxnGroup(prev, current *PartialLog) bool {
+	return prev.Txn == current.Txn && (!current.Txn || prev.Timestamp == current.Timestamp)
+}
+
+// GroupByTransaction splits logs into groups by SameTxnGroup
+func GroupByTransaction(logs []*PartialLog) [][]*PartialLog {
+	var groups [][]*PartialLog
+	for i, log := range logs {
+		if i == 0 || !SameTxnGroup(logs[i-1], log) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], log)
+	}
+	return groups
+}
@@ -7,6 +7,7 @@ import(
 	"os"
 
 	"mongoshake/common"
+	"mongoshake/modules"
 	"mongoshake/receiver/configure"
 	"mongoshake/tunnel"
 
@@ -69,6 +70,9 @@ func sanitizeOptions() error {
 	if len(conf.Options.TunnelAddress) == 0 {
 		return errors.New("tunnel address is illegal")
 	}
+	if len(conf.Options.Modules) == 0 {
+		conf.Options.Modules = module.ModuleOrder
+	}
 	return nil
 }
 
@@ -85,9 +89,24 @@ func startup() {
 	 * collector worker number to fulfill load balance. The tunnel that message
 	 * sent to is determined in the collector side: `TMessage.Shard`.
 	 */
+	// decode chain is shared by all the re-players
+	var keyRing *module.KeyRing
+	if conf.Options.EncryptorKeyFile != "" {
+		var err error
+		if keyRing, err = module.LoadKeyRing(conf.Options.EncryptorKeyFile); err != nil {
+			LOG.Critical("Load encryption key file %s failed. %v", conf.Options.EncryptorKeyFile, err)
+			return
+		}
+	}
+	chain, err := module.NewDecodeChain(conf.Options.Modules, keyRing)
+	if err != nil {
+		LOG.Critical("Create decode chain of modules %v failed. %v", conf.Options.Modules, err)
+		return
+	}
+
 	repList := make([]tunnel.Replayer, conf.Options.ReplayerNum)
 	for i := range repList {
-		repList[i] = replayer.NewExampleReplayer()
+		repList[i] = replayer.NewExampleReplayer(chain)
 	}
 
 	LOG.Info("receiver is starting...")
@@ -7,7 +7,6 @@ import(
 	"mongoshake/common"
 
 	LOG "github.com/vinllen/log4go"
-	"github.com/vinllen/mgo/bson"
 )
 
 const (
@@ -17,23 +16,28 @@ const (
 type ExampleReplayer struct {
 	Retransmit bool  // need re-transmit
 	Ack        int64 // ack number
+	// Seq of the last message replayed. it's acked instead of Ack if the
+	// message has tunnel.MsgSequenced, so that the batches of the same
+	// timestamp are acked one by one
+	AckSeq uint64
 
-	// current compressor construct by TMessage
-	// Compress field specific
-	compressor module.Compress
+	// verify, decrypt, decompress and parse the message by the modules
+	// configured. shared by all the re-players
+	*module.DecodeChain
 
 	// pending queue, use to pass message
 	pendingQueue chan *MessageWithCallback
 }
 
 type MessageWithCallback struct {
-	message    *tunnel.TMessage
+	message    *tunnel.WMessage
 	completion func()
 }
 
-func NewExampleReplayer() *ExampleReplayer {
+func NewExampleReplayer(chain *module.DecodeChain) *ExampleReplayer {
 	LOG.Info("ExampleReplayer start. pending queue capacity %d", PendingQueueCapacity)
 	er := &ExampleReplayer {
+		DecodeChain:  chain,
 		pendingQueue: make(chan *MessageWithCallback, PendingQueueCapacity),
 	}
 	go er.handler()
@@ -43,9 +47,9 @@ func NewExampleReplayer() *ExampleReplayer {
 /*
  * Receiver message and do the following steps:
  * 1. if we need re-transmit, this log will be discard
- * 2. validate the checksum
- * 3. decompress
- * 4. put message into channel
+ * 2. decode by the module chain: validate the checksum, decrypt, decompress
+ *    and parse
+ * 3. put message into channel
  * Generally speaking, do not modify this function.
  */
 func (er *ExampleReplayer) Sync(message *tunnel.TMessage, completion func()) int64 {
@@ -59,43 +63,17 @@ func (er *ExampleReplayer) Sync(message *tunnel.TMessage, completion func()) int
 		er.Retransmit = false
 	}
 
-	// validate the checksum value
-	if message.Checksum != 0 {
-		recalculated := message.Crc32()
-		if recalculated != message.Checksum {
-			// we need the peer to retransmission the current message
-			er.Retransmit = true
-			LOG.Critical("Tunnel message checksum bad. recalculated is 0x%x. origin is 0x%x", recalculated, message.Checksum)
-			return tunnel.ReplyChecksumInvalid
-		}
+	decoded, code := er.Decode(message)
+	if code != tunnel.ReplyOK {
+		// we need the peer to retransmission the current message
+		er.Retransmit = true
+		return code
 	}
 
-	// decompress
-	if message.Compress != module.NoCompress {
-		// reuse current compressor handle
-		var err error
-		if er.compressor, err = module.GetCompressorById(message.Compress); err != nil {
-			er.Retransmit = true
-			LOG.Critical("Tunnel message compressor not support. is %d", message.Compress)
-			return tunnel.ReplyCompressorNotSupported
-		}
-		var decompress [][]byte
-		for _, toDecompress := range message.RawLogs {
-			bits, err := er.compressor.Decompress(toDecompress)
-			if err == nil {
-				decompress = append(decompress, bits)
-			}
-		}
-		if len(decompress) != len(message.RawLogs) {
-			er.Retransmit = true
-			LOG.Critical("Decompress result isn't equivalent. len(decompress) %d, len(Logs) %d", len(decompress), len(message.RawLogs))
-			return tunnel.ReplyDecompressInvalid
-		}
-
-		message.RawLogs = decompress
+	er.pendingQueue <- &MessageWithCallback{message: decoded, completion: completion}
+	if message.Tag&tunnel.MsgSequenced != 0 {
+		return int64(er.AckSeq)
 	}
-
-	er.pendingQueue <- &MessageWithCallback{message: message, completion: completion}
 	return er.GetAcked()
 }
 
@@ -108,30 +86,40 @@ func (er *ExampleReplayer) GetAcked() int64 {
  */
 func (er *ExampleReplayer) handler() {
 	for msg := range er.pendingQueue {
-		count := uint64(len(msg.message.RawLogs))
-		if count == 0 {
+		oplogs := msg.message.ParsedLogs
+		if len(oplogs) == 0 {
 			// may be probe request
 			continue
 		}
+		for _, log := range oplogs {
+			LOG.Info(log) // just print for test
+		}
 
-		// parse batched message
-		oplogs := make([]*oplog.PartialLog, len(msg.message.RawLogs), len(msg.message.RawLogs))
-		for i, raw := range msg.message.RawLogs {
-			oplogs[i] = &oplog.PartialLog{}
-			bson.Unmarshal(raw, &oplogs[i])
-			oplogs[i].RawSize = len(raw)
-			LOG.Info(oplogs[i]) // just print for test
+		// oplogs expanded from one source transaction are adjacent and
+		// marked by Txn. replay every group atomically (e.g. in a target
+		// transaction) if atomicity is required
+		for _, group := range oplog.GroupByTransaction(oplogs) {
+			er.replay(group)
 		}
 
 		if callback := msg.completion; callback != nil {
 			callback() // exec callback
 		}
 
-		// get the newest timestamp
+		// get the newest timestamp. ack after all of them are replayed
 		n := len(oplogs)
 		lastTs := utils.TimestampToInt64(oplogs[n - 1].Timestamp)
 		er.Ack = lastTs
-
-		// add logical code below
+		if msg.message.Tag&tunnel.MsgSequenced != 0 {
+			er.AckSeq = msg.message.Seq
+		}
 	}
+}
+
+/*
+ * Users should modify this function according to different demands.
+ * group is a whole transaction if group[0].Txn is true.
+ */
+func (er *ExampleReplayer) replay(group []*oplog.PartialLog) {
+	// add logical code below
 }
\ No newline at end of file
@@ -24,7 +24,7 @@ func (tunnel *FileReader) Link(relativeReplayer []Replayer) error {
 	for i := 0; i != len(tunnel.replayers); i++ {
 		ch := make(chan *TMessage)
 		tunnel.pipe = append(tunnel.pipe, ch)
-		go tunnel.consume(ch)
+		go tunnel.consume(ch, tunnel.replayers[i])
 	}
 
 	var file *os.File
@@ -45,12 +45,12 @@ func (tunnel *FileReader) Link(relativeReplayer []Replayer) error {
 	return nil
 }
 
-func (tunnel *FileReader) consume(pipe <-chan *TMessage) {
+func (tunnel *FileReader) consume(pipe <-chan *TMessage, replayer Replayer) {
 	seqKey := 1
 	for msg := range pipe {
 		// hash corresponding replayer
 		seqKey++
-		switch tunnel.replayers[msg.Shard].Sync(msg, func(context *TMessage, seq int) func() {
+		switch replayer.Sync(msg, func(context *TMessage, seq int) func() {
 			return func() {
 				LOG.Info("Sync tunnel message successful, signature: %d, %d", context.Checksum, seq)
 			}
@@ -61,6 +61,8 @@ func (tunnel *FileReader) consume(pipe <-chan *TMessage) {
 			fallthrough
 		case ReplyCompressorNotSupported:
 			fallthrough
+		case ReplyDecryptInvalid:
+			fallthrough
 		case ReplyNetworkOpFail:
 			LOG.Warn("File tunnel rejected by replayer-%d", msg.Shard)
 		case ReplyError:
@@ -102,6 +104,12 @@ func (tunnel *FileReader) read() {
 		}
 		io.ReadFull(bufferedReader, bits)
 		blockRemained := binary.BigEndian.Uint32(bits)
+		// indexes of the logs in transactions
+		if message.Tag&MsgTransaction != 0 {
+			io.ReadFull(bufferedReader, bits)
+			message.Txns = make([]uint32, binary.BigEndian.Uint32(bits))
+			binary.Read(bufferedReader, binary.BigEndian, message.Txns)
+		}
 
 		logs := [][]byte{}
 		for blockRemained > 0 {
@@ -126,11 +134,9 @@ func (tunnel *FileReader) read() {
 		}
 		message.Tag |= MsgRetransmission
 
-		// resharding
-		if message.Shard >= uint32(len(tunnel.pipe)) {
-			message.Shard %= uint32(len(tunnel.pipe))
-		}
-		tunnel.pipe[message.Shard] <- message
+		// resharding. the shard is kept since it's authenticated by the
+		// encryptor
+		tunnel.pipe[message.Shard%uint32(len(tunnel.pipe))] <- message
 		LOG.Info("File tunnel reader extract oplogs with shard[%d], compressor[%d], count (%d)", message.Shard, message.Compress, len(message.RawLogs))
 	}
 	LOG.Info("File tunnel reader complete. total oplogs %d", totalLogs)
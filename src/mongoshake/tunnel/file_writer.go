@@ -114,6 +114,9 @@ func (tunnel *FileWriter) SyncToDisk() {
 			binary.Write(headerBuffer, binary.BigEndian, message.Compress)
 			binary.Write(headerBuffer, binary.BigEndian, uint32(0xeeeeeeee))
 			binary.Write(headerBuffer, binary.BigEndian, uint32(buffer.Len()))
+			if tag&MsgTransaction != 0 {
+				writeTxns(headerBuffer, binary.BigEndian, message.Txns)
+			}
 			tunnel.dataFile.filehandle.Write(headerBuffer.Bytes())
 			tunnel.dataFile.filehandle.Write(buffer.Bytes())
 			buffer.Reset()
@@ -43,6 +43,10 @@ func (tunnel *KafkaReader) replay() {
 		binary.Read(byteBuffer, binary.BigEndian, &tag)
 		binary.Read(byteBuffer, binary.BigEndian, &hashShard)
 		binary.Read(byteBuffer, binary.BigEndian, &compress)
+		var txns []uint32
+		if tag&MsgTransaction != 0 {
+			txns = readTxns(byteBuffer, binary.BigEndian)
+		}
 
 		var logCount uint32
 		binary.Read(byteBuffer, binary.BigEndian, &logCount)
@@ -57,19 +61,17 @@ func (tunnel *KafkaReader) replay() {
 			logCount--
 		}
 
-		newLogs := &TMessage{Checksum: checksum, Tag: tag, Shard: hashShard, Compress: compress, RawLogs: oplogs}
-
-		// re-sharding
-		if newLogs.Shard >= uint32(len(tunnel.replayer)) {
-			newLogs.Shard %= uint32(len(tunnel.replayer))
-		}
+		newLogs := &TMessage{Checksum: checksum, Tag: tag, Shard: hashShard, Compress: compress, RawLogs: oplogs,
+			Txns: txns}
 
 		if toRetry != nil {
 			newLogs.Tag |= MsgRetransmission
 		}
 		toRetry = nil
 
-		replay := tunnel.replayer[newLogs.Shard]
+		// re-sharding. the shard is kept since it's authenticated by the
+		// encryptor
+		replay := tunnel.replayer[newLogs.Shard%uint32(len(tunnel.replayer))]
 		if replay.Sync(newLogs, func(context *kafka.Message) func() {
 			return func() {
 				// user can add the ack mechanism so that send ack
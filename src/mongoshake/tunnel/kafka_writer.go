@@ -40,6 +40,10 @@ func (tunnel *KafkaWriter) Send(message *WMessage) int64 {
 	binary.Write(byteBuffer, binary.BigEndian, uint32(message.Shard))
 	// compressor
 	binary.Write(byteBuffer, binary.BigEndian, uint32(message.Compress))
+	// indexes of the logs in transactions
+	if message.Tag&MsgTransaction != 0 {
+		writeTxns(byteBuffer, binary.BigEndian, message.Txns)
+	}
 	// serialize log count
 	binary.Write(byteBuffer, binary.BigEndian, uint32(len(message.RawLogs)))
 
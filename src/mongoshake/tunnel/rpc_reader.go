@@ -35,11 +35,9 @@ type TunnelRPC struct {
 }
 
 func (rpc *TunnelRPC) Transfer(message *TMessage, response *int64) error {
-	// hash corresponding replayer and re-shard
-	if message.Shard >= uint32(len(rpcReplayer)) {
-		message.Shard %= uint32(len(rpcReplayer))
-	}
-	*response = rpcReplayer[message.Shard].Sync(message, nil)
+	// hash corresponding replayer and re-shard. the shard is kept since
+	// it's authenticated by the encryptor
+	*response = rpcReplayer[message.Shard%uint32(len(rpcReplayer))].Sync(message, nil)
 
 	return nil
 }
@@ -103,11 +103,9 @@ func (reader *TCPReader) recvTransfer(socket *net.TCPConn) {
 		message := new(TMessage)
 		message.FromBytes(payload, binary.BigEndian)
 
-		// hash corresponding replayer and re-sharding
-		if message.Shard >= uint32(len(reader.replayer)) {
-			message.Shard %= uint32(len(reader.replayer))
-		}
-		reader.ack = reader.replayer[message.Shard].Sync(message, nil)
+		// hash corresponding replayer and re-sharding. the shard is kept
+		// since it's authenticated by the encryptor
+		reader.ack = reader.replayer[message.Shard%uint32(len(reader.replayer))].Sync(message, nil)
 	}
 }
 
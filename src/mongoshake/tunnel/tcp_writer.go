@@ -27,7 +27,8 @@ import (
 //		|  0x00201314   |       0x01       |      0x01    |   0xFFFFF  |     4096        |
 //		-----------------------------------------------------------------------------------
 //
-//		[ PacketWrite payload ]
+//		[ PacketWrite payload. seq(8B) follows compress if tag has MsgSequenced. then count(4B) and
+//		  index(4B) of the logs in transactions if tag has MsgTransaction ]
 //		-------------------------------------------------------------------------------------------------------------------------------------------------
 //		|    cksum(4B)    |  tag(4B)  |  shard(4B)  |  compress(4B) |  number(4B)  |  len(4B)  |  log([]byte)  |  len(4B)  |  log([]byte)  |
 //		-------------------------------------------------------------------------------------------------------------------------------------------------
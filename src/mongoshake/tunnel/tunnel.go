@@ -21,6 +21,19 @@ const (
 	MsgResident       = 0x00000100
 	MsgPersistent     = 0x00001000
 	MsgStorageBackend = 0x00010000
+	// RawLogs is one block compressed from all the logs packed by
+	// PackRawLogs. Compress tells the compressor
+	MsgCompressedBlock = 0x00100000
+	// RawLogs is one block encrypted from all the logs packed by
+	// PackRawLogs and prefixed by the key id
+	MsgEncrypted = 0x01000000
+	// Seq is the sequence of the batch in its shard. the receiver acks by
+	// the Seq of the last message replayed instead of the timestamp, so
+	// the batches of the same timestamp are acked one by one
+	MsgSequenced = 0x10000000
+	// Txns is the indexes of the logs expanded from transactions. the
+	// marker isn't kept in the oplogs
+	MsgTransaction = 0x20000000
 )
 
 const (
@@ -33,6 +46,7 @@ const (
 	ReplyChecksumInvalid        int64 = -6
 	ReplyCompressorNotSupported int64 = -7
 	ReplyDecompressInvalid            = -8
+	ReplyDecryptInvalid         int64 = -9
 )
 
 // WMessage wrapped TMessage
@@ -46,6 +60,10 @@ type TMessage struct {
 	Shard      uint32
 	Compress   uint32
 	RawLogs    [][]byte
+	// only if Tag has MsgSequenced
+	Seq uint64
+	// only if Tag has MsgTransaction
+	Txns []uint32
 }
 
 func (msg *TMessage) Crc32() uint32 {
@@ -62,6 +80,12 @@ func (msg *TMessage) ToBytes(order binary.ByteOrder) []byte {
 	binary.Write(&buffer, order, msg.Tag)
 	binary.Write(&buffer, order, msg.Shard)
 	binary.Write(&buffer, order, msg.Compress)
+	if msg.Tag&MsgSequenced != 0 {
+		binary.Write(&buffer, order, msg.Seq)
+	}
+	if msg.Tag&MsgTransaction != 0 {
+		writeTxns(&buffer, order, msg.Txns)
+	}
 	binary.Write(&buffer, order, uint32(len(msg.RawLogs)))
 	for _, log := range msg.RawLogs {
 		binary.Write(&buffer, order, uint32(len(log)))
@@ -76,6 +100,12 @@ func (msg *TMessage) FromBytes(buf []byte, order binary.ByteOrder) {
 	binary.Read(buffer, order, &msg.Tag)
 	binary.Read(buffer, order, &msg.Shard)
 	binary.Read(buffer, order, &msg.Compress)
+	if msg.Tag&MsgSequenced != 0 {
+		binary.Read(buffer, order, &msg.Seq)
+	}
+	if msg.Tag&MsgTransaction != 0 {
+		msg.Txns = readTxns(buffer, order)
+	}
 	var n uint32
 	binary.Read(buffer, order, &n)
 	nimo.AssertTrue((buffer.Len() != 0 && msg.Tag&MsgProbe == 0) ||
@@ -97,6 +127,64 @@ func (msg *TMessage) FromBytes(buf []byte, order binary.ByteOrder) {
 	}
 }
 
+// TxnIndexes returns the indexes of the logs in transactions
+func TxnIndexes(logs []*oplog.PartialLog) []uint32 {
+	var txns []uint32
+	for i, log := range logs {
+		if log.Txn {
+			txns = append(txns, uint32(i))
+		}
+	}
+	return txns
+}
+
+// writeTxns writes the count of indexes followed by them
+func writeTxns(buffer *bytes.Buffer, order binary.ByteOrder, txns []uint32) {
+	binary.Write(buffer, order, uint32(len(txns)))
+	for _, index := range txns {
+		binary.Write(buffer, order, index)
+	}
+}
+
+func readTxns(buffer *bytes.Buffer, order binary.ByteOrder) []uint32 {
+	var n uint32
+	binary.Read(buffer, order, &n)
+	nimo.AssertTrue(uint64(n)*4 <= uint64(buffer.Len()), "transaction indexes in msg are truncated")
+	txns := make([]uint32, n)
+	for i := range txns {
+		binary.Read(buffer, order, &txns[i])
+	}
+	return txns
+}
+
+// PackRawLogs concatenates the logs and every one is prefixed by its length
+func PackRawLogs(logs [][]byte) []byte {
+	buffer := bytes.Buffer{}
+	for _, log := range logs {
+		binary.Write(&buffer, binary.BigEndian, uint32(len(log)))
+		buffer.Write(log)
+	}
+	return buffer.Bytes()
+}
+
+// UnpackRawLogs splits the block packed by PackRawLogs into logs
+func UnpackRawLogs(block []byte) ([][]byte, error) {
+	var logs [][]byte
+	for len(block) != 0 {
+		if len(block) < 4 {
+			return nil, fmt.Errorf("log length is truncated with %d bytes left", len(block))
+		}
+		length := binary.BigEndian.Uint32(block)
+		block = block[4:]
+		if uint32(len(block)) < length {
+			return nil, fmt.Errorf("log is truncated. length %d, %d bytes left", length, len(block))
+		}
+		logs = append(logs, block[:length])
+		block = block[length:]
+	}
+	return logs, nil
+}
+
 func (msg *TMessage) String() string {
 	return fmt.Sprintf("[cksum:%d, tag:%d, shard:%d, compress:%d, logs_len:%d]",
 		msg.Checksum, msg.Tag, msg.Shard, msg.Compress, len(msg.RawLogs))
@@ -131,8 +219,9 @@ type Writer interface {
 	 * write the real tunnel message to tunnel.
 	 *
 	 * return the right ACK offset value with positive number. if AckRequired is set
-	 * this ACk offset is used to purge buffered oplogs. Otherwise upper layer use
-	 * the max oplog ts as ACK offset and discard the returned value (ACK offset).
+	 * this ACk offset is used to purge buffered oplogs. it's the Seq acked if the
+	 * message has MsgSequenced. Otherwise upper layer use the max oplog ts as ACK
+	 * offset and discard the returned value (ACK offset).
 	 * error on returning a negative number
 	 */
 	Send(message *WMessage) int64
@@ -199,7 +288,8 @@ type Reader interface {
 
 type Replayer interface {
 	/**
-	 * Replay oplog entry with batched Oplog
+	 * Replay oplog entry with batched Oplog. return the ack offset, which
+	 * is the Seq of the last message replayed if message has MsgSequenced
 	 *
 	 */
 	Sync(message *TMessage, completion func()) int64
@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestPackRawLogs(t *testing.T) {
+	tests := [][][]byte{
+		nil,
+		{{}},
+		{[]byte("a")},
+		{[]byte("first"), {}, []byte("third"), bytes.Repeat([]byte{0xff}, 70000)},
+	}
+	for _, logs := range tests {
+		unpacked, err := UnpackRawLogs(PackRawLogs(logs))
+		if err != nil {
+			t.Errorf("unpack %d logs failed. %v", len(logs), err)
+			continue
+		}
+		if len(unpacked) != len(logs) {
+			t.Errorf("%d logs are unpacked to %d", len(logs), len(unpacked))
+			continue
+		}
+		for i := range logs {
+			if !bytes.Equal(unpacked[i], logs[i]) {
+				t.Errorf("log %d is unpacked to %v, should be %v", i, unpacked[i], logs[i])
+			}
+		}
+	}
+}
+
+func TestUnpackRawLogsTruncated(t *testing.T) {
+	block := PackRawLogs([][]byte{[]byte("first"), []byte("second")})
+	for length := 1; length < len(block); length++ {
+		if length == 4+len("first") {
+			// the end of the first log
+			continue
+		}
+		if logs, err := UnpackRawLogs(block[:length]); err == nil {
+			t.Errorf("block truncated to %d bytes is unpacked to %q", length, logs)
+		}
+	}
+	// the length exceeding the block
+	if logs, err := UnpackRawLogs([]byte{0xff, 0xff, 0xff, 0xff, 'a'}); err == nil {
+		t.Errorf("invalid length is unpacked to %q", logs)
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	tests := []TMessage{
+		{Checksum: 1, Tag: MsgNormal, Shard: 2, Compress: 3, RawLogs: [][]byte{[]byte("a"), []byte("bc")}},
+		{Checksum: 1, Tag: MsgNormal | MsgSequenced, Shard: 2, Compress: 3, Seq: 1 << 40,
+			RawLogs: [][]byte{[]byte("a")}},
+		{Tag: MsgProbe | MsgSequenced, Seq: 7},
+		{Tag: MsgSequenced | MsgTransaction, Seq: 8, Txns: []uint32{0, 2},
+			RawLogs: [][]byte{[]byte("a"), []byte("b"), []byte("c")}},
+		{Tag: MsgTransaction, Txns: []uint32{}, RawLogs: [][]byte{[]byte("a")}},
+	}
+	for _, message := range tests {
+		decoded := new(TMessage)
+		decoded.FromBytes(message.ToBytes(binary.BigEndian), binary.BigEndian)
+		if decoded.Checksum != message.Checksum || decoded.Tag != message.Tag || decoded.Shard != message.Shard ||
+			decoded.Compress != message.Compress || decoded.Seq != message.Seq ||
+			!reflect.DeepEqual(decoded.Txns, message.Txns) || len(decoded.RawLogs) != len(message.RawLogs) {
+			t.Errorf("%v seq %d is decoded to %v seq %d", &message, message.Seq, decoded, decoded.Seq)
+			continue
+		}
+		for i := range message.RawLogs {
+			if !bytes.Equal(decoded.RawLogs[i], message.RawLogs[i]) {
+				t.Errorf("log %d is decoded to %q, should be %q", i, decoded.RawLogs[i], message.RawLogs[i])
+			}
+		}
+	}
+}